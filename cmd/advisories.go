@@ -0,0 +1,631 @@
+// Cmd advisories reads a local database of OSV advisories and matches the packages of an image against it
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// AdvisoryDir is the directory OSV advisories are synced into, as JSON files or the zip exports of
+// osv.dev. Set with `advisory_dir` in config, or `--db`
+var AdvisoryDir string = ""
+
+// The severities of advisories, from the worst
+const (
+	severityCritical = "critical"
+	severityHigh     = "high"
+	severityMedium   = "medium"
+	severityLow      = "low"
+	severityUnknown  = "unknown"
+)
+
+// vulnSeverityRank orders severities, advisories without one rank lowest
+var vulnSeverityRank = map[string]int{
+	severityCritical: 4,
+	severityHigh:     3,
+	severityMedium:   2,
+	severityLow:      1,
+	severityUnknown:  0,
+}
+
+// packageEcosystems are the OSV ecosystems of lockfile packages, by package URL type
+var packageEcosystems = map[string]string{
+	"npm":      "npm",
+	"composer": "Packagist",
+	"gem":      "RubyGems",
+	"pypi":     "PyPI",
+	"cargo":    "crates.io",
+	"golang":   "Go",
+}
+
+// osvAdvisory is an advisory in the OSV format, https://ossf.github.io/osv-schema/
+type osvAdvisory struct {
+	ID               string                 `json:"id"`
+	Aliases          []string               `json:"aliases"`
+	Summary          string                 `json:"summary"`
+	Withdrawn        string                 `json:"withdrawn"`
+	Severity         []osvSeverity          `json:"severity"`
+	Affected         []osvAffected          `json:"affected"`
+	DatabaseSpecific map[string]interface{} `json:"database_specific"`
+}
+
+type osvSeverity struct {
+	Type  string `json:"type"`
+	Score string `json:"score"`
+}
+
+// osvAffected is a package an advisory applies to, and its affected versions
+type osvAffected struct {
+	Package           osvPackage             `json:"package"`
+	Ranges            []osvRange             `json:"ranges"`
+	Versions          []string               `json:"versions"`
+	Severity          []osvSeverity          `json:"severity"`
+	EcosystemSpecific map[string]interface{} `json:"ecosystem_specific"`
+	DatabaseSpecific  map[string]interface{} `json:"database_specific"`
+}
+
+type osvPackage struct {
+	Ecosystem string `json:"ecosystem"`
+	Name      string `json:"name"`
+}
+
+type osvRange struct {
+	Type   string     `json:"type"`
+	Events []osvEvent `json:"events"`
+}
+
+type osvEvent struct {
+	Introduced   string `json:"introduced,omitempty"`
+	Fixed        string `json:"fixed,omitempty"`
+	LastAffected string `json:"last_affected,omitempty"`
+	Limit        string `json:"limit,omitempty"`
+}
+
+// advisoryDB holds advisories by ecosystem and package name, see advisoryKey
+type advisoryDB struct {
+	advisories map[string][]*osvAdvisory
+	Count      int
+}
+
+// vulnFinding is an advisory that applies to a package in an image
+type vulnFinding struct {
+	ID       string   `json:"id"`
+	Aliases  []string `json:"aliases,omitempty"`
+	Summary  string   `json:"summary,omitempty"`
+	Severity string   `json:"severity"`
+	Package  string   `json:"package"`
+	Version  string   `json:"version"`
+	Type     string   `json:"type"`
+	Fixed    string   `json:"fixed,omitempty"`
+	// Source is the file in the image the package was found in
+	Source string `json:"source"`
+	// Ignored is the reason from the ignore file, when the finding is ignored
+	Ignored string `json:"ignored,omitempty"`
+}
+
+// advisoryDBs caches databases by directory, images of a build are scanned in parallel
+var advisoryDBs = map[string]*advisoryDB{}
+var advisoryDBsLock sync.Mutex
+
+// loadAdvisoryDB reads the advisories in a directory, once
+func loadAdvisoryDB(dir string) (*advisoryDB, error) {
+
+	if dir == "" {
+		return nil, fmt.Errorf("no advisory database, set advisory_dir or --db to a directory of OSV advisories")
+	}
+
+	advisoryDBsLock.Lock()
+	defer advisoryDBsLock.Unlock()
+
+	if db, ok := advisoryDBs[dir]; ok {
+		return db, nil
+	}
+
+	db, err := readAdvisoryDB(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	advisoryDBs[dir] = db
+
+	return db, nil
+}
+
+// readAdvisoryDB reads every .json and .zip file below a directory
+func readAdvisoryDB(dir string) (*advisoryDB, error) {
+
+	db := &advisoryDB{advisories: map[string][]*osvAdvisory{}}
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".json":
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			return db.addJSON(path, content)
+		case ".zip":
+			return db.addZip(path)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if db.Count == 0 {
+		return nil, fmt.Errorf("no OSV advisories found in %s", dir)
+	}
+
+	return db, nil
+}
+
+// addZip adds the advisories of an osv.dev export, `all.zip`
+func (db *advisoryDB) addZip(path string) error {
+
+	archive, err := zip.OpenReader(path)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	defer archive.Close()
+
+	for _, file := range archive.File {
+		if !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+			continue
+		}
+
+		r, err := file.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		content, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+
+		if err := db.addJSON(path+"/"+file.Name, content); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// addJSON adds a file holding a single advisory, or a list of them. JSON that isn't an advisory is skipped.
+func (db *advisoryDB) addJSON(name string, content []byte) error {
+
+	var advisories []*osvAdvisory
+
+	content = bytes.TrimSpace(content)
+
+	if bytes.HasPrefix(content, []byte("[")) {
+		if err := json.Unmarshal(content, &advisories); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	} else {
+		advisory := &osvAdvisory{}
+		if err := json.Unmarshal(content, advisory); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		advisories = append(advisories, advisory)
+	}
+
+	for _, advisory := range advisories {
+		db.add(advisory)
+	}
+
+	return nil
+}
+
+// add indexes an advisory under every package it affects, withdrawn advisories are left out
+func (db *advisoryDB) add(advisory *osvAdvisory) {
+
+	if advisory.ID == "" || advisory.Withdrawn != "" || len(advisory.Affected) == 0 {
+		return
+	}
+
+	db.Count++
+
+	for _, affected := range advisory.Affected {
+		key := advisoryKey(affected.Package.Ecosystem, affected.Package.Name)
+
+		indexed := db.advisories[key]
+		if len(indexed) > 0 && indexed[len(indexed)-1] == advisory {
+			continue
+		}
+
+		db.advisories[key] = append(indexed, advisory)
+	}
+}
+
+// advisoryKey is how advisories are looked up, `Debian/openssl`
+func advisoryKey(ecosystem string, name string) string {
+
+	base := ecosystemBase(ecosystem)
+
+	return base + "/" + normalizePackageName(base, name)
+}
+
+// ecosystemBase drops the release from an ecosystem, `Debian:11` is `Debian`
+func ecosystemBase(ecosystem string) string {
+
+	if i := strings.Index(ecosystem, ":"); i >= 0 {
+		return ecosystem[:i]
+	}
+
+	return ecosystem
+}
+
+// normalizePackageName makes names compare the way their ecosystem does
+func normalizePackageName(ecosystem string, name string) string {
+
+	switch ecosystem {
+	case "PyPI":
+		return strings.NewReplacer("_", "-", ".", "-").Replace(strings.ToLower(name))
+	case "Packagist":
+		return strings.ToLower(name)
+	}
+
+	return name
+}
+
+// packageEcosystem returns the OSV ecosystem of a package, with the release for OS packages, `Debian:11` or
+// `Alpine:v3.16`. Packages without an ecosystem aren't scanned.
+func packageEcosystem(p imagePackage, release osRelease) string {
+
+	if ecosystem, ok := packageEcosystems[p.Type]; ok {
+		return ecosystem
+	}
+
+	major := strings.Split(release.VersionID, ".")[0]
+
+	withRelease := func(ecosystem string, version string) string {
+		if version == "" {
+			return ecosystem
+		}
+		return ecosystem + ":" + version
+	}
+
+	switch p.Type {
+	case "deb":
+		if release.ID == "ubuntu" {
+			return withRelease("Ubuntu", release.VersionID)
+		}
+		return withRelease("Debian", major)
+	case "apk":
+		parts := strings.Split(release.VersionID, ".")
+		if len(parts) < 2 {
+			return "Alpine"
+		}
+		return "Alpine:v" + parts[0] + "." + parts[1]
+	case "rpm":
+		switch {
+		case release.ID == "rocky":
+			return withRelease("Rocky Linux", major)
+		case release.ID == "almalinux":
+			return withRelease("AlmaLinux", major)
+		case release.ID == "rhel":
+			return "Red Hat"
+		case strings.HasPrefix(release.ID, "opensuse"):
+			return "openSUSE"
+		case release.ID == "sles":
+			return "SUSE"
+		}
+	}
+
+	return ""
+}
+
+// ecosystemMatches reports if an advisory for the affected ecosystem applies to packages of another. An
+// advisory without a release applies to all of them, `Ubuntu:22.04` matches `Ubuntu:22.04:LTS`.
+func ecosystemMatches(affected string, ecosystem string) bool {
+
+	if affected == ecosystem || strings.HasPrefix(affected, ecosystem+":") {
+		return true
+	}
+
+	return !strings.Contains(affected, ":") && affected == ecosystemBase(ecosystem)
+}
+
+// match returns the advisories affecting the packages in an image. OS packages are matched by the source
+// package they were built from, so a finding is reported once for all the binary packages of a source.
+func (db *advisoryDB) match(contents *imageContents) []vulnFinding {
+
+	var findings []vulnFinding
+	seen := map[string]bool{}
+
+	for _, p := range contents.Packages {
+		ecosystem := packageEcosystem(p, contents.OS)
+		if ecosystem == "" || p.Version == "" {
+			continue
+		}
+
+		name := p.Name
+		if p.Origin != "" {
+			name = p.Origin
+		}
+
+		base := ecosystemBase(ecosystem)
+		compare := ecosystemVersionCompare(ecosystem)
+
+		for _, advisory := range db.advisories[advisoryKey(ecosystem, name)] {
+			for _, affected := range advisory.Affected {
+				if !ecosystemMatches(affected.Package.Ecosystem, ecosystem) ||
+					normalizePackageName(base, affected.Package.Name) != normalizePackageName(base, name) {
+					continue
+				}
+
+				vulnerable, fixed := affected.affects(p.Version, compare)
+				if !vulnerable {
+					continue
+				}
+
+				key := strings.Join([]string{advisory.ID, p.Type, name, p.Version, p.Source}, "\x00")
+				if !seen[key] {
+					seen[key] = true
+					findings = append(findings, vulnFinding{
+						ID:       advisory.ID,
+						Aliases:  advisory.Aliases,
+						Summary:  advisory.Summary,
+						Severity: advisory.severity(affected),
+						Package:  name,
+						Version:  p.Version,
+						Type:     p.Type,
+						Fixed:    fixed,
+						Source:   p.Source,
+					})
+				}
+				break
+			}
+		}
+	}
+
+	sortFindings(findings)
+
+	return findings
+}
+
+// sortFindings puts the worst findings first, then orders them by package and advisory
+func sortFindings(findings []vulnFinding) {
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		a, b := findings[i], findings[j]
+		if vulnSeverityRank[a.Severity] != vulnSeverityRank[b.Severity] {
+			return vulnSeverityRank[a.Severity] > vulnSeverityRank[b.Severity]
+		}
+		if a.Package != b.Package {
+			return a.Package < b.Package
+		}
+		return a.ID < b.ID
+	})
+}
+
+// affects reports if a version is affected, listed or inside one of the ranges, and the version it is
+// fixed in when a range says so. Git commit ranges can't be checked against a package version and are skipped.
+func (a osvAffected) affects(version string, compare versionCompare) (bool, string) {
+
+	for _, v := range a.Versions {
+		if v == version {
+			return true, ""
+		}
+	}
+
+	for _, r := range a.Ranges {
+		if r.Type == "GIT" {
+			continue
+		}
+
+		if vulnerable, fixed := rangeAffects(r.Events, version, compare); vulnerable {
+			return true, fixed
+		}
+	}
+
+	return false, ""
+}
+
+// rangeAffects walks the events of a range in version order, as the OSV schema describes
+func rangeAffects(events []osvEvent, version string, compare versionCompare) (bool, string) {
+
+	eventVersion := func(e osvEvent) string {
+		for _, v := range []string{e.Introduced, e.Fixed, e.LastAffected, e.Limit} {
+			if v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	sorted := append([]osvEvent{}, events...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Introduced == "0" || sorted[j].Introduced == "0" {
+			return sorted[i].Introduced == "0" && sorted[j].Introduced != "0"
+		}
+		return compare(eventVersion(sorted[i]), eventVersion(sorted[j])) < 0
+	})
+
+	vulnerable := false
+	fixed := ""
+
+	for _, e := range sorted {
+		switch {
+		case e.Introduced != "":
+			if e.Introduced == "0" || compare(version, e.Introduced) >= 0 {
+				vulnerable = true
+			}
+		case e.Fixed != "":
+			if compare(version, e.Fixed) >= 0 {
+				vulnerable = false
+			} else if vulnerable && fixed == "" {
+				fixed = e.Fixed
+			}
+		case e.LastAffected != "":
+			if compare(version, e.LastAffected) > 0 {
+				vulnerable = false
+			}
+		case e.Limit != "":
+			if compare(version, e.Limit) >= 0 {
+				vulnerable = false
+			}
+		}
+	}
+
+	if !vulnerable {
+		return false, ""
+	}
+
+	return true, fixed
+}
+
+// severity returns how bad an advisory is for a package: the severity the database gives it, or from its
+// CVSS v3 vector, `unknown` without either
+func (a *osvAdvisory) severity(affected osvAffected) string {
+
+	for _, specific := range []map[string]interface{}{affected.EcosystemSpecific, affected.DatabaseSpecific, a.DatabaseSpecific} {
+		if label, ok := specific["severity"].(string); ok {
+			if severity := normalizeVulnSeverity(label); severity != severityUnknown {
+				return severity
+			}
+		}
+	}
+
+	for _, severities := range [][]osvSeverity{affected.Severity, a.Severity} {
+		for _, s := range severities {
+			if s.Type != "CVSS_V3" {
+				continue
+			}
+			if score, err := cvss3BaseScore(s.Score); err == nil {
+				return cvssSeverity(score)
+			}
+		}
+	}
+
+	return severityUnknown
+}
+
+// normalizeVulnSeverity maps the severity labels used by advisory databases to ours
+func normalizeVulnSeverity(label string) string {
+
+	switch strings.ToLower(strings.TrimSpace(label)) {
+	case "critical":
+		return severityCritical
+	case "high", "important":
+		return severityHigh
+	case "medium", "moderate":
+		return severityMedium
+	case "low", "negligible", "unimportant":
+		return severityLow
+	}
+
+	return severityUnknown
+}
+
+// cvssSeverity is the qualitative severity of a CVSS score
+func cvssSeverity(score float64) string {
+
+	switch {
+	case score >= 9:
+		return severityCritical
+	case score >= 7:
+		return severityHigh
+	case score >= 4:
+		return severityMedium
+	case score > 0:
+		return severityLow
+	}
+
+	return severityUnknown
+}
+
+// cvss3Weights are the values of the CVSS v3 base metrics
+var cvss3Weights = map[string]map[string]float64{
+	"AV": {"N": 0.85, "A": 0.62, "L": 0.55, "P": 0.2},
+	"AC": {"L": 0.77, "H": 0.44},
+	"PR": {"N": 0.85, "L": 0.62, "H": 0.27},
+	"UI": {"N": 0.85, "R": 0.62},
+	"C":  {"H": 0.56, "L": 0.22, "N": 0},
+	"I":  {"H": 0.56, "L": 0.22, "N": 0},
+	"A":  {"H": 0.56, "L": 0.22, "N": 0},
+}
+
+// cvss3BaseScore calculates the base score of a CVSS v3 vector, `CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H`
+func cvss3BaseScore(vector string) (float64, error) {
+
+	if !strings.HasPrefix(vector, "CVSS:3.") {
+		return 0, fmt.Errorf("not a CVSS v3 vector: %s", vector)
+	}
+
+	metrics := map[string]string{}
+	for _, part := range strings.Split(vector, "/")[1:] {
+		kv := strings.SplitN(part, ":", 2)
+		if len(kv) == 2 {
+			metrics[kv[0]] = kv[1]
+		}
+	}
+
+	changed := metrics["S"] == "C"
+	if !changed && metrics["S"] != "U" {
+		return 0, fmt.Errorf("CVSS vector without a scope: %s", vector)
+	}
+
+	values := map[string]float64{}
+	for metric, weights := range cvss3Weights {
+		value, ok := weights[metrics[metric]]
+		if !ok {
+			return 0, fmt.Errorf("CVSS vector without a valid %s: %s", metric, vector)
+		}
+		values[metric] = value
+	}
+
+	// privileges count for more when the scope changes
+	if changed && metrics["PR"] == "L" {
+		values["PR"] = 0.68
+	} else if changed && metrics["PR"] == "H" {
+		values["PR"] = 0.5
+	}
+
+	iss := 1 - (1-values["C"])*(1-values["I"])*(1-values["A"])
+
+	impact := 6.42 * iss
+	if changed {
+		impact = 7.52*(iss-0.029) - 3.25*math.Pow(iss-0.02, 15)
+	}
+
+	if impact <= 0 {
+		return 0, nil
+	}
+
+	exploitability := 8.22 * values["AV"] * values["AC"] * values["PR"] * values["UI"]
+
+	if changed {
+		return cvssRoundUp(math.Min(1.08*(impact+exploitability), 10)), nil
+	}
+
+	return cvssRoundUp(math.Min(impact+exploitability, 10)), nil
+}
+
+// cvssRoundUp rounds up to one decimal the way the CVSS v3.1 specification does, avoiding float errors
+func cvssRoundUp(value float64) float64 {
+
+	scaled := int64(math.Round(value * 100000))
+	if scaled%10000 == 0 {
+		return float64(scaled) / 100000
+	}
+
+	return float64(scaled/10000+1) / 10
+}
@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"archive/zip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestAdvisories writes an advisory database of loose files, a list of advisories and a zip export
+func writeTestAdvisories(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "mach-advisories")
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	files := map[string]string{
+		"debian/debian.json": `[
+			{"id": "DSA-5343-1", "aliases": ["CVE-2023-0286"], "summary": "openssl security update",
+			 "affected": [{"package": {"ecosystem": "Debian:11", "name": "openssl"},
+			               "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1.1.1n-0+deb11u4"}]}]}]},
+			{"id": "DSA-5000-1",
+			 "affected": [{"package": {"ecosystem": "Debian:10", "name": "openssl"},
+			               "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "0"}, {"fixed": "1.1.1n-0+deb10u9"}]}]}]}
+		]`,
+		"npm/GHSA-35jh-r3h4-6jhm.json": `{"id": "GHSA-35jh-r3h4-6jhm", "aliases": ["CVE-2021-23337"], "summary": "Command Injection in lodash",
+			"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:H/UI:N/S:U/C:H/I:H/A:H"}],
+			"database_specific": {"severity": "HIGH"},
+			"affected": [{"package": {"ecosystem": "npm", "name": "lodash"},
+			              "ranges": [{"type": "SEMVER", "events": [{"introduced": "0"}, {"fixed": "4.17.21"}]},
+			                         {"type": "GIT", "events": [{"introduced": "0"}, {"fixed": "c6e2817"}]}]}]}`,
+		"npm/GHSA-withdrawn.json": `{"id": "GHSA-withdrawn", "withdrawn": "2022-01-01T00:00:00Z",
+			"affected": [{"package": {"ecosystem": "npm", "name": "lodash"}, "versions": ["4.17.20"]}]}`,
+		"npm/GHSA-listed.json": `{"id": "GHSA-listed",
+			"affected": [{"package": {"ecosystem": "npm", "name": "lodash"}, "versions": ["4.17.19"]}]}`,
+		"README.md": "not an advisory",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			assert.FailNow(t, err.Error())
+		}
+	}
+
+	archive, err := os.Create(filepath.Join(dir, "PyPI.zip"))
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+
+	zw := zip.NewWriter(archive)
+	w, _ := zw.Create("PYSEC-2022-1.json")
+	w.Write([]byte(`{"id": "PYSEC-2022-1", "aliases": ["CVE-2022-22818"],
+		"severity": [{"type": "CVSS_V3", "score": "CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H"}],
+		"affected": [{"package": {"ecosystem": "PyPI", "name": "django"},
+		              "ranges": [{"type": "ECOSYSTEM", "events": [{"introduced": "4.0"}, {"fixed": "4.0.2"},
+		                                                          {"introduced": "3.2"}, {"fixed": "3.2.12"}]}]}]}`))
+	zw.Close()
+	archive.Close()
+
+	return dir
+}
+
+func testImageContents() *imageContents {
+
+	return &imageContents{
+		OS: osRelease{ID: "debian", VersionID: "11"},
+		Packages: []imagePackage{
+			{Name: "libssl1.1", Version: "1.1.1n-0+deb11u3", Type: "deb", Origin: "openssl", Source: "/var/lib/dpkg/status"},
+			{Name: "openssl", Version: "1.1.1n-0+deb11u3", Type: "deb", Origin: "openssl", Source: "/var/lib/dpkg/status"},
+			{Name: "curl", Version: "7.74.0-1.3+deb11u7", Type: "deb", Origin: "curl", Source: "/var/lib/dpkg/status"},
+			{Name: "lodash", Version: "4.17.20", Type: "npm", Source: "/srv/app/package-lock.json"},
+			{Name: "Django", Version: "3.2.11", Type: "pypi", Source: "/srv/app/Pipfile.lock"},
+		},
+	}
+}
+
+func Test_readAdvisoryDB(t *testing.T) {
+
+	db, err := readAdvisoryDB(writeTestAdvisories(t))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 5, db.Count, "withdrawn advisories are left out")
+	assert.Len(t, db.advisories["Debian/openssl"], 2)
+	assert.Len(t, db.advisories["PyPI/django"], 1, "advisories in zip exports are read")
+
+	_, err = readAdvisoryDB(filepath.Join(writeTestAdvisories(t), "debian", "missing"))
+	assert.Error(t, err)
+
+	empty, _ := ioutil.TempDir("", "mach-advisories")
+	defer os.RemoveAll(empty)
+
+	_, err = readAdvisoryDB(empty)
+	assert.Error(t, err, "an empty database is a mistake, not a clean scan")
+
+	_, err = loadAdvisoryDB("")
+	assert.Error(t, err)
+}
+
+func Test_advisoryMatch(t *testing.T) {
+
+	db, err := readAdvisoryDB(writeTestAdvisories(t))
+	assert.NoError(t, err)
+
+	findings := db.match(testImageContents())
+
+	if !assert.Len(t, findings, 3) {
+		return
+	}
+
+	django, lodash, openssl := findings[0], findings[1], findings[2]
+
+	assert.Equal(t, "PYSEC-2022-1", django.ID)
+	assert.Equal(t, severityCritical, django.Severity, "from the CVSS vector")
+	assert.Equal(t, "Django", django.Package)
+	assert.Equal(t, "3.2.12", django.Fixed)
+
+	assert.Equal(t, "GHSA-35jh-r3h4-6jhm", lodash.ID)
+	assert.Equal(t, severityHigh, lodash.Severity)
+	assert.Equal(t, "/srv/app/package-lock.json", lodash.Source)
+
+	assert.Equal(t, "DSA-5343-1", openssl.ID, "the advisory for Debian 10 doesn't apply")
+	assert.Equal(t, "openssl", openssl.Package, "reported once for the source package")
+	assert.Equal(t, severityUnknown, openssl.Severity)
+	assert.Equal(t, "1.1.1n-0+deb11u4", openssl.Fixed)
+	assert.Equal(t, []string{"CVE-2023-0286"}, openssl.Aliases)
+}
+
+func Test_rangeAffects(t *testing.T) {
+
+	events := []osvEvent{{Fixed: "1.2.0"}, {Introduced: "1.0.0"}, {Introduced: "2.0.0"}, {LastAffected: "2.1.0"}}
+
+	for version, expected := range map[string]bool{
+		"0.9.0": false,
+		"1.0.0": true,
+		"1.1.9": true,
+		"1.2.0": false,
+		"2.1.0": true,
+		"2.1.1": false,
+	} {
+		affected, _ := rangeAffects(events, version, compareSemver)
+		assert.Equal(t, expected, affected, version)
+	}
+
+	_, fixed := rangeAffects(events, "1.1.0", compareSemver)
+	assert.Equal(t, "1.2.0", fixed)
+
+	affected, _ := rangeAffects([]osvEvent{{Introduced: "0"}, {Limit: "3.0.0"}}, "3.0.0", compareSemver)
+	assert.False(t, affected)
+}
+
+func Test_packageEcosystem(t *testing.T) {
+
+	deb := imagePackage{Type: "deb"}
+	apk := imagePackage{Type: "apk"}
+	rpm := imagePackage{Type: "rpm"}
+
+	assert.Equal(t, "Debian:11", packageEcosystem(deb, osRelease{ID: "debian", VersionID: "11"}))
+	assert.Equal(t, "Ubuntu:22.04", packageEcosystem(deb, osRelease{ID: "ubuntu", VersionID: "22.04"}))
+	assert.Equal(t, "Alpine:v3.16", packageEcosystem(apk, osRelease{ID: "alpine", VersionID: "3.16.2"}))
+	assert.Equal(t, "Rocky Linux:9", packageEcosystem(rpm, osRelease{ID: "rocky", VersionID: "9.2"}))
+	assert.Equal(t, "", packageEcosystem(rpm, osRelease{ID: "fedora", VersionID: "38"}))
+	assert.Equal(t, "Packagist", packageEcosystem(imagePackage{Type: "composer"}, osRelease{}))
+
+	assert.True(t, ecosystemMatches("Ubuntu:22.04:LTS", "Ubuntu:22.04"))
+	assert.True(t, ecosystemMatches("Debian", "Debian:11"))
+	assert.False(t, ecosystemMatches("Debian:10", "Debian:11"))
+	assert.False(t, ecosystemMatches("Alpine:v3.1", "Alpine:v3.16"))
+}
+
+func Test_cvss3BaseScore(t *testing.T) {
+
+	for vector, expected := range map[string]float64{
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:U/C:H/I:H/A:H": 9.8,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:N/S:C/C:H/I:H/A:H": 10.0,
+		"CVSS:3.1/AV:N/AC:L/PR:L/UI:N/S:U/C:L/I:N/A:N": 4.3,
+		"CVSS:3.1/AV:N/AC:L/PR:N/UI:R/S:C/C:L/I:L/A:N": 6.1,
+		"CVSS:3.0/AV:L/AC:H/PR:H/UI:R/S:U/C:N/I:N/A:N": 0,
+	} {
+		score, err := cvss3BaseScore(vector)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, score, vector)
+	}
+
+	_, err := cvss3BaseScore("AV:N/AC:L/Au:N/C:P/I:P/A:P")
+	assert.Error(t, err, "CVSS v2 vectors aren't scored")
+
+	_, err = cvss3BaseScore("CVSS:3.1/AV:N/AC:L/S:U/C:H/I:H/A:H")
+	assert.Error(t, err)
+
+	assert.Equal(t, severityMedium, normalizeVulnSeverity("MODERATE"))
+	assert.Equal(t, severityUnknown, normalizeVulnSeverity("whatever"))
+}
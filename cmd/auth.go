@@ -0,0 +1,230 @@
+// Cmd auth finds registry credentials the way the docker cli does, so passwords don't have to live in .mach.yaml
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+)
+
+// dockerHubAuthKey is the key the docker cli stores docker hub credentials under
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// dockerConfigFile is the part of the docker cli's config.json that deals with registry credentials
+type dockerConfigFile struct {
+	Auths       map[string]types.AuthConfig `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// dockerConfigPath returns the docker cli config file, in $DOCKER_CONFIG or ~/.docker
+func dockerConfigPath() string {
+
+	dir := os.Getenv("DOCKER_CONFIG")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".docker")
+	}
+
+	return filepath.Join(dir, "config.json")
+}
+
+// loadDockerConfig reads the docker cli config, a missing file is the same as an empty one
+func loadDockerConfig() (*dockerConfigFile, error) {
+
+	config := &dockerConfigFile{}
+
+	filename := dockerConfigPath()
+	if filename == "" {
+		return config, nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return config, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return config, nil
+}
+
+// registryAuthKey turns a registry host or URL into the key credentials are stored under, the docker hub
+// has a few names that all map to dockerHubAuthKey.
+func registryAuthKey(registry string) string {
+
+	host := registry
+	if strings.Contains(host, "://") {
+		if u, err := url.Parse(host); err == nil {
+			host = u.Host
+		}
+	}
+	host = strings.TrimSuffix(strings.SplitN(host, "/", 2)[0], "/")
+
+	switch host {
+	case "", "docker.io", "index.docker.io", "registry-1.docker.io":
+		return dockerHubAuthKey
+	}
+
+	return host
+}
+
+// imageAuthKey returns the credentials key for the registry an image lives in
+func imageAuthKey(image string) string {
+
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return dockerHubAuthKey
+	}
+
+	return registryAuthKey(reference.Domain(named))
+}
+
+// registryAuth returns the credentials for a registry. `docker_user` and `docker_pass` are used for the
+// registry in `docker_host` when set, anything else comes from the docker cli config: a credential helper
+// for the registry in `credHelpers`, the `credsStore`, then `auths`. No credentials at all is not an error,
+// the registry may well allow anonymous pulls.
+func registryAuth(registry string) (types.AuthConfig, error) {
+
+	key := registryAuthKey(registry)
+
+	if DockerUser != "" && key == registryAuthKey(DockerHost) {
+		return types.AuthConfig{Username: DockerUser, Password: DockerPassword, ServerAddress: key}, nil
+	}
+
+	config, err := loadDockerConfig()
+	if err != nil {
+		return types.AuthConfig{}, err
+	}
+
+	for host, helper := range config.CredHelpers {
+		if registryAuthKey(host) == key {
+			return credentialHelperAuth(helper, key)
+		}
+	}
+
+	if config.CredsStore != "" {
+		auth, err := credentialHelperAuth(config.CredsStore, key)
+		if err != nil || auth.Username != "" || auth.IdentityToken != "" {
+			return auth, err
+		}
+	}
+
+	for host, auth := range config.Auths {
+		if registryAuthKey(host) == key {
+			return decodeAuth(auth, key)
+		}
+	}
+
+	return types.AuthConfig{ServerAddress: key}, nil
+}
+
+// decodeAuth fills in the username and password from the base64 `auth` field of a config.json entry
+func decodeAuth(auth types.AuthConfig, key string) (types.AuthConfig, error) {
+
+	auth.ServerAddress = key
+
+	if auth.Auth == "" {
+		return auth, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+	if err != nil {
+		return auth, fmt.Errorf("invalid auth for %s in %s: %v", key, dockerConfigPath(), err)
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return auth, fmt.Errorf("invalid auth for %s in %s", key, dockerConfigPath())
+	}
+
+	auth.Username, auth.Password, auth.Auth = parts[0], parts[1], ""
+
+	return auth, nil
+}
+
+// credentialHelperAuth asks a docker credential helper, `docker-credential-<helper>` on the PATH, for the
+// credentials of a registry.
+func credentialHelperAuth(helper string, key string) (types.AuthConfig, error) {
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(key)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return types.AuthConfig{ServerAddress: key}, nil
+		}
+		return types.AuthConfig{}, fmt.Errorf("docker-credential-%s: %v %s", helper, err, msg)
+	}
+
+	var creds struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return types.AuthConfig{}, fmt.Errorf("docker-credential-%s: %v", helper, err)
+	}
+
+	// helpers store identity tokens with this username, as the docker cli does
+	if creds.Username == "<token>" {
+		return types.AuthConfig{IdentityToken: creds.Secret, ServerAddress: key}, nil
+	}
+
+	return types.AuthConfig{Username: creds.Username, Password: creds.Secret, ServerAddress: key}, nil
+}
+
+// encodeRegistryAuth encodes credentials for the X-Registry-Auth header of the docker api
+func encodeRegistryAuth(auth types.AuthConfig) string {
+
+	authConfigBytes, _ := json.Marshal(auth)
+
+	return base64.URLEncoding.EncodeToString(authConfigBytes)
+}
+
+// buildAuthConfigs returns the credentials for every registry an image pulls from during its build, along
+// with the registry it is pushed to.
+func buildAuthConfigs(node *buildNode) (map[string]types.AuthConfig, error) {
+
+	images := append([]string{node.Tag}, node.From...)
+
+	configs := map[string]types.AuthConfig{}
+	for _, image := range images {
+		key := imageAuthKey(image)
+		if _, ok := configs[key]; ok {
+			continue
+		}
+
+		auth, err := registryAuth(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if auth.Username != "" || auth.IdentityToken != "" {
+			configs[key] = auth
+		}
+	}
+
+	return configs, nil
+}
@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeDockerConfig points DOCKER_CONFIG at a temp dir holding the given config.json, and puts any credential
+// helper scripts on the PATH. The returned func puts everything back.
+func writeDockerConfig(t *testing.T, config string, helpers map[string]string) func() {
+
+	dir := t.TempDir()
+	ioutil.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0644)
+
+	for name, script := range helpers {
+		ioutil.WriteFile(filepath.Join(dir, "docker-credential-"+name), []byte("#!/bin/sh\n"+script), 0755)
+	}
+
+	path := os.Getenv("PATH")
+	os.Setenv("DOCKER_CONFIG", dir)
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+
+	return func() {
+		os.Unsetenv("DOCKER_CONFIG")
+		os.Setenv("PATH", path)
+	}
+}
+
+func Test_registryAuthKey(t *testing.T) {
+
+	assert.Equal(t, dockerHubAuthKey, registryAuthKey("https://index.docker.io/v1/"))
+	assert.Equal(t, dockerHubAuthKey, registryAuthKey("docker.io"))
+	assert.Equal(t, dockerHubAuthKey, registryAuthKey("registry-1.docker.io"))
+	assert.Equal(t, "ghcr.io", registryAuthKey("https://ghcr.io"))
+	assert.Equal(t, "localhost:5000", registryAuthKey("localhost:5000/v2/"))
+
+	assert.Equal(t, dockerHubAuthKey, imageAuthKey("superterran/mach:php"))
+	assert.Equal(t, "ghcr.io", imageAuthKey("ghcr.io/superterran/mach:php"))
+}
+
+func Test_registryAuthFromAuths(t *testing.T) {
+
+	// dXNlcjpwYXNz is user:pass
+	defer writeDockerConfig(t, `{"auths": {"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"}, "ghcr.io": {"identitytoken": "tok"}}}`, nil)()
+
+	auth, err := registryAuth("docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", auth.Username)
+	assert.Equal(t, "pass", auth.Password)
+	assert.Equal(t, dockerHubAuthKey, auth.ServerAddress)
+
+	auth, err = registryAuth("https://ghcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "tok", auth.IdentityToken)
+
+	auth, err = registryAuth("quay.io")
+	assert.NoError(t, err)
+	assert.Empty(t, auth.Username, "registries without credentials are pulled from anonymously")
+}
+
+func Test_registryAuthCredentialHelpers(t *testing.T) {
+
+	defer writeDockerConfig(t, `{"credsStore": "store", "credHelpers": {"ghcr.io": "gh"}, "auths": {"quay.io": {"auth": "dXNlcjpwYXNz"}}}`, map[string]string{
+		"store": `read host; if [ "$host" = "https://index.docker.io/v1/" ]; then echo '{"Username": "hub", "Secret": "secret"}'; else echo "credentials not found in native keychain"; exit 1; fi`,
+		"gh":    `echo '{"Username": "<token>", "Secret": "gh-token"}'`,
+	})()
+
+	auth, err := registryAuth("docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "hub", auth.Username)
+	assert.Equal(t, "secret", auth.Password)
+
+	auth, err = registryAuth("ghcr.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "gh-token", auth.IdentityToken, "a per-registry helper wins over the store")
+
+	auth, err = registryAuth("quay.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "user", auth.Username, "auths are used when the store has nothing")
+}
+
+func Test_registryAuthExplicitCredentials(t *testing.T) {
+
+	defer writeDockerConfig(t, `{"auths": {"https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNz"}}}`, nil)()
+
+	DockerUser, DockerPassword, DockerHost = "mach", "secret", "https://index.docker.io/v1/"
+	defer func() { DockerUser, DockerPassword = "", "" }()
+
+	auth, err := registryAuth("registry-1.docker.io")
+	assert.NoError(t, err)
+	assert.Equal(t, "mach", auth.Username, "docker_user should win for the docker_host registry")
+
+	configs, err := buildAuthConfigs(&buildNode{Tag: "superterran/mach:php", From: []string{"ghcr.io/org/base:1", "alpine"}})
+	assert.NoError(t, err)
+	assert.Len(t, configs, 1, "only registries with credentials are sent to the daemon")
+	assert.Equal(t, "secret", configs[dockerHubAuthKey].Password)
+}
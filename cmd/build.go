@@ -4,13 +4,11 @@ package cmd
 import (
 	"bufio"
 	"context"
-	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"html/template"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
 	"strings"
@@ -18,10 +16,8 @@ import (
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/jsonmessage"
 	"github.com/fatih/color"
-	"github.com/go-git/go-git/v5"
 	"github.com/moby/term"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -35,7 +31,7 @@ var FirstOnly bool = false
 // Nopush builds the image, but does not push to a registry. Set with `--no-push` or `-n`
 var Nopush bool = false
 
-// BuildImageDirname tells the tool which directory to itereate through to find Dockerfiles. defaults the present working
+// BuildImageDirname tells the tool which directory tree to itereate through to find Dockerfiles. defaults the present working
 // directory, but a good practice is to mint a .mach.yaml and set this to `images` or the like when building an IaC repo.
 var BuildImageDirname string = "."
 
@@ -50,7 +46,8 @@ var DockerHost string = "https://index.docker.io/v1/"
 // DockerRegistry is the package name inside the docker registry. @todo think through a better name
 var DockerRegistry string = "superterran/mach"
 
-// DockerUser is the registry username
+// DockerUser is the registry username for the registry in DockerHost, leave it empty to use the credentials
+// of the docker cli, from ~/.docker/config.json and its credential helpers
 var DockerUser string = ""
 
 // DockerPassword is the registry password
@@ -65,9 +62,17 @@ var NoCache bool = false
 // add build tag
 var BuildVariantFromParam string = ""
 
+// KeepGoing carries on building after an image fails, set with `--keep-going` or `-k`. Images built from a
+// failed image are still skipped.
+var KeepGoing bool = false
+
+// Jobs is the number of images built at the same time, set with `--jobs` or `-j`. When more than one, the
+// output of each build is prefixed with its tag instead of using the terminal formatting.
+var Jobs int = 1
+
 type errorLine struct {
 	Error       string      `json:"error"`
-	errorDetail errorDetail `json:"errorDetail"`
+	ErrorDetail errorDetail `json:"errorDetail"`
 }
 
 type errorDetail struct {
@@ -81,6 +86,7 @@ func CreateBuildCmd() *cobra.Command {
 		Long: `This allows you to maintain a directory of docker images, with templating,
 	and use this to populate a docker registry. `,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
 			return runBuild(cmd, args)
 		},
 	}
@@ -99,12 +105,64 @@ func init() {
 
 	buildCmd.Flags().BoolP("output-only", "o", OutputOnly, "send output to stdout, do not build")
 
+	buildCmd.Flags().StringVar(&Plan, "plan", Plan, "print the tags, build order, pushes and up-to-date status of each image as a table or json, without building")
+
+	buildCmd.Flags().Lookup("plan").NoOptDefVal = "table"
+
 	buildCmd.Flags().BoolP("first-only", "f", FirstOnly, "stop the build loop after the first image is found")
 
 	buildCmd.Flags().BoolP("verbose", "v", Verbose, "show entire build output")
 
+	buildCmd.Flags().Bool("strict", StrictTemplates, "fail on template keys that do not exist (default on when CI is set)")
+	viper.SetDefault("strict_templates", StrictTemplates)
+	viper.BindPFlag("strict_templates", buildCmd.Flags().Lookup("strict"))
+
+	buildCmd.Flags().BoolP("keep-going", "k", KeepGoing, "keep building other images after one fails")
+
+	buildCmd.Flags().BoolVar(&RunImageTests, "test", RunImageTests, "run the checks in mach.test.yaml against each built image before pushing it")
+
+	viper.BindPFlag("test_images", buildCmd.Flags().Lookup("test"))
+
+	buildCmd.Flags().StringVar(&SBOMFormat, "sbom", SBOMFormat, "write an SBOM of each built image next to the build report, spdx or cyclonedx")
+
+	buildCmd.Flags().Lookup("sbom").NoOptDefVal = sbomSPDX
+
+	viper.BindPFlag("sbom", buildCmd.Flags().Lookup("sbom"))
+
+	buildCmd.Flags().BoolVar(&ScanImages, "scan", ScanImages, "match each built image against the advisory_dir advisories before pushing it")
+
+	viper.BindPFlag("scan_images", buildCmd.Flags().Lookup("scan"))
+
+	buildCmd.Flags().StringVar(&ExportDir, "export", ExportDir, "write each built image to this directory, with an index for mach load")
+	viper.BindPFlag("export_dir", buildCmd.Flags().Lookup("export"))
+
+	buildCmd.Flags().StringVar(&ExportFormat, "export-format", ExportFormat, "format of exported images, docker-archive or oci")
+	viper.SetDefault("export_format", ExportFormat)
+	viper.BindPFlag("export_format", buildCmd.Flags().Lookup("export-format"))
+
+	buildCmd.Flags().BoolVar(&Force, "force", Force, "build and push even if an image with the same content hash exists")
+
+	buildCmd.Flags().BoolVar(&CheckRegistry, "check-registry", CheckRegistry, "also look for an image with the same content hash in the registry")
+	viper.SetDefault("check_registry", CheckRegistry)
+	viper.BindPFlag("check_registry", buildCmd.Flags().Lookup("check-registry"))
+
+	buildCmd.Flags().StringVar(&ReportJSON, "report-json", ReportJSON, "write a JSON report of the build to a file, - for stdout")
+	viper.SetDefault("report_json", ReportJSON)
+	viper.BindPFlag("report_json", buildCmd.Flags().Lookup("report-json"))
+
+	buildCmd.Flags().StringVar(&ReportJUnit, "report-junit", ReportJUnit, "write a JUnit XML report of the build to a file, - for stdout")
+	viper.SetDefault("report_junit", ReportJUnit)
+	viper.BindPFlag("report_junit", buildCmd.Flags().Lookup("report-junit"))
+
+	buildCmd.Flags().StringVar(&ChangedSince, "changed-since", ChangedSince, "only build images changed since a git ref, and the images built from them")
+
+	buildCmd.Flags().IntP("jobs", "j", Jobs, "number of images to build in parallel")
+	viper.SetDefault("jobs", Jobs)
+	viper.BindPFlag("jobs", buildCmd.Flags().Lookup("jobs"))
+
 	buildCmd.Flags().StringVar(&BuildImageDirname, "build-image-dir-name", BuildImageDirname, "build Image directory")
 	viper.SetDefault("BuildImageDirname", BuildImageDirname)
+	viper.SetDefault("image_name_separator", ImageNameSeparator)
 	viper.BindPFlag("BuildImageDirname", buildCmd.Flags().Lookup("build-image-dir-name"))
 
 	buildCmd.Flags().StringVar(&DefaultGitBranch, "default-git-branch", DefaultGitBranch, "default git branch")
@@ -147,8 +205,12 @@ func runBuild(cmd *cobra.Command, args []string) error {
 
 	FirstOnly, _ = cmd.Flags().GetBool("first-only")
 
+	KeepGoing, _ = cmd.Flags().GetBool("keep-going")
+
 	BuildImageDirname = viper.GetString("BuildImageDirname")
 
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
 	DockerHost = viper.GetString("docker_host")
 
 	DockerUser = viper.GetString("docker_user")
@@ -159,221 +221,511 @@ func runBuild(cmd *cobra.Command, args []string) error {
 
 	BuildVariantFromParam = viper.GetString("variant")
 
+	Jobs = viper.GetInt("jobs")
+
+	CheckRegistry = viper.GetBool("check_registry")
+
+	RunImageTests = viper.GetBool("test_images")
+
+	SBOMFormat = viper.GetString("sbom")
+
+	SBOMDir = viper.GetString("sbom_dir")
+
+	ScanImages = viper.GetBool("scan_images")
+
+	AdvisoryDir = viper.GetString("advisory_dir")
+
+	ScanFailOn = viper.GetString("scan_fail_on")
+
+	ScanIgnoreFile = viper.GetString("scan_ignore_file")
+
+	ExportDir = viper.GetString("export_dir")
+
+	ExportFormat = viper.GetString("export_format")
+
+	StrictTemplates = viper.GetBool("strict_templates")
+
+	ReportJSON = viper.GetString("report_json")
+
+	ReportJUnit = viper.GetString("report_junit")
+
 	return MainBuildFlow(args)
 }
 
 // MainBuildFlow will run builds against an array of arguments, if no arguments are supplied
-// it will iterate through the build directory
+// it will iterate through the build directory. Images are built in dependency order, so an image
+// that is built `FROM` another image in this repo is always built after it.
 func MainBuildFlow(args []string) error {
 	if OutputOnly {
 		TestMode = true
 		OutputOnly = true
 	}
 
-	if len(args) < 1 {
-		matches, _ := filepath.Glob(BuildImageDirname + "/**/Dockerfile*")
-		for _, match := range matches {
-			var mach_tag string = buildImage(match)
-			if !Nopush || OutputOnly {
-				pushImage(mach_tag)
-			}
+	// a --plan in a format that can't be written fails before any image is rendered and hashed
+	if Plan != "" {
+		if err := checkPlanFormat(Plan); err != nil {
+			return err
+		}
+	}
 
-			if FirstOnly {
-				break
-			}
+	if Plan == "" {
+		restore, err := redirectBuildOutput()
+		if err != nil {
+			return err
 		}
-	} else {
-		for _, arg := range args {
+		defer restore()
+	}
 
-			var image string = arg
-			var variant string
+	// a broken push_targets would fail every image after building it, so it fails the build up front
+	if _, err := pushTargets(); err != nil {
+		return err
+	}
 
-			if strings.Contains(arg, ":") {
-				image = strings.Split(arg, ":")[0]
-				variant = "-" + strings.Split(arg, ":")[1]
-			}
+	started := time.Now()
+	dockerfiles := findDockerfiles(args)
 
-			matches, _ := filepath.Glob(BuildImageDirname + "/" + image + "/Dockerfile" + variant + "*")
-			for _, match := range matches {
-				var mach_tag string = buildImage(match)
+	nodes, err := planBuildOrder(dockerfiles)
+	if err != nil {
+		return failBuildPlan(started, dockerfiles, err)
+	}
 
-				if !Nopush || OutputOnly {
-					pushImage(mach_tag)
-				}
+	if ChangedSince != "" {
+		changed, err := changedFiles(".", ChangedSince)
+		if err != nil {
+			return failBuildPlan(started, dockerfiles, err)
+		}
 
-				if FirstOnly {
-					break
-				}
+		nodes = filterChanged(nodes, changed)
+		if len(nodes) == 0 {
+			color.Green("no images changed since " + ChangedSince)
+		}
+	}
+
+	if FirstOnly && len(nodes) > 1 {
+		nodes = nodes[:1]
+	}
+
+	if Plan != "" {
+		return writeBuildPlan(os.Stdout, nodes)
+	}
+
+	if OutputOnly {
+		for _, node := range nodes {
+			if _, err := buildAndPush(node, nil); err != nil {
+				return err
 			}
 		}
+
+		return nil
+	}
+
+	var results []*buildResult
+
+	if Jobs > 1 && !TestMode {
+		results = runBuildJobs(nodes, Jobs, os.Stdout, buildAndPush)
+	} else {
+		results = runBuildJobs(nodes, 1, nil, buildAndPush)
+	}
+
+	err = buildSummary(os.Stdout, results)
+
+	if lockErr := updateImageLock(results); lockErr != nil && err == nil {
+		err = lockErr
+	}
+
+	if ExportDir != "" {
+		if exportErr := writeExportIndex(ExportDir, results); exportErr != nil && err == nil {
+			err = exportErr
+		}
+	}
+
+	if reportErr := writeBuildReports(started, results); reportErr != nil && err == nil {
+		err = reportErr
 	}
 
-	return nil
+	return err
 }
 
-// generateDockerfileTemplate grabs the docker tpl file, and any tpl files in the `includes` sub directory with the
-// docerfile, and runs them through a templater to produce the output for a dockerfile to be built.
-// this method uses the `html/template` package https://golang.org/pkg/html/template/ so this should be
-// fairly flexible. I intentionally haven't introduced outside variables to the templating engine i.e.
-// host system environment variables. This may come in time, but Dockerfiles should not contain secrets so
-// I'm not sure if this is a good feature to introduce.
-func generateDockerfileTemplate(wr io.Writer, filename string) {
+// buildAndPush builds an image, tests it with RunImageTests, scans it with ScanImages, exports it to ExportDir and pushes all of its tags, this is the job run for
+// each image of a build. Errors come back as a *buildError saying which stage failed.
+func buildAndPush(node *buildNode, out io.Writer) (*imageBuild, error) {
+
+	if node.Err != nil {
+		return nil, newBuildError(stageTemplate, node.Tag, node.Err)
+	}
 
-	tpl, err := template.ParseGlob(filename)
+	build, err := buildImageTo(node, out)
 	if err != nil {
-		panic(err)
+		return build, newBuildError(stageBuild, node.Tag, err)
 	}
 
-	tpl.ParseGlob(filepath.Dir(filename) + "/includes/*.tpl")
-	tpl.Execute(wr, filepath.Base(filename))
+	if RunImageTests && !TestMode && build.testsDue() {
+		if err := testImage(node.Filename, build.Tag, out); err != nil {
+			return build, newBuildError(stageTest, node.Tag, err)
+		}
+	}
 
-}
+	if SBOMFormat != "" && !TestMode {
+		if err := writeImageSBOM(build, out); err != nil {
+			return build, newBuildError(stageSBOM, node.Tag, err)
+		}
+	}
 
-func getApiVersion(filename string) string {
+	// unchanged images are scanned too, new advisories come out against old images
+	if ScanImages && !TestMode {
+		if err := scanBuiltImage(build, out); err != nil {
+			return build, newBuildError(stageScan, node.Tag, err)
+		}
+	}
 
-	content, err := ioutil.ReadFile(filepath.Dir(filename) + "/API_VERSION")
+	if ExportDir != "" && !TestMode {
+		if err := exportBuiltImage(build, out); err != nil {
+			return build, newBuildError(stageExport, node.Tag, err)
+		}
+	}
+
+	if Nopush || TestMode || build.SkipPush || pushesNowhere(node.Filename) {
+		return build, nil
+	}
+
+	targets, err := pushTargets()
 	if err != nil {
-		content, err := ioutil.ReadFile(filepath.Dir(filename) + "/../API_VERSION")
-		if err != nil {
+		return build, newBuildError(stagePush, node.Tag, err)
+	}
 
-			return ""
-		} else {
-			return string(content) + "-"
+	if err := pushToTargets(build, targets, out, tagAndPushImage); err != nil {
+		return build, newBuildError(stagePush, node.Tag, err)
+	}
+
+	return build, nil
+}
+
+// findDockerfiles returns the Dockerfiles matching the build arguments, or every Dockerfile in the build
+// directory tree if there are no arguments. Arguments are image paths, `php/8.1`, optionally with a variant,
+// `php/8.1:fpm`. A path ending in `/...` selects every image below it, `php/...`.
+func findDockerfiles(args []string) []string {
+
+	if len(args) < 1 {
+		return walkDockerfiles(BuildImageDirname, "")
+	}
+
+	var matches []string
+
+	for _, arg := range args {
+
+		var image string = arg
+		var variant string
+
+		if strings.Contains(arg, ":") {
+			image = strings.Split(arg, ":")[0]
+			variant = "-" + strings.Split(arg, ":")[1]
 		}
-	} else {
-		return string(content) + "-"
+
+		if image == "..." || strings.HasSuffix(image, "/...") {
+			matches = append(matches, walkDockerfiles(filepath.Join(BuildImageDirname, strings.TrimSuffix(image, "...")), variant)...)
+			continue
+		}
+
+		found, _ := filepath.Glob(BuildImageDirname + "/" + image + "/Dockerfile" + variant + "*")
+		matches = append(matches, found...)
 	}
+
+	return matches
 }
 
-// getTag determines the string used for the docker image tag that gets referenced in the registry.
-// This is typically just the directory name the dockerfile resides in, but can be modified by either
-// using a variant in the filename (detailed below) or by using a git branch other than the default
-func getTag(filename string) string {
+// generateDockerfileTemplate grabs the docker tpl file, and any tpl files in the `includes` sub directory with the
+// docerfile, and runs them through a templater to produce the output for a dockerfile to be built.
+// this method uses the `text/template` package https://golang.org/pkg/text/template/ along with the functions
+// from templateFuncs, shared with compose templates. Templates are given a dockerfileContext, host system
+// environment variables are only available when allowed with `template_env`, as Dockerfiles should not
+// contain secrets.
+func generateDockerfileTemplate(wr io.Writer, filename string) error {
 
-	var apiVersion = getApiVersion(filename)
-	var variant = getVariant(filename)
+	return renderTemplate(wr, filename, newDockerfileContext(filename))
+}
 
-	var tag string
+// getApiVersion returns the API_VERSION of an image followed by a dash, the file is looked up through the
+// directories above the image, see apiVersionFile.
+func getApiVersion(filename string) string {
 
-	if "-"+apiVersion == variant+"-" {
-		tag = apiVersion + filepath.Base(filepath.Dir(filename))
-	} else {
-		tag = apiVersion + filepath.Base(filepath.Dir(filename)) + variant
+	path := apiVersionFile(filename)
+	if path == "" {
+		return ""
 	}
 
-	if DockerRegistry != "" {
-		return DockerRegistry + ":" + tag
-	} else {
-		Nopush = true
-		return tag
+	content, err := ioutil.ReadFile(path)
+	if err != nil || strings.TrimSpace(string(content)) == "" {
+		return ""
 	}
 
+	return strings.TrimSpace(string(content)) + "-"
 }
 
-// getVariant determines the additional string to append to the docker image tag. This is determined
-// by the filename of the docker file being read, `Dockerfile` will not get any variant, but files like
-// `Dockerfile-variant` will be tagged as `<dirname>-<variant>`.
-func getVariant(filename string) string {
-
-	var variant string = ""
+// getTag determines the string used for the docker image tag that gets referenced in the registry. This is
+// the first of the tag templates, by default the name of the image in docker_registry, modified by the
+// API_VERSION, a variant in the filename, and the git branch when it isn't the default, see tagContext. Images
+// with their own repository are tagged with the variant alone, `org/example:go`.
+// Broken tag templates are reported when the build is planned, here they fall back to DefaultTagTemplate.
+func getTag(filename string) string {
 
-	if strings.Contains(filepath.Base(filename), "-") {
-		variant = "-" + strings.Split(filepath.Base(filename), "-")[1]
+	tags, err := imageTags(filename)
+	if err != nil {
+		ctx := newTagContext(filename)
+		if ctx.Repository != "" {
+			return ctx.Repository + ":" + ctx.VariantTag
+		}
+		tag := ctx.APIVersion + ctx.Name + ctx.Variant + ctx.BranchSuffix
+		if DockerRegistry != "" {
+			tag = DockerRegistry + ":" + tag
+		}
+		return tag
 	}
 
-	variant = strings.Replace(variant, ".tpl", "", 1)
+	return tags[0]
+}
 
-	if getBranchVariant()+"-" == "-"+getApiVersion(filename) {
-		return variant
-	} else {
-		return variant + getBranchVariant()
+// fileVariant returns the variant named in a Dockerfile's filename, `go` for `Dockerfile-go.tpl`
+func fileVariant(filename string) string {
+
+	if !strings.Contains(filepath.Base(filename), "-") {
+		return ""
 	}
+
+	return strings.Replace(strings.Split(filepath.Base(filename), "-")[1], ".tpl", "", 1)
 }
 
-// getBranchVariant will return a string that can appended to the variant of a tag, this function is called
-// by getVariant. This will not produce output if on the default branch-name, otherwise it will return
-// a string with the branch.
+// getBranchVariant will return a string that can appended to the variant of a tag, this is the BranchSuffix
+// of the tag templates. This will not produce output on the default branch or for a release build, a git tag
+// at HEAD, otherwise it will return the full branch name. Branch names like `feature/new-php` are turned into
+// valid tags when the tag templates are rendered.
 func getBranchVariant() string {
 
-	var branch = ""
-	var variant string = ""
+	if BuildVariantFromParam != "" {
+		return "-" + BuildVariantFromParam
+	}
+
+	ref := currentGitRef()
+	if ref.Release != "" || ref.Branch == "" || ref.Branch == DefaultGitBranch {
+		return ""
+	}
+
+	return "-" + ref.Branch
+}
+
+// getGitHead returns the current branch name and short commit hash of the repository in the working
+// directory, the branch comes from the CI environment when HEAD is detached. Both are empty when it isn't a
+// git repository.
+func getGitHead() (string, string) {
 
-	repo, err := git.PlainOpen(".")
+	ref := currentGitRef()
+
+	return ref.Branch, ref.SHA
+}
+
+// imageBuild is the outcome of building a single Dockerfile
+type imageBuild struct {
+	Filename string
+	Tag      string
+	// Tags is the tag followed by any extra tags from the image manifest
+	Tags []string
+	// Hash is the content hash of the image, stamped on it with the contentHashLabel
+	Hash string
+	// Skipped is set when an image with the same content hash already existed and nothing was built
+	Skipped bool
+	// SkipPush is set when there is no need to push the image again
+	SkipPush bool
+	// ID and Size are the image as the local daemon has it, after the build or when it was up to date
+	ID   string
+	Size int64
+	// Digests holds the digest the registry gave each tag that was pushed
+	Digests map[string]string
+	// Pushes is every push to every push target, failed or not
+	Pushes []pushResult
+	// SBOM is the file the SBOM of the image was written to
+	SBOM string
+	// Export is where the image was exported to with `--export`
+	Export *exportedImage
+	// Vulnerabilities is how many advisories the scan of the image found, by severity, ignored ones excluded
+	Vulnerabilities map[string]int
+	// contents is what is inside the image, read once for both the SBOM and the scan
+	contents *imageContents
+}
+
+// testsDue reports if the image of a build is to be tested. Anything that may be pushed is, even when it was up
+// to date locally, so only an image the registry already has as it is goes untested.
+func (b *imageBuild) testsDue() bool {
+	return !b.SkipPush
+}
+
+// packages returns what is inside the built image, exporting it from the local daemon the first time
+func (b *imageBuild) packages() (*imageContents, error) {
+
+	if b.contents != nil {
+		return b.contents, nil
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 	if err != nil {
-		branch = "origin/refs/main"
-	} else {
+		return nil, err
+	}
 
-		head, err := repo.Head()
-		if err != nil {
-			log.Fatal(err)
+	return b.packagesFrom(context.Background(), cli)
+}
+
+// packagesFrom reads what is inside the image from the daemon. An image that was up to date in the registry
+// but isn't in the daemon is pulled first, so it is described like any other.
+func (b *imageBuild) packagesFrom(ctx context.Context, cli client.APIClient) (*imageContents, error) {
+
+	if b.Skipped {
+		if _, _, err := cli.ImageInspectWithRaw(ctx, b.Tag); err != nil {
+			if err := pullImage(ctx, cli, b.Tag); err != nil {
+				return nil, fmt.Errorf("%s is up to date in the registry, but could not be pulled: %v", b.Tag, err)
+			}
+			inspectImage(cli, b)
 		}
+	}
 
-		branch = head.String()
+	contents, err := readImagePackages(ctx, cli, b.Tag)
+	if err != nil {
+		return nil, err
 	}
 
-	if strings.Contains(branch, "/") {
-		var variant_branch string = strings.Split(branch, "/")[2]
-		if variant_branch != DefaultGitBranch {
-			variant = "-" + variant_branch
-		}
+	b.contents = contents
+
+	return contents, nil
+}
+
+// pullImage pulls a tag into the daemon with the credentials for its registry
+func pullImage(ctx context.Context, cli client.APIClient, tag string) error {
+
+	authConfig, err := registryAuth(imageAuthKey(tag))
+	if err != nil {
+		return err
 	}
 
-	if BuildVariantFromParam != "" {
-		return "-" + BuildVariantFromParam
+	rd, err := cli.ImagePull(ctx, tag, types.ImagePullOptions{RegistryAuth: encodeRegistryAuth(authConfig)})
+	if err != nil {
+		return err
 	}
+	defer rd.Close()
 
-	return variant
+	return jsonmessage.DisplayJSONMessagesStream(rd, ioutil.Discard, 0, false, nil)
 }
 
 // buildImage probably does too much, but it creates a tarball with a templatized dockerfile, and
-// everything in it's directory for context, and it builds the image.
+// everything in it's directory for context, and it builds the image. The tarball is streamed from
+// memory, nothing is written to the image directory. Errors are printed, the build flow uses
+// buildAndPush which returns them instead.
 func buildImage(filename string) string {
 
-	var mach_tag = getTag(filename)
+	node, err := newBuildNode(filename)
+	if err != nil {
+		color.Red(err.Error())
+		return getTag(filename)
+	}
+
+	build, err := buildImageTo(node, nil)
+	if err != nil {
+		color.Red(err.Error())
+	}
+
+	return build.Tag
+}
+
+// buildImageTo builds a single image, sending the daemon output to out one line per message. When out is
+// nil the output goes to the terminal through dockerLog. Errors are returned rather than exiting, so one
+// failing image does not take down the other jobs of a parallel build. Unless Force is set, the build is
+// skipped when an image with the same content hash already exists.
+func buildImageTo(node *buildNode, out io.Writer) (*imageBuild, error) {
+
+	var filename = node.Filename
+	var mach_tag = node.Tag
+
+	build := &imageBuild{
+		Filename: filename,
+		Tag:      mach_tag,
+		Tags:     withExtraTags(filename, mach_tag),
+	}
 
 	if !OutputOnly {
-		color.HiYellow("Building image with tag " + mach_tag)
+		if out == nil {
+			color.HiYellow("Building image with tag " + mach_tag)
+		} else {
+			fmt.Fprintln(out, "Building image with tag "+mach_tag)
+		}
 	}
 
 	if OutputOnly || TestMode {
-		generateDockerfileTemplate(os.Stdout, filename)
-		return mach_tag
+		_, err := os.Stdout.Write(node.Dockerfile)
+		return build, err
 	}
 
-	fmt.Print("\n" + "\033[s")
+	manifest, err := loadImageManifest(filename)
+	if err != nil {
+		return build, err
+	}
 
-	var DockerFilename string = filepath.Dir(filename) + "/." + filepath.Base(filename) + ".generated"
+	build.Hash, err = node.ContentHash()
+	if err != nil {
+		return build, err
+	}
 
-	f, _ := os.Create(DockerFilename)
-	generateDockerfileTemplate(f, filename)
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return build, err
+	}
+
+	if !Force {
+		build.Skipped, build.SkipPush = checkContentHash(cli, mach_tag, build.Hash)
+		if build.Skipped {
+			if out == nil {
+				color.Green(mach_tag + " is up to date, skipping build")
+			} else {
+				fmt.Fprintln(out, "up to date, skipping build")
+			}
+			inspectImage(cli, build)
+			return build, nil
+		}
+	}
 
-	f.Close()
+	if out == nil {
+		fmt.Print("\n" + "\033[s")
+	}
 
-	tar, _ := archive.TarWithOptions(filepath.Dir(DockerFilename), &archive.TarOptions{})
+	tar, err := buildContext(filepath.Dir(filename), node.Dockerfile)
+	if err != nil {
+		return build, err
+	}
+	defer tar.Close()
 
-	var authConfig = types.AuthConfig{
-		Username:      DockerUser,
-		Password:      DockerPassword,
-		ServerAddress: DockerHost,
+	authConfigs, err := buildAuthConfigs(node)
+	if err != nil {
+		return build, err
 	}
-	authConfigBytes, _ := json.Marshal(authConfig)
 
 	opts := types.ImageBuildOptions{
-		Dockerfile: filepath.Base(DockerFilename),
-		Remove:     true,
-		Tags:       []string{mach_tag},
-		NoCache:    NoCache,
-		AuthConfigs: map[string]types.AuthConfig{
-			"https://index.docker.io/v1/": {
-				Auth: base64.URLEncoding.EncodeToString(authConfigBytes),
-			},
-		},
+		Dockerfile:  buildContextDockerfile,
+		Remove:      true,
+		Tags:        build.Tags,
+		NoCache:     NoCache,
+		AuthConfigs: authConfigs,
+	}
+
+	manifest.apply(&opts)
+	opts.Tags = appendUnique(nil, opts.Tags...)
+
+	if opts.Labels == nil {
+		opts.Labels = map[string]string{}
 	}
+	opts.Labels[contentHashLabel] = build.Hash
 
 	ctx := context.Background()
-	cli, _ := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 
-	res, _ := cli.ImageBuild(ctx, tar, opts)
+	res, err := cli.ImageBuild(ctx, tar, opts)
+	if err != nil {
+		return build, err
+	}
+	defer res.Body.Close()
 
 	scanner := bufio.NewScanner(res.Body)
 
@@ -384,62 +736,104 @@ func buildImage(filename string) string {
 		errLine := &errorLine{}
 		json.Unmarshal([]byte(lastLine), errLine)
 		if errLine.Error != "" {
-			log.Fatal(color.RedString(errLine.Error))
-		} else {
-			fmt.Print("\033[s")
-			dockerLog(scanner.Text())
+			return build, errors.New(errLine.Error)
 		}
 
-		//	os.Exit(1)
+		if out == nil {
+			fmt.Print("\033[s")
+			dockerLog(lastLine)
+		} else {
+			plainLog(out, lastLine)
+		}
 	}
 
-	e := os.Remove(DockerFilename)
-	if e != nil {
-		log.Fatal(e)
+	if err := scanner.Err(); err != nil {
+		return build, err
 	}
 
-	return mach_tag
+	inspectImage(cli, build)
+
+	return build, nil
+}
+
+// inspectImage fills in the image ID and size of a build from the local daemon. These are only reported,
+// so an image the daemon can't find is left without them.
+func inspectImage(cli client.APIClient, build *imageBuild) {
 
+	inspect, _, err := cli.ImageInspectWithRaw(context.Background(), build.Tag)
+	if err != nil {
+		return
+	}
+
+	build.ID = inspect.ID
+	build.Size = inspect.Size
 }
 
 // pushImage takes the current tag and pushes it to the configured registry. This fuction short-circuits
 // if TestMode or Nopush are true.
 func pushImage(mach_tag string) string {
 
-	cli, _ := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if Nopush || TestMode {
+		return "skipping push due to TestMode"
+	}
 
-	var authConfig = types.AuthConfig{
-		Username:      DockerUser,
-		Password:      DockerPassword,
-		ServerAddress: DockerHost,
+	_, err := pushImageTo(mach_tag, nil)
+	if err != nil {
+		color.Red(err.Error())
+		return "push failed"
 	}
-	authConfigBytes, _ := json.Marshal(authConfig)
-	authConfigEncoded := base64.URLEncoding.EncodeToString(authConfigBytes)
 
-	tag := mach_tag
+	return "push complete"
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*60)
-	defer cancel()
+// pushImageTo pushes a tag to the registry it names, sending the progress to out, or to the terminal
+// when out is nil. It returns the digest the registry stored the image under.
+func pushImageTo(mach_tag string, out io.Writer) (string, error) {
 
-	opts := types.ImagePushOptions{RegistryAuth: authConfigEncoded}
+	authConfig, err := registryAuth(imageAuthKey(mach_tag))
+	if err != nil {
+		return "", err
+	}
 
-	termFd, isTerm := term.GetFdInfo(os.Stderr)
+	return pushImageWithAuth(mach_tag, authConfig, out)
+}
 
-	if Nopush || TestMode {
-		return "skipping push due to TestMode"
+// pushImageWithAuth pushes a tag with the given registry credentials, returning the pushed digest
+func pushImageWithAuth(tag string, authConfig types.AuthConfig, out io.Writer) (string, error) {
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return "", err
 	}
 
-	rd, err := cli.ImagePush(ctx, tag, opts)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute*60)
+	defer cancel()
 
-	err = jsonmessage.DisplayJSONMessagesStream(rd, os.Stderr, termFd, isTerm, nil)
+	opts := types.ImagePushOptions{RegistryAuth: encodeRegistryAuth(authConfig)}
+
+	rd, err := cli.ImagePush(ctx, tag, opts)
 	if err != nil {
-		if !TestMode {
-			log.Fatal(err)
+		return "", err
+	}
+	defer rd.Close()
+
+	// the daemon sends the pushed digest as an aux message at the end of the stream
+	var digest string
+	aux := func(msg jsonmessage.JSONMessage) {
+		var result types.PushResult
+		if json.Unmarshal(*msg.Aux, &result) == nil && result.Digest != "" {
+			digest = result.Digest
 		}
 	}
 
-	defer rd.Close()
-	return "push complete"
+	if out == nil {
+		termFd, isTerm := term.GetFdInfo(os.Stderr)
+		err = jsonmessage.DisplayJSONMessagesStream(rd, os.Stderr, termFd, isTerm, aux)
+	} else {
+		err = jsonmessage.DisplayJSONMessagesStream(rd, out, 0, false, aux)
+	}
+
+	return digest, err
 }
 
 // dockerLog is a logging method that tries to handle the output produced by the docker daemon.
@@ -483,3 +877,30 @@ func dockerLog(msg string) string {
 
 	return msg
 }
+
+// plainLog writes the text of a docker daemon message to out without any terminal formatting, this is
+// used when several builds share the same output.
+func plainLog(out io.Writer, msg string) {
+
+	var message jsonmessage.JSONMessage
+	if err := json.Unmarshal([]byte(msg), &message); err != nil {
+		fmt.Fprintln(out, msg)
+		return
+	}
+
+	// progress bars only make sense on a terminal, the status line before and after them is enough here
+	if message.Progress != nil {
+		return
+	}
+
+	var text = message.Stream
+	if message.Status != "" {
+		text = strings.TrimSpace(message.ID + " " + message.Status)
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+		if strings.TrimSpace(line) != "" {
+			fmt.Fprintln(out, line)
+		}
+	}
+}
@@ -86,6 +86,9 @@ func Test_BranchVariant(t *testing.T) {
 }
 
 func Test_GetTag(t *testing.T) {
+	BuildImageDirname = "images"
+	defer func() { BuildImageDirname = "." }()
+
 	var expect = "superterran/mach:example"
 	var actual = getTag("images/example/Dockerfile")
 	assert.Contains(t, actual, expect,
@@ -94,6 +97,9 @@ func Test_GetTag(t *testing.T) {
 }
 
 func Test_GetTagNoRegistry(t *testing.T) {
+	BuildImageDirname = "images"
+	defer func() { BuildImageDirname = "." }()
+
 	DockerRegistry = ""
 	var expect = "example"
 	var actual = getTag("images/example/Dockerfile")
@@ -103,6 +109,9 @@ func Test_GetTagNoRegistry(t *testing.T) {
 }
 
 func Test_GetTagWithVariant(t *testing.T) {
+	BuildImageDirname = "images"
+	defer func() { BuildImageDirname = "." }()
+
 	DockerRegistry = "superterran/mach"
 	var expect = "superterran/mach:example-test"
 	var actual = getTag("images/example/Dockerfile-test")
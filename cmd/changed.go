@@ -0,0 +1,161 @@
+// Cmd changed narrows a build down to the images that have changed since a git ref
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// ChangedSince limits the build to images with changes since a git ref, set with `--changed-since`. Changes
+// are committed ones between the ref and HEAD, plus anything uncommitted in the working tree.
+var ChangedSince string = ""
+
+// changedFiles returns the absolute paths of every file that differs between the ref and the working tree
+// of the repository at path.
+func changedFiles(path string, ref string) (map[string]bool, error) {
+
+	repo, err := git.PlainOpenWithOptions(path, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil, err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+
+	root := worktree.Filesystem.Root()
+
+	from, err := commitTree(repo, plumbing.Revision(ref))
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve %s: %v", ref, err)
+	}
+
+	to, err := commitTree(repo, plumbing.Revision(plumbing.HEAD))
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := from.Diff(to)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+
+	for _, change := range changes {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if name != "" {
+				changed[filepath.Join(root, name)] = true
+			}
+		}
+	}
+
+	status, err := worktree.Status()
+	if err != nil {
+		return nil, err
+	}
+
+	for name, file := range status {
+		if file.Staging != git.Unmodified || file.Worktree != git.Unmodified {
+			changed[filepath.Join(root, name)] = true
+		}
+	}
+
+	return changed, nil
+}
+
+func commitTree(repo *git.Repository, rev plumbing.Revision) (*object.Tree, error) {
+
+	hash, err := repo.ResolveRevision(rev)
+	if err != nil {
+		return nil, err
+	}
+
+	commit, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return commit.Tree()
+}
+
+// filterChanged keeps the planned images that have changed, along with every image built from a changed
+// image, even when the change is further up the chain or outside the selection.
+func filterChanged(nodes []*buildNode, changed map[string]bool) []*buildNode {
+
+	memo := map[*buildNode]bool{}
+
+	var affected func(node *buildNode) bool
+	affected = func(node *buildNode) bool {
+		if result, ok := memo[node]; ok {
+			return result
+		}
+
+		result := imageChanged(node.Filename, changed)
+		for _, parent := range node.Parents {
+			if affected(parent) {
+				result = true
+			}
+		}
+
+		memo[node] = result
+		return result
+	}
+
+	var result []*buildNode
+	for _, node := range nodes {
+		if affected(node) {
+			result = append(result, node)
+		}
+	}
+
+	return result
+}
+
+// imageChanged reports if anything in the image's directory changed, which covers the Dockerfiles, includes and
+// build context, or the API_VERSION it inherits from a directory above when it doesn't have its own. Changes
+// to images nested in its directory are theirs.
+func imageChanged(filename string, changed map[string]bool) bool {
+
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return true
+	}
+
+	var nested []string
+	for _, rel := range nestedImageDirs(dir) {
+		nested = append(nested, filepath.Join(dir, rel)+string(filepath.Separator))
+	}
+
+	for path := range changed {
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) && !hasAnyPrefix(path, nested) {
+			return true
+		}
+	}
+
+	if path := apiVersionFile(filename); path != "" {
+		if abs, err := filepath.Abs(path); err == nil {
+			return changed[abs]
+		}
+	}
+
+	return false
+}
+
+// hasAnyPrefix reports if s starts with any of the prefixes
+func hasAnyPrefix(s string, prefixes []string) bool {
+
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
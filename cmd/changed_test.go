@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// commitAll stages everything in the repository and commits it
+func commitAll(t *testing.T, repo *git.Repository, msg string) {
+
+	worktree, _ := repo.Worktree()
+	worktree.AddGlob(".")
+
+	_, err := worktree.Commit(msg, &git.CommitOptions{
+		Author: &object.Signature{Name: "mach", Email: "mach@example.com", When: time.Now()},
+	})
+	if err != nil {
+		assert.FailNowf(t, "could not commit", "Error msg: %v", err)
+	}
+}
+
+func Test_buildChangedSince(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	dir := writeTestImages(t, map[string]string{
+		"images/base":    "FROM alpine\n",
+		"images/php":     "FROM superterran/mach:v1-base\n",
+		"images/other":   "FROM alpine\n",
+		"images/version": "FROM alpine\n",
+	})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "images", "API_VERSION"), []byte("v1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "images", "version", "API_VERSION"), []byte("v2"), 0644)
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		assert.FailNowf(t, "could not init repo", "Error msg: %v", err)
+	}
+	commitAll(t, repo, "initial")
+
+	os.MkdirAll(filepath.Join(dir, "images", "base", "includes"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "images", "base", "includes", "run.tpl"), []byte("RUN true"), 0644)
+
+	BuildImageDirname = filepath.Join(dir, "images")
+	defer func() { BuildImageDirname = "." }()
+
+	nodes, _ := planBuildOrder(findDockerfiles(nil))
+
+	changed, err := changedFiles(dir, "HEAD")
+	assert.NoError(t, err)
+
+	var actual []string
+	for _, node := range filterChanged(nodes, changed) {
+		actual = append(actual, filepath.Base(filepath.Dir(node.Filename)))
+	}
+
+	assert.Equal(t, []string{"base", "php"}, actual, "uncommitted changes and downstream images should be built")
+
+	commitAll(t, repo, "include")
+	ioutil.WriteFile(filepath.Join(dir, "images", "API_VERSION"), []byte("v3"), 0644)
+	commitAll(t, repo, "version")
+
+	changed, err = changedFiles(dir, "HEAD~1")
+	assert.NoError(t, err)
+
+	actual = nil
+	for _, node := range filterChanged(nodes, changed) {
+		actual = append(actual, filepath.Base(filepath.Dir(node.Filename)))
+	}
+
+	assert.Equal(t, []string{"base", "other", "php"}, actual, "images inheriting API_VERSION should be built")
+
+	_, err = changedFiles(dir, "no-such-ref")
+	assert.Error(t, err)
+}
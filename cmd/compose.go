@@ -2,11 +2,12 @@
 package cmd
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"text/template"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -23,7 +24,7 @@ func CreateComposeCmd() *cobra.Command {
 		Short: "Runs docker compose on compositions in a directory.",
 		Long:  ``,
 		RunE: func(cmd *cobra.Command, args []string) error {
-
+			cmd.SilenceUsage = true
 			return runCompose(cmd, args)
 		},
 	}
@@ -40,16 +41,29 @@ func init() {
 
 	composeCmd.Flags().BoolP("first-only", "f", FirstOnly, "stop the build loop after the first image is found")
 
+	composeCmd.Flags().Bool("strict", StrictTemplates, "fail on template keys that do not exist (default on when CI is set)")
+
 }
 
 func runCompose(cmd *cobra.Command, args []string) error {
 
 	ComposeDirname = viper.GetString("ComposeDirname")
 
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
 	OutputOnly, _ = cmd.Flags().GetBool("output-only")
 
 	FirstOnly, _ = cmd.Flags().GetBool("first-only")
 
+	StrictTemplates = viper.GetBool("strict_templates")
+	if cmd.Flags().Changed("strict") {
+		StrictTemplates, _ = cmd.Flags().GetBool("strict")
+	}
+
 	return MainComposeFlow(args)
 }
 
@@ -63,7 +77,9 @@ func MainComposeFlow(args []string) error {
 
 		if contains(s, args[1]) {
 			composeArgs := args[1:]
-			RunCompose(args[0], composeArgs)
+			if err := RunCompose(args[0], composeArgs); err != nil {
+				return err
+			}
 		}
 	}
 
@@ -74,7 +90,9 @@ func MainComposeFlow(args []string) error {
 				dir := filepath.Dir(match)
 				composition := filepath.Base(dir)
 				composeArgs := args[0:]
-				RunCompose(composition, composeArgs)
+				if err := RunCompose(composition, composeArgs); err != nil {
+					return err
+				}
 
 				if FirstOnly {
 					break
@@ -92,7 +110,7 @@ func MainComposeFlow(args []string) error {
 // RunCompose is a wrapper for `docker-compose`. It requires `docker-compose` installed locally, and the command is
 // invoked from the directory of the composition. When running commands, pass flags to docker-composer with --, i.e.
 // `mach compose satis up -- -d --force-recreate`.
-func RunCompose(composition string, args []string) {
+func RunCompose(composition string, args []string) error {
 
 	baseCmd := "docker-compose"
 
@@ -100,7 +118,9 @@ func RunCompose(composition string, args []string) {
 	composeDir, _ = filepath.Abs(composeDir)
 
 	if _, err := os.Stat(composeDir + "/docker-compose.yml.tpl"); err == nil {
-		generateCompositionTemplate(composeDir + "/docker-compose.yml.tpl")
+		if err := generateCompositionTemplate(composeDir + "/docker-compose.yml.tpl"); err != nil {
+			return err
+		}
 	}
 
 	s := []string{"up", "down", "ps"}
@@ -117,27 +137,25 @@ func RunCompose(composition string, args []string) {
 		}
 	}
 
+	return nil
 }
 
-func generateCompositionTemplate(filename string) {
-
-	generateFilename := filepath.Dir(filename) + "/docker-compose.yml"
+// generateCompositionTemplate renders a docker-compose.yml.tpl with the settings from .mach.yaml, writing the
+// docker-compose.yml next to it, or to stdout with OutputOnly. Nothing is written if the template fails.
+func generateCompositionTemplate(filename string) error {
 
-	wr := os.Stdout
+	var rendered bytes.Buffer
 
-	if !OutputOnly {
-		wr, _ = os.Create(generateFilename)
+	if err := renderTemplate(&rendered, filename, viper.AllSettings()); err != nil {
+		return err
 	}
 
-	tpl, _ := template.ParseGlob(filename)
-
-	tpl.ParseGlob(filepath.Dir(filename) + "/includes/*.tpl")
-
-	tpl.Execute(wr, viper.AllSettings())
-
-	if !OutputOnly {
-		wr.Close()
+	if OutputOnly {
+		_, err := rendered.WriteTo(os.Stdout)
+		return err
 	}
+
+	return ioutil.WriteFile(filepath.Dir(filename)+"/docker-compose.yml", rendered.Bytes(), 0644)
 }
 
 func contains(s []string, str string) bool {
@@ -0,0 +1,137 @@
+// Cmd context packs the build context sent to the docker daemon, without writing anything to the source tree
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// buildContextDockerfile is the name the rendered Dockerfile is given inside the build context
+const buildContextDockerfile = ".mach.Dockerfile"
+
+// contextTar packs the directory of an image as the daemon sees it, leaving out anything excluded by the
+// .dockerignore in that directory, and the directories of images nested in it.
+func contextTar(dir string) (io.ReadCloser, error) {
+
+	excludes, err := readDockerignore(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// last, so no exception in the .dockerignore brings them back
+	excludes = append(excludes, nestedImageDirs(dir)...)
+
+	return archive.TarWithOptions(dir, &archive.TarOptions{ExcludePatterns: excludes})
+}
+
+// buildContext streams the build context for an image with the rendered Dockerfile added to it in memory,
+// under the name buildContextDockerfile.
+func buildContext(dir string, dockerfile []byte) (io.ReadCloser, error) {
+
+	src, err := contextTar(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		defer src.Close()
+
+		tr := tar.NewReader(src)
+		tw := tar.NewWriter(pw)
+
+		err := func() error {
+			for {
+				header, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					return err
+				}
+
+				if header.Name == buildContextDockerfile {
+					continue
+				}
+
+				if err := tw.WriteHeader(header); err != nil {
+					return err
+				}
+
+				if _, err := io.Copy(tw, tr); err != nil {
+					return err
+				}
+			}
+
+			err := tw.WriteHeader(&tar.Header{
+				Name:     buildContextDockerfile,
+				Typeflag: tar.TypeReg,
+				Mode:     0644,
+				Size:     int64(len(dockerfile)),
+				ModTime:  time.Now(),
+			})
+			if err != nil {
+				return err
+			}
+
+			if _, err := tw.Write(dockerfile); err != nil {
+				return err
+			}
+
+			return tw.Close()
+		}()
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// readDockerignore reads the exclude patterns from a .dockerignore, following the same rules as the docker
+// cli: blank lines and comments are skipped, patterns are cleaned and `!` marks an exception.
+func readDockerignore(dir string) ([]string, error) {
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var excludes []string
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		pattern := strings.TrimSpace(scanner.Text())
+		if pattern == "" || strings.HasPrefix(pattern, "#") {
+			continue
+		}
+
+		invert := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimSpace(strings.TrimPrefix(pattern, "!"))
+
+		if pattern != "" {
+			pattern = filepath.Clean(filepath.FromSlash(pattern))
+			if len(pattern) > 1 && pattern[0] == filepath.Separator {
+				pattern = pattern[1:]
+			}
+		}
+
+		if invert {
+			pattern = "!" + pattern
+		}
+
+		excludes = append(excludes, pattern)
+	}
+
+	return excludes, scanner.Err()
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_readDockerignore(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", ".dockerignore"), []byte("# comment\n\n/node_modules/\n*.log\n!keep.log\n"), 0644)
+
+	excludes, err := readDockerignore(filepath.Join(dir, "php"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node_modules", "*.log", "!keep.log"}, excludes)
+}
+
+func Test_buildContext(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM {{ .Name }}\n"})
+	defer os.RemoveAll(dir)
+
+	image := filepath.Join(dir, "php")
+	ioutil.WriteFile(filepath.Join(image, ".dockerignore"), []byte("*.log\n!keep.log\n"), 0644)
+	ioutil.WriteFile(filepath.Join(image, "build.log"), []byte("noise"), 0644)
+	ioutil.WriteFile(filepath.Join(image, "keep.log"), []byte("keep"), 0644)
+
+	rd, err := buildContext(image, []byte("FROM alpine\n"))
+	if err != nil {
+		assert.FailNowf(t, "buildContext returned an error", "Error msg: %v", err)
+	}
+	defer rd.Close()
+
+	files := map[string]string{}
+
+	tr := tar.NewReader(rd)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+
+		content, _ := ioutil.ReadAll(tr)
+		files[header.Name] = string(content)
+	}
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	assert.Equal(t, []string{".dockerignore", buildContextDockerfile, "Dockerfile", "keep.log"}, names)
+	assert.Equal(t, "FROM alpine\n", files[buildContextDockerfile], "the rendered Dockerfile should be in the context")
+
+	entries, _ := ioutil.ReadDir(image)
+	assert.Len(t, entries, 4, "nothing should be written to the image directory")
+}
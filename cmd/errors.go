@@ -0,0 +1,128 @@
+// Cmd errors holds the typed errors of the build pipeline and the exit codes they map to
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Exit codes for the failures pipelines may want to tell apart, anything else exits with 1
+const (
+	ExitTemplateFailure = 3
+	ExitBuildFailure    = 4
+	ExitPushFailure     = 5
+	ExitLintFailure     = 6
+	ExitTestFailure     = 7
+	ExitScanFailure     = 8
+	ExitSBOMFailure     = 9
+	ExitExportFailure   = 10
+)
+
+// The stages of the build pipeline an image can fail in
+const (
+	stageTemplate = "template"
+	stageBuild    = "build"
+	stageTest     = "test"
+	stageSBOM     = "sbom"
+	stageScan     = "scan"
+	stageExport   = "export"
+	stagePush     = "push"
+)
+
+// stageOrder is the order images go through the stages in
+var stageOrder = []string{stageTemplate, stageBuild, stageTest, stageSBOM, stageScan, stageExport, stagePush}
+
+// exitCoder is an error that knows the exit code it should produce
+type exitCoder interface {
+	ExitCode() int
+}
+
+// exitCode returns the exit code for an error returned by a command
+func exitCode(err error) int {
+
+	var coder exitCoder
+	if errors.As(err, &coder) {
+		return coder.ExitCode()
+	}
+
+	return 1
+}
+
+func (e *templateError) ExitCode() int {
+	return ExitTemplateFailure
+}
+
+// buildError is an image that failed in one of the stages of the build pipeline
+type buildError struct {
+	Stage string
+	Tag   string
+	Err   error
+}
+
+// newBuildError wraps an error from building an image, template errors are always reported as such no
+// matter which stage they surfaced in.
+func newBuildError(stage string, tag string, err error) *buildError {
+
+	var tplErr *templateError
+	if errors.As(err, &tplErr) {
+		stage = stageTemplate
+	}
+
+	return &buildError{Stage: stage, Tag: tag, Err: err}
+}
+
+func (e *buildError) Error() string {
+	return fmt.Sprintf("%s: %s failed: %v", e.Tag, e.Stage, e.Err)
+}
+
+func (e *buildError) Unwrap() error {
+	return e.Err
+}
+
+func (e *buildError) ExitCode() int {
+
+	switch e.Stage {
+	case stageTemplate:
+		return ExitTemplateFailure
+	case stageTest:
+		return ExitTestFailure
+	case stageSBOM:
+		return ExitSBOMFailure
+	case stageScan:
+		return ExitScanFailure
+	case stageExport:
+		return ExitExportFailure
+	case stagePush:
+		return ExitPushFailure
+	}
+
+	return ExitBuildFailure
+}
+
+// buildFailures collects the failed images of a build. When images failed in different stages the exit
+// code of the earliest stage wins, as a broken template usually explains the rest.
+type buildFailures []*buildError
+
+func (f buildFailures) Error() string {
+
+	var tags []string
+	for _, failure := range f {
+		tags = append(tags, failure.Tag)
+	}
+
+	return fmt.Sprintf("%d image(s) failed: %s", len(f), strings.Join(tags, ", "))
+}
+
+func (f buildFailures) ExitCode() int {
+
+	for _, stage := range stageOrder {
+		for _, failure := range f {
+			if failure.Stage == stage {
+				return failure.ExitCode()
+			}
+		}
+	}
+
+	return ExitBuildFailure
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_exitCode(t *testing.T) {
+
+	assert.Equal(t, 1, exitCode(errors.New("unknown")))
+	assert.Equal(t, ExitTemplateFailure, exitCode(fmt.Errorf("wrapped: %w", &templateError{File: "Dockerfile"})))
+	assert.Equal(t, ExitBuildFailure, exitCode(newBuildError(stageBuild, "php", errors.New("boom"))))
+	assert.Equal(t, ExitPushFailure, exitCode(newBuildError(stagePush, "php", errors.New("denied"))))
+	assert.Equal(t, ExitTestFailure, exitCode(newBuildError(stageTest, "php", errors.New("user"))))
+	assert.Equal(t, ExitSBOMFailure, exitCode(newBuildError(stageSBOM, "php", errors.New("no space left"))))
+	assert.Equal(t, ExitExportFailure, exitCode(newBuildError(stageExport, "php", errors.New("no space left"))))
+}
+
+func Test_newBuildErrorTemplate(t *testing.T) {
+
+	var actual = newBuildError(stageBuild, "php", &templateError{File: "Dockerfile", Line: 2, Message: "bad"})
+
+	assert.Equal(t, stageTemplate, actual.Stage, "template errors should be reported as template failures")
+	assert.Equal(t, "php: template failed: Dockerfile:2: bad", actual.Error())
+}
+
+func Test_buildFailuresExitCode(t *testing.T) {
+
+	var failures = buildFailures{
+		newBuildError(stagePush, "php", errors.New("denied")),
+		newBuildError(stageBuild, "node", errors.New("boom")),
+	}
+
+	assert.Equal(t, ExitBuildFailure, exitCode(failures), "the earliest stage should decide the exit code")
+	assert.Equal(t, "2 image(s) failed: php, node", failures.Error())
+}
+
+func Test_buildFailuresTestStage(t *testing.T) {
+
+	var failures = buildFailures{
+		newBuildError(stagePush, "php", errors.New("denied")),
+		newBuildError(stageTest, "node", errors.New("2 of 5 checks failed")),
+	}
+
+	assert.Equal(t, ExitTestFailure, exitCode(failures), "a failed test comes before a failed push")
+}
+
+func Test_buildFailuresScanStage(t *testing.T) {
+
+	var failures = buildFailures{
+		newBuildError(stagePush, "php", errors.New("denied")),
+		newBuildError(stageScan, "node", &scanFailure{Count: 2, FailOn: severityHigh}),
+	}
+
+	assert.Equal(t, ExitScanFailure, exitCode(failures), "a failed scan comes before a failed push")
+
+	failures = append(failures, newBuildError(stageTest, "ruby", errors.New("1 of 3 checks failed")))
+
+	assert.Equal(t, ExitTestFailure, exitCode(failures), "images are tested before they are scanned")
+}
@@ -0,0 +1,418 @@
+// Cmd export writes built images to a directory, as docker-archive tarballs or OCI image layouts, for moving
+// them to where no registry can be reached
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+)
+
+// ExportDir is where builds write each image, none when empty. Set with `--export` or `export_dir` in config
+var ExportDir string = ""
+
+// ExportFormat is how images are exported, `docker-archive` or `oci`. Set with `--export-format`
+var ExportFormat string = exportDockerArchive
+
+// The formats images can be exported in
+const (
+	exportDockerArchive = "docker-archive"
+	exportOCI           = "oci"
+)
+
+// exportIndexFilename lists the exported images of a directory, for `mach load`
+const exportIndexFilename = "mach-export.json"
+
+// The media types and annotations of an OCI image layout
+const (
+	ociManifestType      = "application/vnd.oci.image.manifest.v1+json"
+	ociConfigType        = "application/vnd.oci.image.config.v1+json"
+	ociLayerType         = "application/vnd.oci.image.layer.v1.tar"
+	ociLayerGzipType     = "application/vnd.oci.image.layer.v1.tar+gzip"
+	ociRefNameAnnotation = "org.opencontainers.image.ref.name"
+	// ociImageNameAnnotation holds the full reference, as containerd and docker write it
+	ociImageNameAnnotation = "io.containerd.image.name"
+)
+
+// exportIndex is the index file of an export directory
+type exportIndex struct {
+	Images []*exportedImage `json:"images"`
+}
+
+// exportedImage is an image written to an export directory
+type exportedImage struct {
+	Tag  string   `json:"tag"`
+	Tags []string `json:"tags"`
+	// Format is `docker-archive` or `oci`
+	Format string `json:"format"`
+	// Path is the tarball or layout directory, relative to the export directory
+	Path    string `json:"path"`
+	ImageID string `json:"image_id,omitempty"`
+	// Digest is the sha256 of the tarball, or of the manifest of the layout
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Exported time.Time `json:"exported"`
+}
+
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type ociManifest struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType"`
+	Config        ociDescriptor   `json:"config"`
+	Layers        []ociDescriptor `json:"layers"`
+}
+
+type ociIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	Manifests     []ociDescriptor `json:"manifests"`
+}
+
+// dockerArchiveManifest is an image in the manifest.json of a `docker save` tarball
+type dockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+func checkExportFormat(format string) error {
+
+	if format != exportDockerArchive && format != exportOCI {
+		return fmt.Errorf("unknown export format %q, use docker-archive or oci", format)
+	}
+
+	return nil
+}
+
+// exportBuiltImage writes a freshly built image, with all of its tags, to ExportDir
+func exportBuiltImage(build *imageBuild, out io.Writer) error {
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	build.Export, err = exportImage(context.Background(), cli, build.Tags, ExportDir, ExportFormat)
+	if err != nil {
+		return err
+	}
+
+	printStatus(out, color.New(color.FgGreen), fmt.Sprintf("exported %s to %s", build.Tag, filepath.Join(ExportDir, build.Export.Path)))
+
+	return nil
+}
+
+// exportImage saves an image from the daemon into dir, named after its first tag: `<tag>.tar` for a
+// docker-archive, a `<tag>` layout directory for oci
+func exportImage(ctx context.Context, cli client.APIClient, tags []string, dir string, format string) (*exportedImage, error) {
+
+	if err := checkExportFormat(format); err != nil {
+		return nil, err
+	}
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, tags[0])
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	saved, err := cli.ImageSave(ctx, tags)
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	image := &exportedImage{
+		Tag:      tags[0],
+		Tags:     tags,
+		Format:   format,
+		Path:     tagFilename(tags[0]),
+		ImageID:  inspect.ID,
+		Exported: time.Now().UTC(),
+	}
+
+	if format == exportOCI {
+		image.Digest, image.Size, err = writeOCILayout(saved, filepath.Join(dir, image.Path), tags)
+		return image, err
+	}
+
+	image.Path += ".tar"
+
+	image.Digest, image.Size, err = writeBlobFile(saved, filepath.Join(dir, image.Path))
+
+	return image, err
+}
+
+// writeBlobFile copies r to a file, through a temporary file so a failed export never leaves a partial one
+// behind, and returns the sha256 digest and size of what was written
+func writeBlobFile(r io.Reader, filename string) (string, int64, error) {
+
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".mach-export-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	hash := sha256.New()
+
+	size, err := io.Copy(io.MultiWriter(tmp, hash), r)
+	if err != nil {
+		tmp.Close()
+		return "", 0, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.Rename(tmp.Name(), filename); err != nil {
+		return "", 0, err
+	}
+
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), size, nil
+}
+
+// writeOCILayout turns a `docker save` tarball into an OCI image layout directory, with an entry in its
+// index.json for each tag. It returns the digest of the image manifest and the size of the layout.
+func writeOCILayout(r io.Reader, dir string, tags []string) (string, int64, error) {
+
+	blobs := filepath.Join(dir, "blobs", "sha256")
+
+	if err := os.RemoveAll(dir); err != nil {
+		return "", 0, err
+	}
+
+	if err := os.MkdirAll(blobs, 0755); err != nil {
+		return "", 0, err
+	}
+
+	var manifests []dockerArchiveManifest
+	entries := map[string]ociDescriptor{}
+	links := map[string]string{}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", 0, err
+		}
+
+		switch {
+		case header.Typeflag == tar.TypeSymlink:
+			// docker save links layers it has already written
+			links[header.Name] = path.Join(path.Dir(header.Name), header.Linkname)
+		case header.Typeflag != tar.TypeReg:
+			continue
+		case header.Name == "manifest.json":
+			if err := json.NewDecoder(tr).Decode(&manifests); err != nil {
+				return "", 0, fmt.Errorf("manifest.json: %v", err)
+			}
+		default:
+			descriptor, err := writeOCIBlob(tr, blobs)
+			if err != nil {
+				return "", 0, err
+			}
+			entries[header.Name] = descriptor
+		}
+	}
+
+	if len(manifests) == 0 {
+		return "", 0, fmt.Errorf("no manifest.json in the exported image")
+	}
+
+	entry := func(name string) (ociDescriptor, error) {
+		for i := 0; i < 10; i++ {
+			if target, ok := links[name]; ok {
+				name = target
+				continue
+			}
+			if descriptor, ok := entries[name]; ok {
+				return descriptor, nil
+			}
+			break
+		}
+		return ociDescriptor{}, fmt.Errorf("%s is missing from the exported image", name)
+	}
+
+	manifest := ociManifest{SchemaVersion: 2, MediaType: ociManifestType, Layers: []ociDescriptor{}}
+
+	config, err := entry(manifests[0].Config)
+	if err != nil {
+		return "", 0, err
+	}
+	config.MediaType = ociConfigType
+	manifest.Config = config
+
+	size := config.Size
+	referenced := map[string]bool{config.Digest: true}
+
+	for _, name := range manifests[0].Layers {
+		layer, err := entry(name)
+		if err != nil {
+			return "", 0, err
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+
+		if !referenced[layer.Digest] {
+			referenced[layer.Digest] = true
+			size += layer.Size
+		}
+	}
+
+	// the legacy json files of the tarball have no place in the layout
+	for _, descriptor := range entries {
+		if !referenced[descriptor.Digest] {
+			os.Remove(filepath.Join(blobs, digestHex(descriptor.Digest)))
+		}
+	}
+
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		return "", 0, err
+	}
+
+	descriptor, err := writeOCIBlob(bytes.NewReader(content), blobs)
+	if err != nil {
+		return "", 0, err
+	}
+	descriptor.MediaType = ociManifestType
+	size += descriptor.Size
+
+	index := ociIndex{SchemaVersion: 2}
+	for _, tag := range tags {
+		tagged := descriptor
+		tagged.Annotations = map[string]string{ociRefNameAnnotation: tagName(tag), ociImageNameAnnotation: tag}
+		index.Manifests = append(index.Manifests, tagged)
+	}
+
+	if err := writeJSONFile(filepath.Join(dir, "index.json"), index); err != nil {
+		return "", 0, err
+	}
+
+	if err := writeJSONFile(filepath.Join(dir, "oci-layout"), map[string]string{"imageLayoutVersion": "1.0.0"}); err != nil {
+		return "", 0, err
+	}
+
+	return descriptor.Digest, size, nil
+}
+
+// writeOCIBlob writes a blob into the blobs directory of a layout, named after its digest. Gzipped blobs
+// are given the gzipped layer media type, the caller sets it for anything that isn't a layer.
+func writeOCIBlob(r io.Reader, blobs string) (ociDescriptor, error) {
+
+	br := bufio.NewReader(r)
+
+	mediaType := ociLayerType
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		mediaType = ociLayerGzipType
+	}
+
+	tmp := filepath.Join(blobs, ".partial")
+
+	digest, size, err := writeBlobFile(br, tmp)
+	if err != nil {
+		return ociDescriptor{}, err
+	}
+
+	if err := os.Rename(tmp, filepath.Join(blobs, digestHex(digest))); err != nil {
+		return ociDescriptor{}, err
+	}
+
+	return ociDescriptor{MediaType: mediaType, Digest: digest, Size: size}, nil
+}
+
+// digestHex drops the algorithm from a digest, which is how blobs are named
+func digestHex(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
+}
+
+func writeJSONFile(filename string, v interface{}) error {
+
+	return writeReportFile(filename, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
+}
+
+// readExportIndex reads the index of an export directory, a directory without one has an empty index
+func readExportIndex(dir string) (*exportIndex, error) {
+
+	index := &exportIndex{}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, exportIndexFilename))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, fmt.Errorf("%s: %v", exportIndexFilename, err)
+	}
+
+	return index, nil
+}
+
+// writeExportIndex adds the images a build exported to the index of the export directory. Images exported
+// by earlier builds stay listed, unless their files are gone.
+func writeExportIndex(dir string, results []*buildResult) error {
+
+	index, err := readExportIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	images := map[string]*exportedImage{}
+	for _, image := range index.Images {
+		if _, err := os.Stat(filepath.Join(dir, image.Path)); err == nil {
+			images[image.Tag] = image
+		}
+	}
+
+	for _, result := range results {
+		if result.Build != nil && result.Build.Export != nil {
+			images[result.Build.Export.Tag] = result.Build.Export
+		}
+	}
+
+	index.Images = []*exportedImage{}
+	for _, image := range images {
+		index.Images = append(index.Images, image)
+	}
+
+	sort.Slice(index.Images, func(i, j int) bool { return index.Images[i].Tag < index.Images[j].Tag })
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	return writeJSONFile(filepath.Join(dir, exportIndexFilename), index)
+}
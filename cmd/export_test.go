@@ -0,0 +1,179 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var testExportTags = []string{"superterran/mach:php", "superterran/mach:php-8.1"}
+
+// testExportClient is a daemon holding an image saved the way docker 20.10 does it, with a layer linked to
+// one written before it
+func testExportClient(t *testing.T) *fakeSaveClient {
+
+	base := testLayer(t, map[string]string{"etc/os-release": "ID=alpine\nVERSION_ID=3.16.0\n"}, false)
+	app := testLayer(t, map[string]string{"srv/app/index.php": "<?php echo 'hi';"}, true)
+
+	var saved bytes.Buffer
+	tw := tar.NewWriter(&saved)
+
+	write := func(name string, content []byte) {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+
+	manifest, _ := json.Marshal([]dockerArchiveManifest{{
+		Config:   "abc.json",
+		RepoTags: testExportTags,
+		Layers:   []string{"1/layer.tar", "2/layer.tar", "3/layer.tar"},
+	}})
+
+	write("manifest.json", manifest)
+	write("abc.json", []byte(`{"architecture": "amd64"}`))
+	write("repositories", []byte(`{"superterran/mach": {"php": "1"}}`))
+	write("1/layer.tar", base)
+	write("1/json", []byte(`{"id": "1"}`))
+	write("2/layer.tar", app)
+	tw.WriteHeader(&tar.Header{Name: "3/layer.tar", Linkname: "../1/layer.tar", Typeflag: tar.TypeSymlink})
+	tw.Close()
+
+	return &fakeSaveClient{
+		fakeContainerClient: fakeContainerClient{
+			fakeDockerClient: fakeDockerClient{images: map[string]types.ImageInspect{
+				"superterran/mach:php": {ID: "sha256:abc"},
+			}},
+		},
+		saved: saved.Bytes(),
+	}
+}
+
+func testExportDir(t *testing.T) string {
+
+	dir, err := ioutil.TempDir("", "mach-export")
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	return dir
+}
+
+func Test_exportImageDockerArchive(t *testing.T) {
+
+	cli := testExportClient(t)
+	dir := testExportDir(t)
+
+	image, err := exportImage(context.Background(), cli, testExportTags, dir, exportDockerArchive)
+	assert.NoError(t, err)
+
+	sum := sha256.Sum256(cli.saved)
+
+	assert.Equal(t, "superterran/mach:php", image.Tag)
+	assert.Equal(t, testExportTags, image.Tags)
+	assert.Equal(t, "superterran_mach_php.tar", image.Path)
+	assert.Equal(t, "sha256:abc", image.ImageID)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), image.Digest)
+	assert.Equal(t, int64(len(cli.saved)), image.Size)
+
+	written, _ := ioutil.ReadFile(filepath.Join(dir, image.Path))
+	assert.Equal(t, cli.saved, written)
+
+	files, _ := ioutil.ReadDir(dir)
+	assert.Len(t, files, 1, "no temporary files are left behind")
+
+	_, err = exportImage(context.Background(), cli, []string{"superterran/mach:node"}, dir, exportDockerArchive)
+	assert.Error(t, err, "images that aren't in the daemon can't be exported")
+
+	_, err = exportImage(context.Background(), cli, testExportTags, dir, "tgz")
+	assert.Error(t, err)
+}
+
+func Test_exportImageOCI(t *testing.T) {
+
+	cli := testExportClient(t)
+	dir := testExportDir(t)
+
+	image, err := exportImage(context.Background(), cli, testExportTags, dir, exportOCI)
+	assert.NoError(t, err)
+
+	layout := filepath.Join(dir, "superterran_mach_php")
+	assert.Equal(t, "superterran_mach_php", image.Path)
+
+	var version map[string]string
+	assert.NoError(t, readJSONFile(filepath.Join(layout, "oci-layout"), &version))
+	assert.Equal(t, "1.0.0", version["imageLayoutVersion"])
+
+	var index ociIndex
+	assert.NoError(t, readJSONFile(filepath.Join(layout, "index.json"), &index))
+
+	if !assert.Len(t, index.Manifests, 2) {
+		return
+	}
+	assert.Equal(t, image.Digest, index.Manifests[0].Digest)
+	assert.Equal(t, "php-8.1", index.Manifests[1].Annotations[ociRefNameAnnotation])
+	assert.Equal(t, "superterran/mach:php-8.1", index.Manifests[1].Annotations[ociImageNameAnnotation])
+
+	var manifest ociManifest
+	assert.NoError(t, readJSONFile(filepath.Join(layout, "blobs", "sha256", digestHex(image.Digest)), &manifest))
+
+	assert.Equal(t, ociManifestType, manifest.MediaType)
+	assert.Equal(t, ociConfigType, manifest.Config.MediaType)
+	if assert.Len(t, manifest.Layers, 3) {
+		assert.Equal(t, ociLayerType, manifest.Layers[0].MediaType)
+		assert.Equal(t, ociLayerGzipType, manifest.Layers[1].MediaType)
+		assert.Equal(t, manifest.Layers[0], manifest.Layers[2], "linked layers are the same blob")
+	}
+
+	blobs, _ := ioutil.ReadDir(filepath.Join(layout, "blobs", "sha256"))
+	assert.Len(t, blobs, 4, "the manifest, config and two layers, the legacy json files are left out")
+
+	assert.Equal(t, manifest.Config.Size+manifest.Layers[0].Size+manifest.Layers[1].Size+index.Manifests[0].Size, image.Size)
+}
+
+func Test_writeExportIndex(t *testing.T) {
+
+	dir := testExportDir(t)
+
+	ioutil.WriteFile(filepath.Join(dir, "superterran_mach_node.tar"), []byte("node"), 0644)
+
+	assert.NoError(t, writeJSONFile(filepath.Join(dir, exportIndexFilename), exportIndex{Images: []*exportedImage{
+		{Tag: "superterran/mach:php", Path: "superterran_mach_php.tar", Digest: "sha256:old"},
+		{Tag: "superterran/mach:node", Path: "superterran_mach_node.tar"},
+		{Tag: "superterran/mach:ruby", Path: "superterran_mach_ruby.tar"},
+	}}))
+
+	results := []*buildResult{
+		{Build: &imageBuild{Tag: "superterran/mach:php", Export: &exportedImage{Tag: "superterran/mach:php", Path: "superterran_mach_php.tar", Digest: "sha256:new"}}},
+		{Build: &imageBuild{Tag: "superterran/mach:go", Export: &exportedImage{Tag: "superterran/mach:go", Path: "superterran_mach_go"}}},
+		{Build: &imageBuild{Tag: "superterran/mach:base"}},
+		{Skipped: "superterran/mach:base failed"},
+	}
+
+	assert.NoError(t, writeExportIndex(dir, results))
+
+	index, err := readExportIndex(dir)
+	assert.NoError(t, err)
+
+	var tags []string
+	for _, image := range index.Images {
+		tags = append(tags, image.Tag)
+	}
+
+	assert.Equal(t, []string{"superterran/mach:go", "superterran/mach:node", "superterran/mach:php"}, tags, "ruby's tarball is gone")
+	assert.Equal(t, "sha256:new", index.Images[2].Digest)
+
+	empty, err := readExportIndex(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, empty.Images)
+}
@@ -0,0 +1,192 @@
+// Cmd gitref works out which branch or release is being built, from git or from the CI system running mach
+package cmd
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// ciBranchEnv are the variables CI systems put the branch in when they check out a detached HEAD, in the order
+// they are looked at. Pull requests come first, so they are tagged after their source branch.
+var ciBranchEnv = []string{
+	"GITHUB_HEAD_REF",
+	"CI_MERGE_REQUEST_SOURCE_BRANCH_NAME",
+	"CI_COMMIT_BRANCH",
+	"CIRCLE_BRANCH",
+	"TRAVIS_PULL_REQUEST_BRANCH",
+	"TRAVIS_BRANCH",
+	"BUILDKITE_BRANCH",
+	"BITBUCKET_BRANCH",
+	"BRANCH_NAME",
+	"GIT_BRANCH",
+}
+
+// ciTagEnv are the variables CI systems put the git tag being built in
+var ciTagEnv = []string{
+	"CI_COMMIT_TAG",
+	"CIRCLE_TAG",
+	"TRAVIS_TAG",
+	"BUILDKITE_TAG",
+	"BITBUCKET_TAG",
+	"TAG_NAME",
+}
+
+// gitRef is what the working directory has checked out
+type gitRef struct {
+	// Branch is the branch name, like `feature/new-php`
+	Branch string
+	// Release is the git tag at HEAD, which makes this a release build
+	Release string
+	// SHA is the short commit hash
+	SHA string
+}
+
+var (
+	gitRefOnce sync.Once
+	gitRefRead gitRef
+)
+
+// currentGitRef returns what the repository in the working directory has checked out, falling back to the
+// CI environment when HEAD is detached. Anything that can't be worked out is left empty, as is everything
+// outside of a git repository. It is read once, as every image's tags need it and it doesn't change mid-run.
+func currentGitRef() gitRef {
+
+	gitRefOnce.Do(func() {
+		gitRefRead = readGitRef(".", os.Getenv)
+	})
+
+	return gitRefRead
+}
+
+// readGitRef reads the checked out ref of the repository at path, with getenv used to look up CI variables
+func readGitRef(path string, getenv func(string) string) gitRef {
+
+	var ref gitRef
+
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return ref
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return ref
+	}
+
+	ref.SHA = head.Hash().String()[:7]
+	ref.Release = tagAt(repo, head.Hash())
+
+	if head.Name().IsBranch() {
+		ref.Branch = head.Name().Short()
+		return ref
+	}
+
+	if ref.Release == "" {
+		ref.Release = ciTag(getenv)
+	}
+
+	if ref.Release == "" {
+		ref.Branch = ciBranch(getenv)
+	}
+
+	return ref
+}
+
+// tagAt returns the git tag pointing at a commit, the first by name when there are several
+func tagAt(repo *git.Repository, hash plumbing.Hash) string {
+
+	tags, err := repo.Tags()
+	if err != nil {
+		return ""
+	}
+
+	var names []string
+
+	tags.ForEach(func(ref *plumbing.Reference) error {
+		target := ref.Hash()
+		if tag, err := repo.TagObject(target); err == nil {
+			target = tag.Target
+		}
+		if target == hash {
+			names = append(names, ref.Name().Short())
+		}
+		return nil
+	})
+
+	if len(names) == 0 {
+		return ""
+	}
+
+	sort.Strings(names)
+
+	return names[0]
+}
+
+// ciBranch returns the branch from the CI environment
+func ciBranch(getenv func(string) string) string {
+
+	if getenv("GITHUB_REF_TYPE") == "branch" && getenv("GITHUB_HEAD_REF") == "" {
+		return getenv("GITHUB_REF_NAME")
+	}
+
+	for _, name := range ciBranchEnv {
+		if branch := getenv(name); branch != "" {
+			return strings.TrimPrefix(strings.TrimPrefix(branch, "refs/heads/"), "origin/")
+		}
+	}
+
+	return ""
+}
+
+// ciTag returns the git tag being built from the CI environment
+func ciTag(getenv func(string) string) string {
+
+	if getenv("GITHUB_REF_TYPE") == "tag" {
+		return getenv("GITHUB_REF_NAME")
+	}
+
+	for _, name := range ciTagEnv {
+		if tag := getenv(name); tag != "" {
+			return tag
+		}
+	}
+
+	return ""
+}
+
+// liveBranches returns the branches of the repository at path, local and remote-tracking ones alike, by name
+// without the remote, `feature/new-php` for `origin/feature/new-php`
+func liveBranches(path string) (map[string]bool, error) {
+
+	repo, err := git.PlainOpen(path)
+	if err != nil {
+		return nil, err
+	}
+
+	refs, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+
+	branches := map[string]bool{}
+
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		switch {
+		case ref.Name().IsBranch():
+			branches[ref.Name().Short()] = true
+		case ref.Name().IsRemote():
+			name := strings.TrimPrefix(ref.Name().String(), "refs/remotes/")
+			if i := strings.Index(name, "/"); i >= 0 && name[i+1:] != "HEAD" {
+				branches[name[i+1:]] = true
+			}
+		}
+		return nil
+	})
+
+	return branches, err
+}
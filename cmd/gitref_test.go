@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/assert"
+)
+
+// testEnv returns a getenv func reading from a map, so the environment of whoever runs the tests stays out
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func Test_readGitRef(t *testing.T) {
+
+	dir := t.TempDir()
+
+	assert.Equal(t, gitRef{}, readGitRef(dir, testEnv(map[string]string{"GITHUB_HEAD_REF": "pr"})),
+		"outside of a git repository nothing should be worked out")
+
+	repo, _ := git.PlainInit(dir, false)
+
+	assert.Equal(t, gitRef{}, readGitRef(dir, testEnv(nil)), "a repository without commits should not be fatal")
+
+	ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\n"), 0644)
+	commitAll(t, repo, "first")
+
+	head, _ := repo.Head()
+	worktree, _ := repo.Worktree()
+	worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature/new-php"), Create: true})
+
+	ref := readGitRef(dir, testEnv(nil))
+	assert.Equal(t, "feature/new-php", ref.Branch)
+	assert.Equal(t, head.Hash().String()[:7], ref.SHA)
+	assert.Equal(t, "", ref.Release)
+
+	worktree.Checkout(&git.CheckoutOptions{Hash: head.Hash()})
+
+	ref = readGitRef(dir, testEnv(nil))
+	assert.Equal(t, "", ref.Branch, "a detached HEAD has no branch")
+
+	ref = readGitRef(dir, testEnv(map[string]string{"GIT_BRANCH": "origin/feature/new-php"}))
+	assert.Equal(t, "feature/new-php", ref.Branch)
+
+	ref = readGitRef(dir, testEnv(map[string]string{"GITHUB_REF_TYPE": "branch", "GITHUB_REF_NAME": "main"}))
+	assert.Equal(t, "main", ref.Branch)
+
+	ref = readGitRef(dir, testEnv(map[string]string{"GITHUB_REF_TYPE": "branch", "GITHUB_REF_NAME": "1/merge", "GITHUB_HEAD_REF": "fix"}))
+	assert.Equal(t, "fix", ref.Branch, "pull requests are tagged after their source branch")
+
+	ref = readGitRef(dir, testEnv(map[string]string{"CI_COMMIT_TAG": "v1.0.0", "CI_COMMIT_BRANCH": "main"}))
+	assert.Equal(t, "v1.0.0", ref.Release)
+	assert.Equal(t, "", ref.Branch)
+
+	repo.CreateTag("v1.1.0", head.Hash(), &git.CreateTagOptions{
+		Tagger:  &object.Signature{Name: "mach", Email: "mach@example.com", When: time.Now()},
+		Message: "release",
+	})
+
+	ref = readGitRef(dir, testEnv(map[string]string{"CI_COMMIT_TAG": "v1.0.0"}))
+	assert.Equal(t, "v1.1.0", ref.Release, "an annotated tag at HEAD should make it a release")
+}
+
+func Test_getBranchVariantOutsideRepository(t *testing.T) {
+
+	os.Setenv("GITHUB_HEAD_REF", "feature/new-php")
+	defer os.Unsetenv("GITHUB_HEAD_REF")
+
+	assert.Equal(t, "", getBranchVariant(), "the tests run outside of a repository, where CI variables are not used")
+}
+
+func Test_currentGitRefReadOnce(t *testing.T) {
+
+	dir := t.TempDir()
+
+	repo, _ := git.PlainInit(dir, false)
+	ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\n"), 0644)
+	commitAll(t, repo, "first")
+
+	worktree, _ := repo.Worktree()
+	worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("feature/new-php"), Create: true})
+
+	wd, _ := os.Getwd()
+	os.Chdir(dir)
+	defer os.Chdir(wd)
+
+	gitRefOnce = sync.Once{}
+	defer func() { gitRefOnce = sync.Once{} }()
+
+	assert.Equal(t, "feature/new-php", currentGitRef().Branch)
+
+	worktree.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("fix"), Create: true})
+
+	assert.Equal(t, "feature/new-php", currentGitRef().Branch, "the ref is read once per run")
+}
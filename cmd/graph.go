@@ -0,0 +1,278 @@
+// Cmd graph orders image builds so that images built from other images in this repo are built after their parents
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+)
+
+// buildNode is a single Dockerfile in the build graph, along with the tag it produces and the images it is built from
+type buildNode struct {
+	Filename string
+	Tag      string
+	// Tags is every tag the image gets, from the tag templates and its manifest, the Tag first
+	Tags    []string
+	From    []string
+	Parents []*buildNode
+	// Dockerfile is the rendered template
+	Dockerfile []byte
+	// Err is why the Dockerfile or its tags could not be rendered, the image fails its template stage
+	Err error
+
+	hashOnce sync.Once
+	hash     string
+	hashErr  error
+}
+
+// newBuildNode renders a Dockerfile and reads its tag and FROM lines, parents are linked up by planBuildOrder.
+// When only the Dockerfile fails to render, the node comes back along with the error, with its tags and the
+// error in Err, so the images built from it can still be linked up.
+func newBuildNode(filename string) (*buildNode, error) {
+
+	tags, err := imageTags(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := loadImageManifest(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &buildNode{
+		Filename: filename,
+		Tag:      tags[0],
+		Tags:     appendUnique(tags, manifest.extraTags()...),
+	}
+
+	var rendered bytes.Buffer
+	if err := generateDockerfileTemplate(&rendered, filename); err != nil {
+		node.Err = err
+		return node, err
+	}
+
+	node.From = parseFromLines(rendered.Bytes())
+	node.Dockerfile = rendered.Bytes()
+
+	return node, nil
+}
+
+// planBuildOrder renders every Dockerfile found in the build directory, reads the FROM lines and returns the
+// selected Dockerfiles ordered so that any image produced by this repo is built before the images that use it.
+// A FROM matches a parent by any of its tags. Parents that are not part of the selection are pulled into it,
+// so no image is built against a stale parent; those that are up to date are skipped by the content hash.
+// Dockerfiles that can't be rendered are planned with their Err set, only the graph itself can fail the plan.
+func planBuildOrder(selected []string) ([]*buildNode, error) {
+
+	all := append(findDockerfiles(nil), selected...)
+
+	wanted := map[string]bool{}
+	for _, filename := range selected {
+		wanted[filename] = true
+	}
+
+	nodes := map[string]*buildNode{}
+	byTag := map[string]*buildNode{}
+
+	var ordered []*buildNode
+
+	for _, filename := range all {
+		if _, ok := nodes[filename]; ok {
+			continue
+		}
+
+		node, err := newBuildNode(filename)
+		if err != nil {
+			// a broken template fails its own image and those built from it, not the whole build
+			if node == nil {
+				node = &buildNode{Filename: filename, Tag: filename, Err: err}
+			}
+			if !wanted[filename] {
+				color.Yellow("warning: %s can't be rendered: %s", filename, err)
+			}
+		}
+
+		for _, tag := range node.Tags {
+			if other, ok := byTag[normalizeImageRef(tag)]; ok {
+				return nil, fmt.Errorf("%s and %s both produce the tag %s", other.Filename, filename, tag)
+			}
+			byTag[normalizeImageRef(tag)] = node
+		}
+
+		nodes[filename] = node
+		ordered = append(ordered, node)
+	}
+
+	for _, node := range ordered {
+		for _, from := range node.From {
+			if parent, ok := byTag[normalizeImageRef(from)]; ok {
+				if !containsNode(node.Parents, parent) {
+					node.Parents = append(node.Parents, parent)
+				}
+			} else if isRepoImage(from) {
+				color.Yellow("warning: %s is built from %s, but no Dockerfile in %s produces that tag", node.Filename, from, BuildImageDirname)
+			}
+		}
+	}
+
+	var sorted []*buildNode
+
+	state := map[*buildNode]int{}
+
+	var visit func(node *buildNode, path []*buildNode) error
+	visit = func(node *buildNode, path []*buildNode) error {
+		switch state[node] {
+		case 1:
+			return fmt.Errorf("dependency cycle detected: %s", describeCycle(append(path, node)))
+		case 2:
+			return nil
+		}
+
+		state[node] = 1
+		for _, parent := range node.Parents {
+			if err := visit(parent, append(path, node)); err != nil {
+				return err
+			}
+		}
+		state[node] = 2
+		sorted = append(sorted, node)
+
+		return nil
+	}
+
+	for _, node := range ordered {
+		if err := visit(node, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	var pull func(node *buildNode)
+	pull = func(node *buildNode) {
+		for _, parent := range node.Parents {
+			if !wanted[parent.Filename] {
+				wanted[parent.Filename] = true
+				pull(parent)
+			}
+		}
+	}
+
+	for _, node := range ordered {
+		if wanted[node.Filename] {
+			pull(node)
+		}
+	}
+
+	var result []*buildNode
+	for _, node := range sorted {
+		if wanted[node.Filename] {
+			result = append(result, node)
+		}
+	}
+
+	return result, nil
+}
+
+func containsNode(nodes []*buildNode, node *buildNode) bool {
+
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+
+	return false
+}
+
+// describeCycle formats the tail of a dependency path, starting from the node that closes the loop
+func describeCycle(path []*buildNode) string {
+
+	last := path[len(path)-1]
+
+	var start int
+	for i, node := range path {
+		if node == last {
+			start = i
+			break
+		}
+	}
+
+	var names []string
+	for _, node := range path[start:] {
+		names = append(names, node.Tag+" ("+node.Filename+")")
+	}
+
+	return strings.Join(names, " -> ")
+}
+
+// parseFromLines returns the images referenced by the FROM instructions in a rendered Dockerfile. `scratch` and
+// references to earlier stages of a multi-stage build are left out, as they are not images to be built first.
+func parseFromLines(dockerfile []byte) []string {
+
+	var images []string
+	stages := map[string]bool{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "FROM") {
+			continue
+		}
+
+		args := fields[1:]
+		for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+			args = args[1:]
+		}
+
+		if len(args) == 0 {
+			continue
+		}
+
+		image := args[0]
+
+		if image != "scratch" && !stages[strings.ToLower(image)] {
+			images = append(images, image)
+		}
+
+		if len(args) >= 3 && strings.EqualFold(args[1], "AS") {
+			stages[strings.ToLower(args[2])] = true
+		}
+	}
+
+	return images
+}
+
+// normalizeImageRef makes image references comparable, dropping the implied docker hub hostname and adding the
+// implied `latest` tag, so `docker.io/superterran/mach` and `superterran/mach:latest` are the same image.
+func normalizeImageRef(ref string) string {
+
+	for _, prefix := range []string{"docker.io/", "index.docker.io/", "registry-1.docker.io/"} {
+		ref = strings.TrimPrefix(ref, prefix)
+	}
+
+	ref = strings.TrimPrefix(ref, "library/")
+
+	name := ref[strings.LastIndex(ref, "/")+1:]
+	if !strings.Contains(name, ":") && !strings.Contains(name, "@") {
+		ref = ref + ":latest"
+	}
+
+	return ref
+}
+
+// isRepoImage reports if an image reference points into the repository this tool pushes to
+func isRepoImage(ref string) bool {
+
+	if DockerRegistry == "" {
+		return false
+	}
+
+	repo := normalizeImageRef(DockerRegistry + ":latest")
+	repo = repo[:strings.LastIndex(repo, ":")]
+
+	return strings.HasPrefix(normalizeImageRef(ref), repo+":")
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTestImages creates an images directory with a Dockerfile per entry, keyed by image directory name
+func writeTestImages(t *testing.T, dockerfiles map[string]string) string {
+
+	dir, err := ioutil.TempDir("", "mach-images")
+	if err != nil {
+		assert.FailNowf(t, "could not create temp dir", "Error msg: %v", err)
+	}
+
+	for image, content := range dockerfiles {
+		os.MkdirAll(filepath.Join(dir, image), 0755)
+		ioutil.WriteFile(filepath.Join(dir, image, "Dockerfile"), []byte(content), 0644)
+	}
+
+	return dir
+}
+
+func Test_parseFromLines(t *testing.T) {
+
+	var actual = parseFromLines([]byte(`FROM --platform=linux/amd64 golang:1.18 AS build
+RUN go build .
+from build as test
+FROM scratch
+FROM superterran/mach:php
+COPY --from=build /app /app
+`))
+
+	assert.Equal(t, []string{"golang:1.18", "superterran/mach:php"}, actual,
+		"stages and scratch should not be reported as parent images",
+	)
+}
+
+func Test_normalizeImageRef(t *testing.T) {
+
+	assert.Equal(t, "superterran/mach:latest", normalizeImageRef("docker.io/superterran/mach"))
+	assert.Equal(t, "alpine:latest", normalizeImageRef("library/alpine"))
+	assert.Equal(t, "localhost:5000/mach:php", normalizeImageRef("localhost:5000/mach:php"))
+}
+
+func Test_planBuildOrder(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"a-child": "FROM superterran/mach:php\n",
+		"b-other": "FROM alpine:latest\n",
+		"php":     "FROM docker.io/superterran/mach:base\n",
+		"base":    "FROM alpine:latest\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	nodes, err := planBuildOrder(findDockerfiles(nil))
+	if err != nil {
+		assert.FailNowf(t, "planBuildOrder returned an error", "Error msg: %v", err)
+	}
+
+	var actual []string
+	for _, node := range nodes {
+		actual = append(actual, node.Tag)
+	}
+
+	assert.Equal(t, []string{
+		"superterran/mach:base",
+		"superterran/mach:php",
+		"superterran/mach:a-child",
+		"superterran/mach:b-other",
+	}, actual, "parents should be built before the images that use them")
+}
+
+func Test_planBuildOrderSelection(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"child": "FROM superterran/mach:php\n",
+		"php":   "FROM alpine:latest\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	nodes, err := planBuildOrder(findDockerfiles([]string{"child"}))
+	if err != nil {
+		assert.FailNowf(t, "planBuildOrder returned an error", "Error msg: %v", err)
+	}
+
+	if assert.Len(t, nodes, 2, "the parent should be pulled into the build") {
+		assert.Equal(t, "superterran/mach:php", nodes[0].Tag)
+		assert.Equal(t, nodes[0], nodes[1].Parents[0])
+	}
+}
+
+func Test_planBuildOrderExtraTags(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"a-child": "FROM superterran/mach:php-stable\n",
+		"php":     "FROM alpine:latest\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "php", ImageManifestFilename), []byte("tags: [php-stable]\n"), 0644)
+
+	nodes, err := planBuildOrder(findDockerfiles(nil))
+	if err != nil {
+		assert.FailNowf(t, "planBuildOrder returned an error", "Error msg: %v", err)
+	}
+
+	if assert.Len(t, nodes, 2) {
+		assert.Equal(t, "superterran/mach:php", nodes[0].Tag, "a parent should be matched by its extra tags")
+		assert.Equal(t, nodes[0], nodes[1].Parents[0])
+	}
+}
+
+func Test_planBuildOrderCycle(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"one": "FROM superterran/mach:two\n",
+		"two": "FROM superterran/mach:one\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	_, err := planBuildOrder(findDockerfiles(nil))
+
+	assert.Error(t, err, "a cycle should be reported")
+	assert.Contains(t, err.Error(), "dependency cycle detected")
+}
+
+func Test_planBuildOrderTemplateError(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"child": "FROM superterran/mach:php\n",
+		"other": "FROM alpine:latest\n",
+		"php":   "FROM alpine:latest\n{{ if }}\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	nodes, err := planBuildOrder(findDockerfiles(nil))
+	if err != nil {
+		assert.FailNowf(t, "a broken template should not fail the plan", "Error msg: %v", err)
+	}
+
+	if !assert.Len(t, nodes, 3) {
+		return
+	}
+	assert.Equal(t, "superterran/mach:php", nodes[0].Tag)
+	assert.Error(t, nodes[0].Err)
+	assert.Equal(t, nodes[0], nodes[1].Parents[0], "images built from a broken one are still linked to it")
+
+	KeepGoing = true
+	defer func() { KeepGoing = false }()
+
+	results := runBuildJobs(nodes, 1, ioutil.Discard, func(node *buildNode, out io.Writer) (*imageBuild, error) {
+		if node.Err != nil {
+			return buildAndPush(node, out)
+		}
+		return &imageBuild{Tag: node.Tag}, nil
+	})
+
+	var buildErr *buildError
+	if assert.True(t, errors.As(results[0].Err, &buildErr)) {
+		assert.Equal(t, stageTemplate, buildErr.Stage)
+	}
+	assert.Equal(t, "superterran/mach:php was not built", results[1].Skipped)
+	assert.NoError(t, results[2].Err, "the rest of the images are built")
+	assert.Empty(t, results[2].Skipped)
+}
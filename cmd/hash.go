@@ -0,0 +1,131 @@
+// Cmd hash fingerprints what goes into an image, so builds of unchanged images can be skipped
+package cmd
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+)
+
+// contentHashLabel is the image label holding the content hash an image was built from
+const contentHashLabel = "mach.content-hash"
+
+// Force builds and pushes images even when an image with the same content hash already exists, set with `--force`
+var Force bool = false
+
+// CheckRegistry also looks for the content hash in the registry before building, set with `--check-registry`
+var CheckRegistry bool = false
+
+// ContentHash returns a hash over everything that goes into the image: the rendered Dockerfile, the resolved
+// image manifest, the build context, and the hashes of any images from this repo it is built from, so a
+// change to a parent rebuilds its children. The hash is worked out once per node.
+func (n *buildNode) ContentHash() (string, error) {
+
+	n.hashOnce.Do(func() {
+		if n.Err != nil {
+			n.hashErr = n.Err
+			return
+		}
+		n.hash, n.hashErr = n.computeContentHash()
+	})
+
+	return n.hash, n.hashErr
+}
+
+func (n *buildNode) computeContentHash() (string, error) {
+
+	h := sha256.New()
+
+	fmt.Fprintf(h, "dockerfile %d\n", len(n.Dockerfile))
+	h.Write(n.Dockerfile)
+
+	manifest, err := loadImageManifest(n.Filename)
+	if err != nil {
+		return "", err
+	}
+
+	manifestJSON, _ := json.Marshal(manifest)
+	fmt.Fprintf(h, "manifest %s\n", manifestJSON)
+
+	for _, parent := range n.Parents {
+		parentHash, err := parent.ContentHash()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "parent %s %s\n", parent.Tag, parentHash)
+	}
+
+	// the context is hashed as the daemon would receive it, so files left out by .dockerignore don't count
+	src, err := contextTar(filepath.Dir(n.Filename))
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+
+	tr := tar.NewReader(src)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%c %s %o %s %d\n", header.Typeflag, header.Name, header.Mode, header.Linkname, header.Size)
+		if _, err := io.Copy(h, tr); err != nil {
+			return "", err
+		}
+	}
+
+	return "sha256:" + hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checkContentHash looks for an existing image with the same content hash, first in the local daemon, then
+// in the registry with CheckRegistry. The build is skipped when either has it, the push only when the registry
+// has it: an image built with --no-push, or whose push failed, is up to date locally and still needs pushing.
+func checkContentHash(cli client.APIClient, tag string, hash string) (skipBuild bool, skipPush bool) {
+
+	var local bool
+
+	inspect, _, err := cli.ImageInspectWithRaw(context.Background(), tag)
+	if err == nil && inspect.Config != nil {
+		local = inspect.Config.Labels[contentHashLabel] == hash
+	}
+
+	if !CheckRegistry {
+		return local, false
+	}
+
+	remote := registryHasContentHash(tag, hash)
+
+	return local || remote, remote
+}
+
+// registryHasContentHash reports if the tag in the registry carries the content hash label. Any problem
+// talking to the registry counts as not having it, which means the image just gets built.
+func registryHasContentHash(tag string, hash string) bool {
+
+	image, err := parseRegistryImage(tag)
+	if err != nil {
+		return false
+	}
+
+	auth, err := registryAuth(image.Host)
+	if err != nil {
+		return false
+	}
+
+	labels, err := newRegistryClient(image.Host, auth.Username, auth.Password).imageLabels(image.Repository, image.Tag)
+	if err != nil {
+		return false
+	}
+
+	return labels[contentHashLabel] == hash
+}
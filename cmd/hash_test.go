@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDockerClient stands in for the docker daemon, only the methods a test sets up are usable
+type fakeDockerClient struct {
+	client.APIClient
+	images map[string]types.ImageInspect
+}
+
+func (f *fakeDockerClient) ImageInspectWithRaw(ctx context.Context, image string) (types.ImageInspect, []byte, error) {
+
+	if inspect, ok := f.images[image]; ok {
+		return inspect, nil, nil
+	}
+
+	return types.ImageInspect{}, nil, errors.New("No such image: " + image)
+}
+
+func Test_ContentHash(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	dir := writeTestImages(t, map[string]string{"base": "FROM alpine\n", "php": "FROM superterran/mach:base\n"})
+	defer os.RemoveAll(dir)
+
+	hash := func() (string, string) {
+		base, _ := newBuildNode(filepath.Join(dir, "base", "Dockerfile"))
+		php, _ := newBuildNode(filepath.Join(dir, "php", "Dockerfile"))
+		php.Parents = []*buildNode{base}
+
+		baseHash, err := base.ContentHash()
+		assert.NoError(t, err)
+		phpHash, err := php.ContentHash()
+		assert.NoError(t, err)
+
+		return baseHash, phpHash
+	}
+
+	base1, php1 := hash()
+	base2, php2 := hash()
+
+	assert.True(t, strings.HasPrefix(base1, "sha256:"))
+	assert.Equal(t, base1, base2, "the hash should be deterministic")
+	assert.Equal(t, php1, php2)
+
+	ioutil.WriteFile(filepath.Join(dir, "base", ".dockerignore"), []byte("*.log\n"), 0644)
+	base3, _ := hash()
+	ioutil.WriteFile(filepath.Join(dir, "base", "build.log"), []byte("noise"), 0644)
+	base3b, _ := hash()
+	assert.Equal(t, base3, base3b, "files excluded by .dockerignore should not change the hash")
+
+	ioutil.WriteFile(filepath.Join(dir, "base", "motd"), []byte("hello"), 0644)
+	base4, php4 := hash()
+	assert.NotEqual(t, base3, base4, "a change to the build context should change the hash")
+	assert.NotEqual(t, php1, php4, "a change to a parent should change the hash of its children")
+}
+
+func Test_checkContentHash(t *testing.T) {
+
+	CheckRegistry = false
+
+	cli := &fakeDockerClient{images: map[string]types.ImageInspect{
+		"superterran/mach:php": {Config: &container.Config{Labels: map[string]string{contentHashLabel: "sha256:abc"}}},
+	}}
+
+	skipBuild, skipPush := checkContentHash(cli, "superterran/mach:php", "sha256:abc")
+	assert.True(t, skipBuild)
+	assert.False(t, skipPush, "only the registry can say the image was pushed")
+
+	skipBuild, skipPush = checkContentHash(cli, "superterran/mach:php", "sha256:def")
+	assert.False(t, skipBuild, "a different hash should be built")
+	assert.False(t, skipPush)
+
+	skipBuild, _ = checkContentHash(cli, "superterran/mach:other", "sha256:abc")
+	assert.False(t, skipBuild, "a missing image should be built")
+}
+
+func Test_checkContentHashAfterNoPush(t *testing.T) {
+
+	CheckRegistry = false
+
+	// the image was built by an earlier run with --no-push, or one whose push failed
+	cli := &fakeDockerClient{images: map[string]types.ImageInspect{
+		"superterran/mach:php": {Config: &container.Config{Labels: map[string]string{contentHashLabel: "sha256:abc"}}},
+	}}
+
+	skipBuild, skipPush := checkContentHash(cli, "superterran/mach:php", "sha256:abc")
+	assert.True(t, skipBuild, "the image doesn't need building again")
+	assert.False(t, skipPush, "the rerun should push what the first run didn't")
+}
+
+func Test_checkContentHashRegistry(t *testing.T) {
+
+	server := newTestRegistry(t, "mach", "php", map[string]string{contentHashLabel: "sha256:abc"})
+	defer server.Close()
+
+	CheckRegistry = true
+	defer func() { CheckRegistry = false }()
+
+	// keep the credentials of whoever runs the tests out of it
+	os.Setenv("DOCKER_CONFIG", t.TempDir())
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	tag := strings.TrimPrefix(server.URL, "http://") + "/mach:php"
+	cli := &fakeDockerClient{}
+
+	skipBuild, skipPush := checkContentHash(cli, tag, "sha256:abc")
+	assert.True(t, skipBuild, "an image in the registry with the same hash should not be built")
+	assert.True(t, skipPush)
+
+	cli.images = map[string]types.ImageInspect{
+		tag: {Config: &container.Config{Labels: map[string]string{contentHashLabel: "sha256:def"}}},
+	}
+
+	skipBuild, skipPush = checkContentHash(cli, tag, "sha256:def")
+	assert.True(t, skipBuild, "the local image is up to date")
+	assert.False(t, skipPush, "the registry is behind, so the image should be pushed")
+}
+
+func Test_testsDueLocalOnly(t *testing.T) {
+
+	server := newTestRegistry(t, "mach", "php", map[string]string{contentHashLabel: "sha256:abc"})
+	defer server.Close()
+
+	CheckRegistry = true
+	defer func() { CheckRegistry = false }()
+
+	os.Setenv("DOCKER_CONFIG", t.TempDir())
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	tag := strings.TrimPrefix(server.URL, "http://") + "/mach:php"
+
+	// built with --no-push and without --test, so the registry has an older image
+	cli := &fakeDockerClient{images: map[string]types.ImageInspect{
+		tag: {Config: &container.Config{Labels: map[string]string{contentHashLabel: "sha256:def"}}},
+	}}
+
+	build := &imageBuild{Tag: tag, Hash: "sha256:def"}
+	build.Skipped, build.SkipPush = checkContentHash(cli, tag, build.Hash)
+
+	assert.True(t, build.Skipped)
+	assert.True(t, build.testsDue(), "an image that is about to be pushed should be tested, even when it wasn't built")
+
+	build = &imageBuild{Tag: tag, Hash: "sha256:abc"}
+	build.Skipped, build.SkipPush = checkContentHash(cli, tag, build.Hash)
+
+	assert.False(t, build.testsDue(), "the registry has the image as it is, it was tested before it was pushed")
+}
@@ -0,0 +1,129 @@
+// Cmd images finds the Dockerfiles in the build directory tree and names the images they produce
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ImageNameSeparator joins the directories of a nested image into its name, `php/8.1` is named `php-8.1`.
+// Set with `image_name_separator` in config.
+var ImageNameSeparator string = "-"
+
+// walkDockerfiles returns every Dockerfile, with the variant given, below root at any depth. Hidden directories
+// are not looked in, and a Dockerfile right in the build directory is not an image.
+func walkDockerfiles(root string, variant string) []string {
+
+	var matches []string
+
+	buildDir := filepath.Clean(BuildImageDirname)
+
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if info.IsDir() {
+			if path != root && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		if filepath.Dir(path) == buildDir {
+			return nil
+		}
+
+		if ok, _ := filepath.Match("Dockerfile"+variant+"*", info.Name()); ok {
+			matches = append(matches, path)
+		}
+
+		return nil
+	})
+
+	return matches
+}
+
+// nestedImageDirs returns the directories below the directory of an image that hold images of their own,
+// relative to it. They belong to those images, so they are left out of its build context, hash and changes.
+func nestedImageDirs(dir string) []string {
+
+	var dirs []string
+
+	for _, filename := range walkDockerfiles(dir, "") {
+		if rel, err := filepath.Rel(dir, filepath.Dir(filename)); err == nil && rel != "." {
+			dirs = appendUnique(dirs, rel)
+		}
+	}
+
+	return dirs
+}
+
+// imagePath returns the directory of an image relative to the build directory, `php/8.1`, or just the name
+// of its directory when the Dockerfile isn't in the build directory tree.
+func imagePath(filename string) string {
+
+	dir := filepath.Dir(filename)
+
+	if rel, ok := relToBuildDir(dir); ok && rel != "." {
+		return filepath.ToSlash(rel)
+	}
+
+	return filepath.Base(dir)
+}
+
+// imageName returns the name of an image, the directories of its imagePath joined by ImageNameSeparator
+func imageName(filename string) string {
+
+	return strings.Join(strings.Split(imagePath(filename), "/"), ImageNameSeparator)
+}
+
+// relToBuildDir returns a path relative to the build directory, if it is inside it
+func relToBuildDir(path string) (string, bool) {
+
+	root, err := filepath.Abs(BuildImageDirname)
+	if err != nil {
+		return "", false
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+
+	return rel, true
+}
+
+// apiVersionFile returns the API_VERSION file an image gets its version from: the nearest one in its directory
+// or a directory above it, up to the build directory. Outside the build directory tree only the image's own
+// directory and its parent are looked in. It is empty when there is none.
+func apiVersionFile(filename string) string {
+
+	dir := filepath.Dir(filename)
+
+	dirs := []string{dir, filepath.Dir(dir)}
+
+	if rel, ok := relToBuildDir(dir); ok {
+		dirs = []string{dir}
+		for rel != "." {
+			dir = filepath.Dir(dir)
+			rel = filepath.Dir(rel)
+			dirs = append(dirs, dir)
+		}
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "API_VERSION")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return ""
+}
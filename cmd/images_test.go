@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_findDockerfilesNested(t *testing.T) {
+
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"base":        "FROM alpine\n",
+		"php/8.1":     "FROM alpine\n",
+		"php/8.2":     "FROM alpine\n",
+		"php/8.2/fpm": "FROM alpine\n",
+		".git/hooks":  "FROM alpine\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "Dockerfile"), []byte("FROM alpine\n"), 0644)
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "php", "8.1", "Dockerfile-cli"), []byte("FROM alpine\n"), 0644)
+
+	rel := func(files []string) []string {
+		var paths []string
+		for _, file := range files {
+			path, _ := filepath.Rel(BuildImageDirname, file)
+			paths = append(paths, filepath.ToSlash(path))
+		}
+		sort.Strings(paths)
+		return paths
+	}
+
+	assert.Equal(t, []string{
+		"base/Dockerfile",
+		"php/8.1/Dockerfile",
+		"php/8.1/Dockerfile-cli",
+		"php/8.2/Dockerfile",
+		"php/8.2/fpm/Dockerfile",
+	}, rel(findDockerfiles(nil)), "every image in the tree should be found, but not hidden ones or the build directory itself")
+
+	assert.Equal(t, []string{"php/8.1/Dockerfile", "php/8.1/Dockerfile-cli", "php/8.2/Dockerfile", "php/8.2/fpm/Dockerfile"},
+		rel(findDockerfiles([]string{"php/..."})))
+
+	assert.Equal(t, []string{"php/8.1/Dockerfile-cli"}, rel(findDockerfiles([]string{"php/...:cli"})))
+	assert.Equal(t, []string{"php/8.2/Dockerfile"}, rel(findDockerfiles([]string{"php/8.2"})))
+	assert.Len(t, findDockerfiles([]string{"..."}), 5)
+}
+
+func Test_imageNameNested(t *testing.T) {
+
+	BuildImageDirname = writeTestImages(t, map[string]string{"php/8.1": "FROM alpine\n", "php/8.1/fpm": "FROM alpine\n", "node": "FROM alpine\n"})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "php", "API_VERSION"), []byte("v2\n"), 0644)
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "API_VERSION"), []byte("v1"), 0644)
+
+	fpm := filepath.Join(BuildImageDirname, "php", "8.1", "fpm", "Dockerfile")
+
+	assert.Equal(t, "php/8.1/fpm", imagePath(fpm))
+	assert.Equal(t, "php-8.1-fpm", imageName(fpm))
+	assert.Equal(t, "node", imageName(filepath.Join(BuildImageDirname, "node", "Dockerfile")))
+	assert.Equal(t, "example", imageName("../examples/images/example/Dockerfile"), "images outside the build directory are named after their directory")
+
+	ImageNameSeparator = "_"
+	defer func() { ImageNameSeparator = "-" }()
+	assert.Equal(t, "php_8.1_fpm", imageName(fpm))
+	ImageNameSeparator = "-"
+
+	assert.Equal(t, "v2-", getApiVersion(fpm), "the nearest API_VERSION up the tree should be used")
+	assert.Equal(t, "v1-", getApiVersion(filepath.Join(BuildImageDirname, "node", "Dockerfile")))
+
+	DockerRegistry = "superterran/mach"
+	assert.Equal(t, "superterran/mach:v2-php-8.1-fpm", getTag(fpm))
+}
+
+func Test_nestedImageDirs(t *testing.T) {
+
+	BuildImageDirname = writeTestImages(t, map[string]string{"php/8.1": "FROM alpine\n", "php/8.1/fpm": "FROM alpine\n"})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	dir := filepath.Join(BuildImageDirname, "php", "8.1")
+	os.MkdirAll(filepath.Join(dir, "conf"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "conf", "php.ini"), []byte("memory_limit=1G\n"), 0644)
+
+	assert.Equal(t, []string{"fpm"}, nestedImageDirs(dir))
+
+	src, err := contextTar(dir)
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+	defer src.Close()
+
+	var names []string
+	tr := tar.NewReader(src)
+	for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+		names = append(names, header.Name)
+	}
+	assert.Equal(t, []string{"Dockerfile", "conf/", "conf/php.ini"}, names, "the fpm image should not be in the context")
+
+	node, _ := newBuildNode(filepath.Join(dir, "Dockerfile"))
+	before, _ := node.ContentHash()
+
+	fpm := filepath.Join(dir, "fpm", "motd")
+	ioutil.WriteFile(fpm, []byte("hello"), 0644)
+
+	node, _ = newBuildNode(filepath.Join(dir, "Dockerfile"))
+	after, _ := node.ContentHash()
+	assert.Equal(t, before, after, "a change to the fpm image should not change the hash of its parent directory")
+
+	abs, _ := filepath.Abs(fpm)
+	assert.False(t, imageChanged(filepath.Join(dir, "Dockerfile"), map[string]bool{abs: true}))
+	assert.True(t, imageChanged(filepath.Join(dir, "fpm", "Dockerfile"), map[string]bool{abs: true}))
+}
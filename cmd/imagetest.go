@@ -0,0 +1,530 @@
+// Cmd imagetest runs acceptance tests against built images, from the mach.test.yaml next to a Dockerfile
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var testCmd = CreateTestCmd()
+
+// ImageTestFilename is the name of the per-image test spec, looked up in the directory of each Dockerfile
+var ImageTestFilename string = "mach.test.yaml"
+
+// RunImageTests tests every image after it is built and before it is pushed, set with `--test`
+var RunImageTests bool = false
+
+// execExitWait is how long a command run in a test container gets to exit once its output has ended
+var execExitWait = 5 * time.Second
+
+// testKeepAlive keeps the test container running for commands to be run in, when the spec has no entrypoint
+var testKeepAlive = []string{"tail", "-f", "/dev/null"}
+
+// defaultTestVariant is the key under `variants` for the checks of the Dockerfile without a variant
+const defaultTestVariant = "default"
+
+// imageTestSpec declares what a built image should look like. Anything under `variants` only applies to the
+// matching `Dockerfile-<variant>`, or the plain `Dockerfile` under `default`, its checks are added to the top
+// level ones.
+type imageTestSpec struct {
+	Commands []commandTest `yaml:"commands"`
+	Files    []fileTest    `yaml:"files"`
+	// Env maps variables the image must set to a regular expression the value must match, empty for any value
+	Env   map[string]string `yaml:"env"`
+	Ports []string          `yaml:"ports"`
+	User  string            `yaml:"user"`
+	// Entrypoint keeps the test container running, for images without `tail`
+	Entrypoint []string                 `yaml:"entrypoint"`
+	Variants   map[string]imageTestSpec `yaml:"variants"`
+}
+
+// commandTest is a command run in the container, `run` through `sh -c` or `exec` as it is, with what it
+// should produce. Stdout and Stderr are regular expressions.
+type commandTest struct {
+	Name     string   `yaml:"name"`
+	Run      string   `yaml:"run"`
+	Exec     []string `yaml:"exec"`
+	User     string   `yaml:"user"`
+	ExitCode int      `yaml:"exit_code"`
+	Stdout   string   `yaml:"stdout"`
+	Stderr   string   `yaml:"stderr"`
+}
+
+// fileTest is a path that must exist in the image, with the permissions in Mode, like `0755`, when it is set
+type fileTest struct {
+	Path string `yaml:"path"`
+	Mode string `yaml:"mode"`
+}
+
+// testFailure is an image that failed some of its checks
+type testFailure struct {
+	Failed []string
+	Total  int
+}
+
+func (e *testFailure) Error() string {
+	return fmt.Sprintf("%d of %d checks failed: %s", len(e.Failed), e.Total, strings.Join(e.Failed, ", "))
+}
+
+func CreateTestCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "test [docker-image[:tag]]",
+		Short: "Runs the acceptance tests of built images",
+		Long: `Runs the checks in the mach.test.yaml next to each Dockerfile against the image last built from it,
+	commands with their exit code and output, files and their modes, environment variables, exposed ports and
+	the user. Images without a mach.test.yaml are left alone.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runTest(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(testCmd)
+
+	testCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+}
+
+func runTest(cmd *cobra.Command, args []string) error {
+
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	BuildVariantFromParam = viper.GetString("variant")
+
+	return MainTestFlow(nil, args)
+}
+
+// MainTestFlow tests the images of the Dockerfiles matching the arguments, or every Dockerfile in the build
+// directory, carrying on past failures. Output goes to out, or the terminal when it is nil.
+func MainTestFlow(out io.Writer, args []string) error {
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	var failures buildFailures
+
+	for _, filename := range findDockerfiles(args) {
+		spec, err := loadImageTestSpec(filename)
+		if err != nil {
+			return err
+		}
+
+		if spec == nil {
+			continue
+		}
+
+		tag := getTag(filename)
+		printStatus(out, color.New(color.FgHiYellow), "Testing "+tag)
+
+		if err := runImageTests(context.Background(), cli, tag, spec, out); err != nil {
+			printStatus(out, color.New(color.FgRed), fmt.Sprintf("%s: %v", tag, err))
+			failures = append(failures, newBuildError(stageTest, tag, err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+
+	return nil
+}
+
+// testImage runs the tests of a freshly built image, images without a test spec pass
+func testImage(filename string, tag string, out io.Writer) error {
+
+	spec, err := loadImageTestSpec(filename)
+	if err != nil || spec == nil {
+		return err
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	return runImageTests(context.Background(), cli, tag, spec, out)
+}
+
+// loadImageTestSpec reads the test spec for a Dockerfile and adds the checks for its variant. There being no
+// spec is not an error, the spec is nil.
+func loadImageTestSpec(filename string) (*imageTestSpec, error) {
+
+	path := filepath.Join(filepath.Dir(filename), ImageTestFilename)
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var spec imageTestSpec
+	if err := yaml.Unmarshal(content, &spec); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+
+	variant := fileVariant(filename)
+	if variant == "" {
+		variant = defaultTestVariant
+	}
+
+	if override, ok := spec.Variants[variant]; ok {
+		spec = spec.merge(override)
+	}
+
+	spec.Variants = nil
+
+	for _, command := range spec.Commands {
+		if command.Run == "" && len(command.Exec) == 0 {
+			return nil, fmt.Errorf("%s: command %q needs `run` or `exec`", path, command.Name)
+		}
+	}
+
+	for _, file := range spec.Files {
+		if _, err := parseFileMode(file.Mode); err != nil {
+			return nil, fmt.Errorf("%s: %s: %v", path, file.Path, err)
+		}
+	}
+
+	return &spec, nil
+}
+
+// merge returns a copy of the spec with the checks of the override added
+func (s imageTestSpec) merge(override imageTestSpec) imageTestSpec {
+
+	merged := s
+	merged.Commands = append(append([]commandTest{}, s.Commands...), override.Commands...)
+	merged.Files = append(append([]fileTest{}, s.Files...), override.Files...)
+	merged.Ports = append(append([]string{}, s.Ports...), override.Ports...)
+	merged.Env = mergeStringMaps(s.Env, override.Env)
+
+	if override.User != "" {
+		merged.User = override.User
+	}
+
+	if override.Entrypoint != nil {
+		merged.Entrypoint = override.Entrypoint
+	}
+
+	return merged
+}
+
+// runImageTests runs every check of a spec against an image, reporting each as it goes. The image config is
+// checked by inspecting it, files and commands in a container that is removed afterwards.
+func runImageTests(ctx context.Context, cli client.APIClient, tag string, spec *imageTestSpec, out io.Writer) error {
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, tag)
+	if err != nil {
+		return err
+	}
+
+	config := inspect.Config
+	if config == nil {
+		config = &container.Config{}
+	}
+
+	failure := &testFailure{}
+
+	check := func(name string, err error) {
+		failure.Total++
+		if err != nil {
+			failure.Failed = append(failure.Failed, name)
+			printStatus(out, color.New(color.FgRed), fmt.Sprintf("FAIL  %s: %v", name, err))
+			return
+		}
+		printStatus(out, color.New(color.FgGreen), "PASS  "+name)
+	}
+
+	if spec.User != "" {
+		check("user", checkUser(config.User, spec.User))
+	}
+
+	var keys []string
+	for key := range spec.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		check("env "+key, checkEnv(config.Env, key, spec.Env[key]))
+	}
+
+	for _, port := range spec.Ports {
+		check("port "+port, checkPort(config, port))
+	}
+
+	if len(spec.Files) > 0 || len(spec.Commands) > 0 {
+		if err := runContainerTests(ctx, cli, tag, spec, check); err != nil {
+			return err
+		}
+	}
+
+	if len(failure.Failed) > 0 {
+		return failure
+	}
+
+	return nil
+}
+
+// runContainerTests checks the files and runs the commands of a spec in a container of the image
+func runContainerTests(ctx context.Context, cli client.APIClient, tag string, spec *imageTestSpec, check func(string, error)) error {
+
+	entrypoint := spec.Entrypoint
+	if len(entrypoint) == 0 {
+		entrypoint = testKeepAlive
+	}
+
+	return withContainer(ctx, cli, tag, entrypoint, len(spec.Commands) > 0, func(id string) error {
+		for _, file := range spec.Files {
+			check("file "+file.Path, checkFile(ctx, cli, id, file))
+		}
+
+		for _, command := range spec.Commands {
+			check("command "+command.name(), runCommandTest(ctx, cli, id, command))
+		}
+
+		return nil
+	})
+}
+
+// withContainer creates a container of the image with the entrypoint given, starting it when asked, and
+// removes it once fn is done with it
+func withContainer(ctx context.Context, cli client.APIClient, image string, entrypoint []string, start bool, fn func(id string) error) error {
+
+	created, err := cli.ContainerCreate(ctx, &container.Config{Image: image, Entrypoint: entrypoint, Cmd: []string{}}, nil, nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer cli.ContainerRemove(context.Background(), created.ID, types.ContainerRemoveOptions{Force: true})
+
+	if start {
+		if err := cli.ContainerStart(ctx, created.ID, types.ContainerStartOptions{}); err != nil {
+			return err
+		}
+	}
+
+	return fn(created.ID)
+}
+
+func checkUser(actual string, expected string) error {
+
+	if actual == "" {
+		actual = "root"
+	}
+
+	if actual != expected && !(expected == "root" && actual == "0") {
+		return fmt.Errorf("runs as %s, not %s", actual, expected)
+	}
+
+	return nil
+}
+
+func checkEnv(env []string, key string, pattern string) error {
+
+	for _, variable := range env {
+		parts := strings.SplitN(variable, "=", 2)
+		if parts[0] != key {
+			continue
+		}
+
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+
+		return matchOutput("value", value, pattern)
+	}
+
+	return errors.New("not set")
+}
+
+func checkPort(config *container.Config, port string) error {
+
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+
+	for exposed := range config.ExposedPorts {
+		if string(exposed) == port {
+			return nil
+		}
+	}
+
+	return errors.New("not exposed")
+}
+
+func checkFile(ctx context.Context, cli client.APIClient, id string, file fileTest) error {
+
+	stat, err := cli.ContainerStatPath(ctx, id, file.Path)
+	if err != nil {
+		return errors.New("does not exist")
+	}
+
+	if file.Mode == "" {
+		return nil
+	}
+
+	mode, _ := parseFileMode(file.Mode)
+	if stat.Mode.Perm() != mode {
+		return fmt.Errorf("mode is %#o, not %#o", stat.Mode.Perm(), mode)
+	}
+
+	return nil
+}
+
+// parseFileMode reads permissions written in octal, like `0755`, empty is no mode
+func parseFileMode(mode string) (os.FileMode, error) {
+
+	if mode == "" {
+		return 0, nil
+	}
+
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 0777 {
+		return 0, fmt.Errorf("mode must be permissions in octal, like 0755, not %s", mode)
+	}
+
+	return os.FileMode(perm), nil
+}
+
+func (c commandTest) name() string {
+
+	if c.Name != "" {
+		return c.Name
+	}
+
+	if c.Run != "" {
+		return c.Run
+	}
+
+	return strings.Join(c.Exec, " ")
+}
+
+// runCommandTest runs a command in the container and checks its exit code and output
+func runCommandTest(ctx context.Context, cli client.APIClient, id string, command commandTest) error {
+
+	cmd := command.Exec
+	if len(cmd) == 0 {
+		cmd = []string{"sh", "-c", command.Run}
+	}
+
+	result, err := execInContainer(ctx, cli, id, cmd, command.User)
+	if err != nil {
+		return err
+	}
+
+	if result.ExitCode != command.ExitCode {
+		return fmt.Errorf("exited with %d, not %d: %s", result.ExitCode, command.ExitCode, strings.TrimSpace(result.Stderr))
+	}
+
+	if err := matchOutput("stdout", result.Stdout, command.Stdout); err != nil {
+		return err
+	}
+
+	return matchOutput("stderr", result.Stderr, command.Stderr)
+}
+
+// execResult is what a command run in a container produced
+type execResult struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// execInContainer runs a command in a running container as the user given, or the image's user when empty
+func execInContainer(ctx context.Context, cli client.APIClient, id string, cmd []string, user string) (execResult, error) {
+
+	var result execResult
+
+	exec, err := cli.ContainerExecCreate(ctx, id, types.ExecConfig{Cmd: cmd, User: user, AttachStdout: true, AttachStderr: true})
+	if err != nil {
+		return result, err
+	}
+
+	attached, err := cli.ContainerExecAttach(ctx, exec.ID, types.ExecStartCheck{})
+	if err != nil {
+		return result, err
+	}
+	defer attached.Close()
+
+	var stdout, stderr bytes.Buffer
+	if _, err := stdcopy.StdCopy(&stdout, &stderr, attached.Reader); err != nil {
+		return result, err
+	}
+
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+
+	// the output ends just before the daemon records the exit code
+	var inspect types.ContainerExecInspect
+	deadline := time.Now().Add(execExitWait)
+	for {
+		inspect, err = cli.ContainerExecInspect(ctx, exec.ID)
+		if err != nil || !inspect.Running || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	// an exit code read while the command runs is a zero that means nothing
+	if inspect.Running {
+		return result, fmt.Errorf("%s is still running %s after closing its output", strings.Join(cmd, " "), execExitWait)
+	}
+
+	result.ExitCode = inspect.ExitCode
+
+	return result, nil
+}
+
+// matchOutput checks output against a regular expression, an empty pattern matches anything
+func matchOutput(what string, output string, pattern string) error {
+
+	if pattern == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid %s pattern: %v", what, err)
+	}
+
+	if !re.MatchString(output) {
+		return fmt.Errorf("%s %q does not match %s", what, strings.TrimSpace(output), pattern)
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeExec is what a command run in a fakeContainerClient produces
+type fakeExec struct {
+	stdout   string
+	stderr   string
+	exitCode int
+	// hangs keeps the command running after its output has ended
+	hangs bool
+}
+
+// fakeContainerClient stands in for the docker daemon running test containers, commands are looked up by
+// their arguments joined with spaces
+type fakeContainerClient struct {
+	fakeDockerClient
+	files   map[string]types.ContainerPathStat
+	execs   map[string]fakeExec
+	running string
+	started bool
+	removed bool
+}
+
+func (f *fakeContainerClient) ContainerCreate(ctx context.Context, config *container.Config, hostConfig *container.HostConfig, networkingConfig *network.NetworkingConfig, platform *specs.Platform, name string) (container.ContainerCreateCreatedBody, error) {
+	return container.ContainerCreateCreatedBody{ID: "test"}, nil
+}
+
+func (f *fakeContainerClient) ContainerStart(ctx context.Context, id string, options types.ContainerStartOptions) error {
+	f.started = true
+	return nil
+}
+
+func (f *fakeContainerClient) ContainerRemove(ctx context.Context, id string, options types.ContainerRemoveOptions) error {
+	f.removed = true
+	return nil
+}
+
+func (f *fakeContainerClient) ContainerStatPath(ctx context.Context, id string, path string) (types.ContainerPathStat, error) {
+
+	if stat, ok := f.files[path]; ok {
+		return stat, nil
+	}
+
+	return types.ContainerPathStat{}, errors.New("no such file")
+}
+
+func (f *fakeContainerClient) ContainerExecCreate(ctx context.Context, id string, config types.ExecConfig) (types.IDResponse, error) {
+	f.running = strings.Join(config.Cmd, " ")
+	return types.IDResponse{ID: f.running}, nil
+}
+
+func (f *fakeContainerClient) ContainerExecAttach(ctx context.Context, execID string, config types.ExecStartCheck) (types.HijackedResponse, error) {
+
+	var buff bytes.Buffer
+	stdcopy.NewStdWriter(&buff, stdcopy.Stdout).Write([]byte(f.execs[execID].stdout))
+	stdcopy.NewStdWriter(&buff, stdcopy.Stderr).Write([]byte(f.execs[execID].stderr))
+
+	conn, _ := net.Pipe()
+
+	return types.HijackedResponse{Conn: conn, Reader: bufio.NewReader(&buff)}, nil
+}
+
+func (f *fakeContainerClient) ContainerExecInspect(ctx context.Context, execID string) (types.ContainerExecInspect, error) {
+	return types.ContainerExecInspect{ExitCode: f.execs[execID].exitCode, Running: f.execs[execID].hangs}, nil
+}
+
+func Test_loadImageTestSpec(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	spec, err := loadImageTestSpec(filepath.Join(dir, "php", "Dockerfile"))
+	assert.NoError(t, err)
+	assert.Nil(t, spec, "an image without a spec has nothing to test")
+
+	ioutil.WriteFile(filepath.Join(dir, "php", ImageTestFilename), []byte(`
+user: www-data
+ports: ["80"]
+env:
+  PHP_VERSION: "^8\\."
+commands:
+  - run: php -v
+    stdout: PHP 8
+files:
+  - path: /usr/local/bin/php
+    mode: "0755"
+variants:
+  fpm:
+    user: root
+    ports: ["9000"]
+    commands:
+      - exec: [php-fpm, -t]
+  default:
+    commands:
+      - run: php -i
+`), 0644)
+
+	spec, err = loadImageTestSpec(filepath.Join(dir, "php", "Dockerfile-fpm"))
+	assert.NoError(t, err)
+	assert.Equal(t, "root", spec.User)
+	assert.Equal(t, []string{"80", "9000"}, spec.Ports)
+	assert.Len(t, spec.Commands, 2)
+	assert.Nil(t, spec.Variants)
+
+	spec, err = loadImageTestSpec(filepath.Join(dir, "php", "Dockerfile"))
+	assert.NoError(t, err)
+	assert.Equal(t, "www-data", spec.User)
+	assert.Len(t, spec.Commands, 2, "the plain Dockerfile gets the default checks")
+
+	ioutil.WriteFile(filepath.Join(dir, "php", ImageTestFilename), []byte("files:\n  - path: /bin/sh\n    mode: rwx\n"), 0644)
+
+	_, err = loadImageTestSpec(filepath.Join(dir, "php", "Dockerfile"))
+	assert.Error(t, err)
+}
+
+func Test_runImageTests(t *testing.T) {
+
+	var config container.Config
+	json.Unmarshal([]byte(`{"User": "www-data", "Env": ["PHP_VERSION=8.1.2", "PATH=/usr/bin"], "ExposedPorts": {"80/tcp": {}}}`), &config)
+
+	cli := &fakeContainerClient{
+		fakeDockerClient: fakeDockerClient{images: map[string]types.ImageInspect{
+			"superterran/mach:php": {Config: &config},
+		}},
+		files: map[string]types.ContainerPathStat{
+			"/usr/local/bin/php": {Name: "php", Mode: 0755},
+		},
+		execs: map[string]fakeExec{
+			"sh -c php -v":  {stdout: "PHP 8.1.2 (cli)\n"},
+			"php-fpm -t":    {stderr: "configuration file test failed\n", exitCode: 78},
+			"sh -c php -m":  {stdout: "Core\nzip\n"},
+			"sh -c missing": {stderr: "not found\n", exitCode: 127},
+			"sh -c daemon":  {stdout: "started\n", hangs: true},
+		},
+	}
+
+	spec := &imageTestSpec{
+		User:  "www-data",
+		Env:   map[string]string{"PHP_VERSION": `^8\.1`, "PATH": ""},
+		Ports: []string{"80"},
+		Files: []fileTest{{Path: "/usr/local/bin/php", Mode: "0755"}},
+		Commands: []commandTest{
+			{Run: "php -v", Stdout: `PHP 8\.1`},
+			{Name: "missing command", Run: "missing", ExitCode: 127, Stderr: "not found"},
+		},
+	}
+
+	var out bytes.Buffer
+	assert.NoError(t, runImageTests(context.Background(), cli, "superterran/mach:php", spec, &out))
+	assert.True(t, cli.started)
+	assert.True(t, cli.removed, "the test container should be removed")
+	assert.Contains(t, out.String(), "PASS  command missing command")
+
+	spec = &imageTestSpec{
+		User:  "root",
+		Env:   map[string]string{"APP_ENV": ""},
+		Ports: []string{"9000/tcp"},
+		Files: []fileTest{{Path: "/usr/local/bin/php", Mode: "0700"}, {Path: "/etc/php.ini"}},
+		Commands: []commandTest{
+			{Exec: []string{"php-fpm", "-t"}},
+			{Run: "php -m", Stdout: "intl"},
+			{Run: "daemon"},
+		},
+	}
+
+	execExitWait = 0
+	defer func() { execExitWait = 5 * time.Second }()
+
+	out.Reset()
+	err := runImageTests(context.Background(), cli, "superterran/mach:php", spec, &out)
+
+	var failure *testFailure
+	assert.True(t, errors.As(err, &failure))
+	assert.Equal(t, 8, failure.Total)
+	assert.Equal(t, []string{"user", "env APP_ENV", "port 9000/tcp", "file /usr/local/bin/php", "file /etc/php.ini", "command php-fpm -t", "command php -m", "command daemon"}, failure.Failed,
+		"a command still running has no exit code to pass with")
+	assert.Contains(t, out.String(), "mode is 0755, not 0700")
+	assert.Contains(t, out.String(), "exited with 78, not 0")
+
+	cli = &fakeContainerClient{}
+	assert.Error(t, runImageTests(context.Background(), cli, "superterran/mach:missing", spec, &out))
+}
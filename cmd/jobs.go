@@ -0,0 +1,259 @@
+// Cmd jobs runs image builds concurrently, respecting the build order worked out by the build graph
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// buildJobFunc builds (and pushes) a single image, writing everything it has to say to out
+type buildJobFunc func(node *buildNode, out io.Writer) (*imageBuild, error)
+
+// jobOutput is an io.Writer that prefixes every line with the image it belongs to. Lines are only written
+// once they are complete, and writers sharing a mutex never interleave within a line.
+type jobOutput struct {
+	prefix string
+	w      io.Writer
+	mu     *sync.Mutex
+	buf    []byte
+}
+
+func newJobOutput(w io.Writer, mu *sync.Mutex, name string) *jobOutput {
+	return &jobOutput{prefix: "[" + name + "] ", w: w, mu: mu}
+}
+
+func (o *jobOutput) Write(p []byte) (int, error) {
+
+	o.buf = append(o.buf, p...)
+
+	for {
+		i := bytes.IndexByte(o.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		o.writeLine(o.buf[:i])
+		o.buf = o.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush writes out anything left over that was not terminated by a newline
+func (o *jobOutput) Flush() {
+	if len(o.buf) > 0 {
+		o.writeLine(o.buf)
+		o.buf = nil
+	}
+}
+
+func (o *jobOutput) writeLine(line []byte) {
+
+	// carriage returns and cursor movement from the daemon would fight with the other jobs
+	text := strings.TrimSpace(string(line[bytes.LastIndexByte(line, '\r')+1:]))
+	if text == "" {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	fmt.Fprintln(o.w, o.prefix+text)
+}
+
+// buildResult is how a single image fared in a build
+type buildResult struct {
+	Node  *buildNode
+	Build *imageBuild
+	// Err is a *buildError when the image failed
+	Err error
+	// Skipped says why the image was never attempted
+	Skipped string
+	// Duration is how long building and pushing the image took
+	Duration time.Duration
+}
+
+// runBuildJobs runs the build function over the planned images using up to `jobs` workers. An image is only
+// started once every image it is built from has finished, and is skipped if one of those failed. A failure
+// never stops the jobs that are already running, but unless KeepGoing is set no new images are started.
+// Output is prefixed per image and written to w, or goes straight to the terminal one image at a time when
+// w is nil. The results come back in the same order as the nodes.
+func runBuildJobs(nodes []*buildNode, jobs int, w io.Writer, build buildJobFunc) []*buildResult {
+
+	if jobs < 1 || w == nil {
+		jobs = 1
+	}
+
+	const (
+		pending = iota
+		running
+		finished
+	)
+
+	state := map[*buildNode]int{}
+	results := map[*buildNode]*buildResult{}
+	for _, node := range nodes {
+		state[node] = pending
+		results[node] = &buildResult{Node: node}
+	}
+
+	var mu sync.Mutex
+	done := make(chan *buildResult)
+	active := 0
+	remaining := len(nodes)
+	stopped := false
+
+	status := func(c *color.Color, node *buildNode, msg string) {
+		if w == nil {
+			c.Println(node.Tag + ": " + msg)
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		c.Fprintf(w, "[%s] %s\n", node.Tag, msg)
+	}
+
+	skip := func(node *buildNode, reason string) {
+		state[node] = finished
+		results[node].Skipped = reason
+		remaining--
+		status(color.New(color.FgYellow), node, "skipped, "+reason)
+	}
+
+	for remaining > 0 {
+
+		for _, node := range nodes {
+			if state[node] != pending {
+				continue
+			}
+
+			if stopped {
+				skip(node, "stopped after an earlier failure")
+				continue
+			}
+
+			if active >= jobs {
+				continue
+			}
+
+			ready := true
+			var failedParent *buildNode
+
+			for _, parent := range node.Parents {
+				if _, ok := state[parent]; !ok {
+					continue
+				}
+
+				if state[parent] != finished {
+					ready = false
+				} else if results[parent].Err != nil || results[parent].Skipped != "" {
+					failedParent = parent
+				}
+			}
+
+			if failedParent != nil {
+				skip(node, failedParent.Tag+" was not built")
+				continue
+			}
+
+			if !ready {
+				continue
+			}
+
+			state[node] = running
+			active++
+
+			go func(node *buildNode) {
+				result := &buildResult{Node: node}
+				started := time.Now()
+
+				if w == nil {
+					result.Build, result.Err = build(node, nil)
+				} else {
+					out := newJobOutput(w, &mu, node.Tag)
+					result.Build, result.Err = build(node, out)
+					out.Flush()
+				}
+
+				result.Duration = time.Since(started)
+				done <- result
+			}(node)
+		}
+
+		if active == 0 {
+			continue
+		}
+
+		result := <-done
+		active--
+		remaining--
+		state[result.Node] = finished
+		results[result.Node] = result
+
+		if result.Err != nil {
+			msg := result.Err.Error()
+			var failure *buildError
+			if errors.As(result.Err, &failure) {
+				msg = failure.Stage + " failed: " + failure.Err.Error()
+			}
+
+			status(color.New(color.FgRed), result.Node, msg)
+			stopped = !KeepGoing
+		} else if w != nil {
+			status(color.New(color.FgGreen), result.Node, "done")
+		}
+	}
+
+	var ordered []*buildResult
+	for _, node := range nodes {
+		ordered = append(ordered, results[node])
+	}
+
+	return ordered
+}
+
+// buildSummary prints how every image fared, and returns the failures as a single error, if there were any
+func buildSummary(w io.Writer, results []*buildResult) error {
+
+	var failures buildFailures
+	var built, upToDate, skipped int
+
+	fmt.Fprintln(w)
+
+	for _, result := range results {
+		switch {
+		case result.Err != nil:
+			var failure *buildError
+			if !errors.As(result.Err, &failure) {
+				failure = newBuildError(stageBuild, result.Node.Tag, result.Err)
+			}
+			failures = append(failures, failure)
+			color.New(color.FgRed).Fprintf(w, "FAIL  %s (%s)\n", result.Node.Tag, failure.Stage)
+		case result.Skipped != "":
+			skipped++
+			color.New(color.FgYellow).Fprintf(w, "SKIP  %s (%s)\n", result.Node.Tag, result.Skipped)
+		case result.Build != nil && result.Build.Skipped:
+			upToDate++
+			color.New(color.FgGreen).Fprintf(w, "OK    %s (up to date)\n", result.Node.Tag)
+		default:
+			built++
+			color.New(color.FgGreen).Fprintf(w, "OK    %s\n", result.Node.Tag)
+		}
+	}
+
+	fmt.Fprintf(w, "%d built, %d up to date, %d failed, %d skipped\n", built, upToDate, len(failures), skipped)
+
+	if len(failures) > 0 {
+		return failures
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_jobOutputPrefixesLines(t *testing.T) {
+
+	var buff bytes.Buffer
+	var mu sync.Mutex
+
+	out := newJobOutput(&buff, &mu, "superterran/mach:php")
+	fmt.Fprint(out, "Step 1/2 : FROM alpine\nStep 2/2")
+	fmt.Fprint(out, " : RUN true\n\npartial")
+	out.Flush()
+
+	assert.Equal(t, "[superterran/mach:php] Step 1/2 : FROM alpine\n"+
+		"[superterran/mach:php] Step 2/2 : RUN true\n"+
+		"[superterran/mach:php] partial\n", buff.String())
+}
+
+func Test_runBuildJobsOrder(t *testing.T) {
+
+	base := &buildNode{Tag: "base"}
+	php := &buildNode{Tag: "php", Parents: []*buildNode{base}}
+	other := &buildNode{Tag: "other"}
+	child := &buildNode{Tag: "child", Parents: []*buildNode{php}}
+
+	var mu sync.Mutex
+	var built []string
+
+	results := runBuildJobs([]*buildNode{base, other, php, child}, 3, io.Discard, func(node *buildNode, out io.Writer) (*imageBuild, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, parent := range node.Parents {
+			assert.Contains(t, built, parent.Tag, "parent should be built before "+node.Tag)
+		}
+		built = append(built, node.Tag)
+		return &imageBuild{Tag: node.Tag}, nil
+	})
+
+	assert.NoError(t, buildSummary(io.Discard, results))
+	assert.Len(t, built, 4)
+}
+
+func Test_runBuildJobsFailureKeepsOthers(t *testing.T) {
+
+	base := &buildNode{Tag: "base"}
+	php := &buildNode{Tag: "php", Parents: []*buildNode{base}}
+	other := &buildNode{Tag: "other"}
+
+	var mu sync.Mutex
+	var built []string
+	var buff bytes.Buffer
+
+	KeepGoing = true
+	defer func() { KeepGoing = false }()
+
+	results := runBuildJobs([]*buildNode{base, php, other}, 2, &buff, func(node *buildNode, out io.Writer) (*imageBuild, error) {
+		if node.Tag == "base" {
+			return nil, newBuildError(stagePush, node.Tag, errors.New("boom"))
+		}
+		mu.Lock()
+		built = append(built, node.Tag)
+		mu.Unlock()
+		return &imageBuild{Tag: node.Tag}, nil
+	})
+
+	err := buildSummary(&buff, results)
+
+	assert.Error(t, err)
+	assert.Equal(t, ExitPushFailure, exitCode(err))
+	assert.Equal(t, []string{"other"}, built, "images built from a failed image should be skipped")
+	assert.True(t, strings.Contains(buff.String(), "skipped, base was not built"))
+	assert.True(t, strings.Contains(buff.String(), "1 built, 0 up to date, 1 failed, 1 skipped"))
+}
+
+func Test_runBuildJobsStopsWithoutKeepGoing(t *testing.T) {
+
+	KeepGoing = false
+
+	first := &buildNode{Tag: "first"}
+	second := &buildNode{Tag: "second"}
+
+	var built []string
+
+	results := runBuildJobs([]*buildNode{first, second}, 1, io.Discard, func(node *buildNode, out io.Writer) (*imageBuild, error) {
+		built = append(built, node.Tag)
+		return nil, newBuildError(stageBuild, node.Tag, errors.New("boom"))
+	})
+
+	assert.Equal(t, []string{"first"}, built, "nothing new should start after a failure")
+	assert.Equal(t, "stopped after an earlier failure", results[1].Skipped)
+	assert.Equal(t, ExitBuildFailure, exitCode(buildSummary(io.Discard, results)))
+}
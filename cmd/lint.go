@@ -0,0 +1,614 @@
+// Cmd lint checks rendered Dockerfiles against a set of rules, without needing a docker daemon
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var lintCmd = CreateLintCmd()
+
+// LintFormat is how problems are reported, `text` or `json`, set with `--format`
+var LintFormat string = "text"
+
+// LintFailOn is the lowest severity that fails the lint, set with `--fail-on`
+var LintFailOn string = severityError
+
+// The severities of lint rules, from worst to least
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+	severityInfo    = "info"
+	severityOff     = "off"
+)
+
+var severityRank = map[string]int{severityError: 3, severityWarning: 2, severityInfo: 1}
+
+// lintIgnorePrefix suppresses rules for the next instruction, `# mach:lint-ignore ML001,ML002`, and
+// lintIgnoreFilePrefix for the whole Dockerfile
+const (
+	lintIgnorePrefix     = "mach:lint-ignore"
+	lintIgnoreFilePrefix = "mach:lint-ignore-file"
+)
+
+// lintRule is a single check, run over the instructions of a rendered Dockerfile
+type lintRule struct {
+	ID       string
+	Name     string
+	Severity string
+	check    func(instructions []dockerInstruction) []lintProblem
+}
+
+// lintProblem is something a rule found wrong with a Dockerfile
+type lintProblem struct {
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+	Rule     string `json:"rule"`
+	Name     string `json:"name"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+	// Instruction is the start of the instruction at fault, to find it by in a template
+	Instruction string `json:"instruction"`
+	// Rendered is set when the Dockerfile is a template that renders to something else, the Line is then a
+	// line of the rendered Dockerfile rather than of the File
+	Rendered bool `json:"rendered"`
+}
+
+// lintInstructionLength is how much of an instruction is shown with a problem
+const lintInstructionLength = 60
+
+// dockerInstruction is one instruction of a Dockerfile, with continuation lines joined up
+type dockerInstruction struct {
+	// Line is where the instruction starts in the rendered Dockerfile
+	Line int
+	// Cmd is the instruction in upper case, like `RUN`
+	Cmd  string
+	Args string
+	// Stage counts the FROM instructions before this one, starting at 1
+	Stage int
+	// Ignore holds the rules suppressed for this instruction
+	Ignore map[string]bool
+}
+
+// lintRules are all the rules, severities can be changed or rules turned off with `lint_rules` in config
+var lintRules = []lintRule{
+	{ID: "ML001", Name: "from-latest", Severity: severityWarning, check: lintFromLatest},
+	{ID: "ML002", Name: "missing-user", Severity: severityWarning, check: lintMissingUser},
+	{ID: "ML003", Name: "apt-cleanup", Severity: severityWarning, check: lintAptCleanup},
+	{ID: "ML004", Name: "add-url", Severity: severityWarning, check: lintAddURL},
+	{ID: "ML005", Name: "env-secret", Severity: severityError, check: lintEnvSecret},
+	{ID: "ML006", Name: "missing-healthcheck", Severity: severityInfo, check: lintMissingHealthcheck},
+}
+
+// lintFailure is returned when problems at or above LintFailOn were found
+type lintFailure struct {
+	Count int
+}
+
+func (e *lintFailure) Error() string {
+	return fmt.Sprintf("%d problem(s) at or above %s severity", e.Count, LintFailOn)
+}
+
+func (e *lintFailure) ExitCode() int {
+	return ExitLintFailure
+}
+
+func CreateLintCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "lint [docker-image[:tag]]",
+		Short: "Checks rendered Dockerfiles for common problems",
+		Long: `Renders every Dockerfile in the build directory, or the images passed as arguments, and
+	checks the instructions against a set of rules. Nothing is built, so no docker daemon is needed.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runLint(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+	lintCmd.Flags().StringVar(&LintFormat, "format", LintFormat, "output format, text or json")
+
+	lintCmd.Flags().StringVar(&LintFailOn, "fail-on", LintFailOn, "lowest severity that fails the lint: error, warning or info")
+
+	lintCmd.Flags().Bool("strict", StrictTemplates, "fail on template keys that do not exist (default on when CI is set)")
+
+}
+
+func runLint(cmd *cobra.Command, args []string) error {
+
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	StrictTemplates = viper.GetBool("strict_templates")
+	if cmd.Flags().Changed("strict") {
+		StrictTemplates, _ = cmd.Flags().GetBool("strict")
+	}
+
+	return MainLintFlow(cmd.OutOrStdout(), args)
+}
+
+// MainLintFlow lints the Dockerfiles matching the arguments, or every Dockerfile in the build directory, and
+// writes the problems to w in LintFormat.
+func MainLintFlow(w io.Writer, args []string) error {
+
+	if LintFormat != "text" && LintFormat != "json" {
+		return fmt.Errorf("unknown format %q, use text or json", LintFormat)
+	}
+
+	if _, ok := severityRank[LintFailOn]; !ok {
+		return fmt.Errorf("unknown severity %q, use error, warning or info", LintFailOn)
+	}
+
+	if err := checkLintRules(); err != nil {
+		return err
+	}
+
+	problems := []lintProblem{}
+
+	for _, filename := range findDockerfiles(args) {
+		var rendered bytes.Buffer
+		if err := generateDockerfileTemplate(&rendered, filename); err != nil {
+			return err
+		}
+
+		// the rules only see the rendered Dockerfile, whose lines don't match a template's
+		source, err := ioutil.ReadFile(filename)
+		templated := err != nil || !bytes.Equal(source, rendered.Bytes())
+
+		for _, problem := range lintDockerfile(filename, rendered.Bytes()) {
+			problem.Rendered = templated
+			problems = append(problems, problem)
+		}
+	}
+
+	if LintFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(problems); err != nil {
+			return err
+		}
+	} else {
+		for _, problem := range problems {
+			c := color.New(color.FgYellow)
+			switch problem.Severity {
+			case severityError:
+				c = color.New(color.FgRed)
+			case severityInfo:
+				c = color.New(color.FgCyan)
+			}
+			if problem.Rendered {
+				c.Fprintf(w, "%s (rendered):%d: %s %s %s: %s, at %s\n", problem.File, problem.Line, problem.Severity, problem.Rule, problem.Name, problem.Message, problem.Instruction)
+			} else {
+				c.Fprintf(w, "%s:%d: %s %s %s: %s\n", problem.File, problem.Line, problem.Severity, problem.Rule, problem.Name, problem.Message)
+			}
+		}
+	}
+
+	failed := 0
+	for _, problem := range problems {
+		if severityRank[problem.Severity] >= severityRank[LintFailOn] {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return &lintFailure{Count: failed}
+	}
+
+	return nil
+}
+
+// lintDockerfile runs every rule that is switched on over a rendered Dockerfile, leaving out the problems
+// suppressed by comments.
+func lintDockerfile(filename string, dockerfile []byte) []lintProblem {
+
+	instructions, ignoreFile := parseInstructions(dockerfile)
+
+	var problems []lintProblem
+
+	for _, rule := range lintRules {
+		severity := lintSeverity(rule)
+		if severity == severityOff || ignoreFile[rule.ID] {
+			continue
+		}
+
+		for _, problem := range rule.check(instructions) {
+			instruction := instructionAt(instructions, problem.Line)
+			if instruction != nil && instruction.Ignore[rule.ID] {
+				continue
+			}
+
+			if instruction != nil {
+				problem.Instruction = shortInstruction(*instruction)
+			}
+
+			problem.File = filename
+			problem.Rule = rule.ID
+			problem.Name = rule.Name
+			problem.Severity = severity
+			problems = append(problems, problem)
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Line < problems[j].Line })
+
+	return problems
+}
+
+// checkLintRules makes sure every severity set with `lint_rules` in config is one there is, so a typo doesn't
+// quietly leave a rule at its default
+func checkLintRules() error {
+
+	for key, severity := range viper.GetStringMapString("lint_rules") {
+		switch strings.ToLower(severity) {
+		case severityError, severityWarning, severityInfo, severityOff, "false":
+		default:
+			return fmt.Errorf("lint_rules: unknown severity %q for %s, use error, warning, info or off", severity, key)
+		}
+	}
+
+	return nil
+}
+
+// lintSeverity returns the severity of a rule, from `lint_rules` in config when it is set there by ID or name
+func lintSeverity(rule lintRule) string {
+
+	for key, severity := range viper.GetStringMapString("lint_rules") {
+		if strings.EqualFold(key, rule.ID) || strings.EqualFold(key, rule.Name) {
+			// yaml reads an unquoted off as false
+			if severity == "false" {
+				return severityOff
+			}
+			return strings.ToLower(severity)
+		}
+	}
+
+	return rule.Severity
+}
+
+// instructionAt returns the instruction starting at a line, if there is one
+func instructionAt(instructions []dockerInstruction, line int) *dockerInstruction {
+
+	for i := range instructions {
+		if instructions[i].Line == line {
+			return &instructions[i]
+		}
+	}
+
+	return nil
+}
+
+// shortInstruction returns the start of an instruction, cut to lintInstructionLength
+func shortInstruction(instruction dockerInstruction) string {
+
+	text := strings.Join(strings.Fields(instruction.Cmd+" "+instruction.Args), " ")
+	if len(text) > lintInstructionLength {
+		text = text[:lintInstructionLength] + "..."
+	}
+
+	return text
+}
+
+// parseInstructions splits a Dockerfile into instructions, joining continuation lines, along with the rules
+// suppressed for the whole file.
+func parseInstructions(dockerfile []byte) ([]dockerInstruction, map[string]bool) {
+
+	var instructions []dockerInstruction
+	ignoreFile := map[string]bool{}
+	ignoreNext := map[string]bool{}
+
+	var current *dockerInstruction
+	stage := 0
+	line := 0
+
+	scanner := bufio.NewScanner(bytes.NewReader(dockerfile))
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(text, "#") {
+			comment := strings.TrimSpace(strings.TrimPrefix(text, "#"))
+			if strings.HasPrefix(comment, lintIgnoreFilePrefix) {
+				addRuleIDs(ignoreFile, strings.TrimPrefix(comment, lintIgnoreFilePrefix))
+			} else if strings.HasPrefix(comment, lintIgnorePrefix) {
+				addRuleIDs(ignoreNext, strings.TrimPrefix(comment, lintIgnorePrefix))
+			}
+			continue
+		}
+
+		if current == nil {
+			if text == "" {
+				continue
+			}
+
+			fields := strings.SplitN(text, " ", 2)
+			cmd := strings.ToUpper(fields[0])
+			if cmd == "FROM" {
+				stage++
+			}
+
+			current = &dockerInstruction{Line: line, Cmd: cmd, Stage: stage, Ignore: ignoreNext}
+			ignoreNext = map[string]bool{}
+			if len(fields) > 1 {
+				text = fields[1]
+			} else {
+				text = ""
+			}
+		}
+
+		if strings.HasSuffix(text, "\\") {
+			current.Args += strings.TrimSuffix(text, "\\") + " "
+			continue
+		}
+
+		current.Args = strings.TrimSpace(current.Args + text)
+		instructions = append(instructions, *current)
+		current = nil
+	}
+
+	if current != nil {
+		current.Args = strings.TrimSpace(current.Args)
+		instructions = append(instructions, *current)
+	}
+
+	return instructions, ignoreFile
+}
+
+func addRuleIDs(ids map[string]bool, list string) {
+
+	for _, id := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ' ' }) {
+		ids[strings.ToUpper(id)] = true
+	}
+}
+
+// finalStage returns the instructions of the last stage, the one that ends up in the image
+func finalStage(instructions []dockerInstruction) []dockerInstruction {
+
+	last := 0
+	for _, instruction := range instructions {
+		last = instruction.Stage
+	}
+
+	var stage []dockerInstruction
+	for _, instruction := range instructions {
+		if instruction.Stage == last {
+			stage = append(stage, instruction)
+		}
+	}
+
+	return stage
+}
+
+// fromImage returns the image and stage name of a FROM instruction, skipping flags like --platform
+func fromImage(args string) (string, string) {
+
+	fields := strings.Fields(args)
+	for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+		fields = fields[1:]
+	}
+
+	if len(fields) == 0 {
+		return "", ""
+	}
+
+	if len(fields) >= 3 && strings.EqualFold(fields[1], "AS") {
+		return fields[0], strings.ToLower(fields[2])
+	}
+
+	return fields[0], ""
+}
+
+func lintFromLatest(instructions []dockerInstruction) []lintProblem {
+
+	var problems []lintProblem
+	stages := map[string]bool{}
+
+	for _, instruction := range instructions {
+		if instruction.Cmd != "FROM" {
+			continue
+		}
+
+		image, name := fromImage(instruction.Args)
+
+		// FROM an earlier stage, scratch, a build arg or a digest are all pinned as far as this rule goes
+		pinned := image == "" || image == "scratch" || stages[strings.ToLower(image)] || strings.Contains(image, "$") || strings.Contains(image, "@")
+
+		if name != "" {
+			stages[name] = true
+		}
+
+		if pinned {
+			continue
+		}
+
+		if tagName(image) == "latest" {
+			problems = append(problems, lintProblem{Line: instruction.Line, Message: "FROM " + image + " is not pinned to a version, it builds from whatever latest is today"})
+		}
+	}
+
+	return problems
+}
+
+func lintMissingUser(instructions []dockerInstruction) []lintProblem {
+
+	stage := finalStage(instructions)
+	if len(stage) == 0 {
+		return nil
+	}
+
+	var user *dockerInstruction
+	for i := range stage {
+		if stage[i].Cmd == "USER" {
+			user = &stage[i]
+		}
+	}
+
+	if user == nil {
+		return []lintProblem{{Line: stage[0].Line, Message: "the image runs as root, add a USER"}}
+	}
+
+	name := strings.SplitN(strings.TrimSpace(user.Args), ":", 2)[0]
+	if name == "root" || name == "0" {
+		return []lintProblem{{Line: user.Line, Message: "the image runs as root, the last USER should be someone else"}}
+	}
+
+	return nil
+}
+
+func lintAptCleanup(instructions []dockerInstruction) []lintProblem {
+
+	var problems []lintProblem
+
+	for _, instruction := range instructions {
+		if instruction.Cmd != "RUN" || !aptGetInstalls(instruction.Args) {
+			continue
+		}
+
+		if !strings.Contains(instruction.Args, "/var/lib/apt/lists") {
+			problems = append(problems, lintProblem{Line: instruction.Line, Message: "apt-get install without rm -rf /var/lib/apt/lists/* in the same RUN leaves the package lists in the image"})
+		}
+	}
+
+	return problems
+}
+
+// aptGetOptionArgs are the apt-get options that take the next word as their value
+var aptGetOptionArgs = map[string]bool{"-o": true, "--option": true, "-c": true, "--config-file": true, "-t": true, "--target-release": true}
+
+// aptGetInstalls reports if a shell command runs `apt-get install`, with any options before the install, like
+// `apt-get -y --no-install-recommends install`
+func aptGetInstalls(command string) bool {
+
+	for _, separator := range []string{"&&", "||", ";", "|", "(", ")"} {
+		command = strings.ReplaceAll(command, separator, "\n")
+	}
+
+	for _, line := range strings.Split(command, "\n") {
+		words := strings.Fields(line)
+
+		for i := 0; i < len(words); i++ {
+			if words[i] != "apt-get" && !strings.HasSuffix(words[i], "/apt-get") {
+				continue
+			}
+
+			for i++; i < len(words); i++ {
+				if !strings.HasPrefix(words[i], "-") {
+					if words[i] == "install" {
+						return true
+					}
+					break
+				}
+				if aptGetOptionArgs[words[i]] {
+					i++
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+func lintAddURL(instructions []dockerInstruction) []lintProblem {
+
+	var problems []lintProblem
+
+	for _, instruction := range instructions {
+		if instruction.Cmd != "ADD" {
+			continue
+		}
+
+		for _, field := range strings.Fields(instruction.Args) {
+			if strings.HasPrefix(field, "http://") || strings.HasPrefix(field, "https://") {
+				problems = append(problems, lintProblem{Line: instruction.Line, Message: "ADD " + field + " downloads at build time without a checksum, use curl in a RUN or COPY a vendored file"})
+				break
+			}
+		}
+	}
+
+	return problems
+}
+
+// secretEnvKey matches variable names that usually hold secrets
+var secretEnvKey = regexp.MustCompile(`(?i)(password|passwd|secret|token|api_?key|private_?key|access_?key|credentials)`)
+
+func lintEnvSecret(instructions []dockerInstruction) []lintProblem {
+
+	var problems []lintProblem
+
+	for _, instruction := range instructions {
+		if instruction.Cmd != "ENV" {
+			continue
+		}
+
+		for key, value := range envPairs(instruction.Args) {
+			value = strings.Trim(value, `"'`)
+			if secretEnvKey.MatchString(key) && value != "" && !strings.HasPrefix(value, "$") {
+				problems = append(problems, lintProblem{Line: instruction.Line, Message: "ENV " + key + " looks like a secret, it is stored in the image for anyone to read"})
+			}
+		}
+	}
+
+	return problems
+}
+
+// envPairs reads the variables set by an ENV instruction, in either the `KEY=value` or the `KEY value` form
+func envPairs(args string) map[string]string {
+
+	pairs := map[string]string{}
+
+	fields := strings.Fields(args)
+	if len(fields) == 0 {
+		return pairs
+	}
+
+	if !strings.Contains(fields[0], "=") {
+		pairs[fields[0]] = strings.TrimSpace(strings.TrimPrefix(args, fields[0]))
+		return pairs
+	}
+
+	for _, field := range fields {
+		parts := strings.SplitN(field, "=", 2)
+		if len(parts) == 2 {
+			pairs[parts[0]] = parts[1]
+		}
+	}
+
+	return pairs
+}
+
+func lintMissingHealthcheck(instructions []dockerInstruction) []lintProblem {
+
+	stage := finalStage(instructions)
+	if len(stage) == 0 {
+		return nil
+	}
+
+	for _, instruction := range stage {
+		if instruction.Cmd == "HEALTHCHECK" {
+			return nil
+		}
+	}
+
+	return []lintProblem{{Line: stage[0].Line, Message: "there is no HEALTHCHECK, so orchestrators can't tell if the container works"}}
+}
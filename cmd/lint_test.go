@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+const lintTestDockerfile = `FROM golang:1.18 AS build
+RUN go build .
+
+FROM debian
+ENV DB_PASSWORD=hunter2 \
+    APP_TOKEN=$TOKEN
+# mach:lint-ignore ML004
+ADD https://example.com/tool.tar.gz /opt/
+ADD https://example.com/other.tar.gz /opt/
+RUN apt-get update && \
+    apt-get install -y curl
+COPY --from=build /app /app
+`
+
+func lintRuleIDs(problems []lintProblem) []string {
+
+	var ids []string
+	for _, problem := range problems {
+		ids = append(ids, problem.Rule)
+	}
+
+	return ids
+}
+
+func Test_parseInstructions(t *testing.T) {
+
+	instructions, ignoreFile := parseInstructions([]byte("# mach:lint-ignore-file ML006, ML002\nfrom alpine:3.16 as base\nRUN a \\\n  && b\n\nFROM base\nUSER app\n"))
+
+	assert.Equal(t, map[string]bool{"ML006": true, "ML002": true}, ignoreFile)
+	assert.Len(t, instructions, 4)
+	assert.Equal(t, dockerInstruction{Line: 2, Cmd: "FROM", Args: "alpine:3.16 as base", Stage: 1, Ignore: map[string]bool{}}, instructions[0])
+	assert.Equal(t, "a  && b", instructions[1].Args)
+	assert.Equal(t, 3, instructions[1].Line)
+	assert.Equal(t, 2, instructions[3].Stage)
+}
+
+func Test_lintDockerfile(t *testing.T) {
+
+	problems := lintDockerfile("Dockerfile", []byte(lintTestDockerfile))
+
+	assert.Equal(t, []string{"ML001", "ML002", "ML006", "ML005", "ML004", "ML003"}, lintRuleIDs(problems))
+
+	assert.Equal(t, 4, problems[0].Line, "FROM debian is unpinned, the golang stage is not")
+	assert.Equal(t, 5, problems[3].Line)
+	assert.Contains(t, problems[3].Message, "DB_PASSWORD", "only the secret with a literal value is reported")
+	assert.Equal(t, severityError, problems[3].Severity)
+	assert.Equal(t, 9, problems[4].Line, "the ADD after the suppression comment is ignored")
+}
+
+func Test_lintDockerfileConfig(t *testing.T) {
+
+	viper.Set("lint_rules", map[string]string{"ML006": "off", "missing-user": "error", "ML001": "false"})
+	defer viper.Set("lint_rules", nil)
+
+	problems := lintDockerfile("Dockerfile", []byte("FROM alpine:3.16\nUSER root\n"))
+
+	assert.Equal(t, []string{"ML002"}, lintRuleIDs(problems))
+	assert.Equal(t, severityError, problems[0].Severity)
+	assert.Equal(t, 2, problems[0].Line)
+	assert.Equal(t, "USER root", problems[0].Instruction)
+
+	assert.NoError(t, checkLintRules())
+
+	viper.Set("lint_rules", map[string]string{"ML006": "warn"})
+
+	assert.EqualError(t, checkLintRules(), `lint_rules: unknown severity "warn" for ML006, use error, warning, info or off`)
+	assert.Error(t, MainLintFlow(&bytes.Buffer{}, nil), "a typo in the config should not be ignored")
+}
+
+func Test_aptGetInstalls(t *testing.T) {
+
+	for command, expected := range map[string]bool{
+		"apt-get install -y curl":                                          true,
+		"apt-get update && apt-get -y install curl":                        true,
+		"apt-get --no-install-recommends install curl":                     true,
+		"DEBIAN_FRONTEND=noninteractive /usr/bin/apt-get -qq install curl": true,
+		"apt-get -o Dpkg::Options::=--force-confnew install curl":          true,
+		"apt-get update;apt-get install curl":                              true,
+		"apt-get update":                                                   false,
+		"apt-get -o install update":                                        false,
+		"apk add curl":                                                     false,
+	} {
+		assert.Equal(t, expected, aptGetInstalls(command), command)
+	}
+}
+
+func Test_MainLintFlow(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{
+		"clean": "FROM alpine:3.16\nUSER app\nHEALTHCHECK CMD true\n",
+		"dirty": "FROM alpine\nENV API_KEY=abc\n",
+		"tpl":   "FROM alpine:3.16\n{{- /* a comment */}}\nUSER app\nHEALTHCHECK CMD true\nENV API_KEY=abc\n",
+	})
+	defer os.RemoveAll(dir)
+
+	BuildImageDirname = dir
+	defer func() { BuildImageDirname = "images" }()
+
+	var out bytes.Buffer
+	assert.NoError(t, MainLintFlow(&out, []string{"clean"}))
+	assert.Empty(t, out.String())
+
+	LintFormat = "json"
+	defer func() { LintFormat = "text" }()
+
+	out.Reset()
+	err := MainLintFlow(&out, []string{"dirty"})
+	assert.Error(t, err)
+	assert.Equal(t, ExitLintFailure, exitCode(err))
+
+	var problems []lintProblem
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &problems))
+	assert.Equal(t, []string{"ML001", "ML002", "ML006", "ML005"}, lintRuleIDs(problems))
+	assert.Equal(t, filepath.Join(dir, "dirty", "Dockerfile"), problems[0].File)
+	assert.False(t, problems[0].Rendered)
+
+	LintFormat = "text"
+
+	out.Reset()
+	assert.Error(t, MainLintFlow(&out, []string{"tpl"}))
+	assert.Equal(t, filepath.Join(dir, "tpl", "Dockerfile")+" (rendered):4: error ML005 env-secret: ENV API_KEY looks like a secret, it is stored in the image for anyone to read, at ENV API_KEY=abc\n",
+		out.String(), "lines of a template are those of the rendered Dockerfile, and say so")
+
+	LintFormat = "json"
+
+	LintFailOn = severityInfo
+	defer func() { LintFailOn = severityError }()
+
+	out.Reset()
+	assert.NoError(t, MainLintFlow(&out, []string{"clean"}), "a clean image passes at any severity")
+}
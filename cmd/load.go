@@ -0,0 +1,274 @@
+// Cmd load imports the images of an export directory into the docker daemon
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+)
+
+var loadCmd = CreateLoadCmd()
+
+func CreateLoadCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "load <dir>",
+		Short: "Loads the images exported by mach build --export into the docker daemon",
+		Long: `Reads the index of a directory written by mach build --export and loads every image in it into the
+	docker daemon with all of its tags, docker-archive tarballs and OCI image layouts alike. Each image is checked
+	against the digest in the index first, so an image damaged on its way across is never loaded.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runLoad(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(loadCmd)
+
+	loadCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+}
+
+func runLoad(cmd *cobra.Command, args []string) error {
+
+	return MainLoadFlow(nil, args[0])
+}
+
+// MainLoadFlow loads every image listed in the index of an export directory. Output goes to out, or the
+// terminal when it is nil.
+func MainLoadFlow(out io.Writer, dir string) error {
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	return loadExportedImages(context.Background(), cli, dir, out)
+}
+
+// loadExportedImages loads the images of an export directory in the order of its index, stopping at the
+// first that fails
+func loadExportedImages(ctx context.Context, cli client.APIClient, dir string, out io.Writer) error {
+
+	index, err := readExportIndex(dir)
+	if err != nil {
+		return err
+	}
+
+	if len(index.Images) == 0 {
+		return fmt.Errorf("no images in %s, export them with mach build --export %s", filepath.Join(dir, exportIndexFilename), dir)
+	}
+
+	for _, image := range index.Images {
+		printStatus(out, color.New(color.FgHiYellow), "Loading "+image.Tag)
+
+		if err := loadExportedImage(ctx, cli, dir, image); err != nil {
+			return fmt.Errorf("%s: %v", image.Tag, err)
+		}
+
+		printStatus(out, color.New(color.FgGreen), fmt.Sprintf("loaded %s", image.Tag))
+	}
+
+	return nil
+}
+
+// loadExportedImage checks an exported image against its digest and loads it into the daemon
+func loadExportedImage(ctx context.Context, cli client.APIClient, dir string, image *exportedImage) error {
+
+	filename := filepath.Join(dir, image.Path)
+
+	switch image.Format {
+	case exportDockerArchive:
+		if err := verifyFileDigest(filename, image.Digest); err != nil {
+			return err
+		}
+
+		f, err := os.Open(filename)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		return imageLoad(ctx, cli, f)
+	case exportOCI:
+		archive, err := ociLayoutArchive(filename, image.Digest)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		return imageLoad(ctx, cli, archive)
+	}
+
+	return checkExportFormat(image.Format)
+}
+
+// imageLoad sends a `docker save` tarball to the daemon, returning the first error it reports
+func imageLoad(ctx context.Context, cli client.APIClient, r io.Reader) error {
+
+	res, err := cli.ImageLoad(ctx, r, true)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		errLine := &errorLine{}
+		json.Unmarshal(scanner.Bytes(), errLine)
+		if errLine.Error != "" {
+			return errors.New(errLine.Error)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// verifyFileDigest checks the sha256 of a file
+func verifyFileDigest(filename string, digest string) error {
+	return copyBlob(ioutil.Discard, filename, digest)
+}
+
+// ociLayoutArchive streams an OCI image layout as the `docker save` tarball the daemon can load: its blobs
+// and a manifest.json naming the image by the tags in the layout's index.json. Blobs are checked against
+// their digests as they are read, and the manifest against the digest it was exported with.
+func ociLayoutArchive(dir string, digest string) (io.ReadCloser, error) {
+
+	var index ociIndex
+	if err := readJSONFile(filepath.Join(dir, "index.json"), &index); err != nil {
+		return nil, err
+	}
+
+	var tags []string
+	for _, descriptor := range index.Manifests {
+		if descriptor.Digest != digest {
+			continue
+		}
+		if tag := descriptor.Annotations[ociImageNameAnnotation]; tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%s has no tagged manifest %s", filepath.Join(dir, "index.json"), digest)
+	}
+
+	blob := func(digest string) string {
+		return filepath.Join(dir, "blobs", "sha256", digestHex(digest))
+	}
+
+	if err := verifyFileDigest(blob(digest), digest); err != nil {
+		return nil, err
+	}
+
+	var manifest ociManifest
+	if err := readJSONFile(blob(digest), &manifest); err != nil {
+		return nil, err
+	}
+
+	archived := dockerArchiveManifest{Config: "blobs/sha256/" + digestHex(manifest.Config.Digest), RepoTags: tags}
+	descriptors := []ociDescriptor{manifest.Config}
+
+	for _, layer := range manifest.Layers {
+		archived.Layers = append(archived.Layers, "blobs/sha256/"+digestHex(layer.Digest))
+		descriptors = append(descriptors, layer)
+	}
+
+	content, err := json.Marshal([]dockerArchiveManifest{archived})
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+
+		err := writeTarFile(tw, "manifest.json", int64(len(content)), func(w io.Writer) error {
+			_, err := w.Write(content)
+			return err
+		})
+
+		written := map[string]bool{}
+		for _, descriptor := range descriptors {
+			if err != nil || written[descriptor.Digest] {
+				continue
+			}
+			written[descriptor.Digest] = true
+
+			err = writeTarFile(tw, "blobs/sha256/"+digestHex(descriptor.Digest), descriptor.Size, func(w io.Writer) error {
+				return copyBlob(w, blob(descriptor.Digest), descriptor.Digest)
+			})
+		}
+
+		if err == nil {
+			err = tw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr, nil
+}
+
+// writeTarFile adds a regular file to a tarball
+func writeTarFile(tw *tar.Writer, name string, size int64, write func(io.Writer) error) error {
+
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: size, Typeflag: tar.TypeReg}); err != nil {
+		return err
+	}
+
+	return write(tw)
+}
+
+// copyBlob copies a blob, failing when it doesn't match its digest
+func copyBlob(w io.Writer, filename string, digest string) error {
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), f); err != nil {
+		return err
+	}
+
+	if actual := "sha256:" + hex.EncodeToString(hash.Sum(nil)); actual != digest {
+		return fmt.Errorf("%s has digest %s, expected %s", filename, actual, digest)
+	}
+
+	return nil
+}
+
+func readJSONFile(filename string, v interface{}) error {
+
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(content, v); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeLoadClient stands in for the docker daemon loading images
+type fakeLoadClient struct {
+	*fakeSaveClient
+	loaded   [][]byte
+	response string
+}
+
+func (f *fakeLoadClient) ImageLoad(ctx context.Context, input io.Reader, quiet bool) (types.ImageLoadResponse, error) {
+
+	content, err := ioutil.ReadAll(input)
+	if err != nil {
+		return types.ImageLoadResponse{}, err
+	}
+
+	f.loaded = append(f.loaded, content)
+
+	return types.ImageLoadResponse{Body: ioutil.NopCloser(strings.NewReader(f.response)), JSON: true}, nil
+}
+
+// testExport exports the test image in both formats, with an index
+func testExport(t *testing.T) (string, *fakeLoadClient) {
+
+	cli := &fakeLoadClient{fakeSaveClient: testExportClient(t), response: `{"stream":"Loaded image: superterran/mach:php\n"}` + "\n"}
+	dir := testExportDir(t)
+
+	var results []*buildResult
+	for _, format := range []string{exportDockerArchive, exportOCI} {
+		tags := testExportTags
+		if format == exportOCI {
+			tags = []string{"superterran/mach:php", "superterran/mach:php-oci"}
+		}
+
+		image, err := exportImage(context.Background(), cli, tags, filepath.Join(dir, format), format)
+		if err != nil {
+			assert.FailNow(t, err.Error())
+		}
+		image.Tag, image.Path = tags[1], filepath.Join(format, image.Path)
+
+		results = append(results, &buildResult{Build: &imageBuild{Export: image}})
+	}
+
+	assert.NoError(t, writeExportIndex(dir, results))
+
+	return dir, cli
+}
+
+func Test_loadExportedImages(t *testing.T) {
+
+	dir, cli := testExport(t)
+
+	var out bytes.Buffer
+	assert.NoError(t, loadExportedImages(context.Background(), cli, dir, &out))
+
+	assert.Equal(t, "Loading superterran/mach:php-8.1\nloaded superterran/mach:php-8.1\nLoading superterran/mach:php-oci\nloaded superterran/mach:php-oci\n", out.String())
+
+	if !assert.Len(t, cli.loaded, 2) {
+		return
+	}
+
+	assert.Equal(t, cli.saved, cli.loaded[0], "docker archives are loaded as they are")
+
+	var manifest []dockerArchiveManifest
+	files := map[string]bool{}
+
+	tr := tar.NewReader(bytes.NewReader(cli.loaded[1]))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		files[header.Name] = true
+		if header.Name == "manifest.json" {
+			json.NewDecoder(tr).Decode(&manifest)
+		}
+	}
+
+	if assert.Len(t, manifest, 1) {
+		assert.Equal(t, []string{"superterran/mach:php", "superterran/mach:php-oci"}, manifest[0].RepoTags)
+		assert.True(t, files[manifest[0].Config])
+		assert.Len(t, files, 4, "the manifest, config and each layer once")
+	}
+
+	contents, err := readImageContents(bytes.NewReader(cli.loaded[1]))
+	assert.NoError(t, err, "OCI layouts are loaded as a docker archive")
+	assert.Equal(t, "alpine", contents.OS.ID)
+}
+
+func Test_loadExportedImagesChecksDigests(t *testing.T) {
+
+	dir, cli := testExport(t)
+
+	ioutil.WriteFile(filepath.Join(dir, exportDockerArchive, "superterran_mach_php.tar"), []byte("damaged"), 0644)
+
+	err := loadExportedImages(context.Background(), cli, dir, ioutil.Discard)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "superterran/mach:php-8.1:")
+	assert.Empty(t, cli.loaded)
+
+	dir, cli = testExport(t)
+
+	blobs := filepath.Join(dir, exportOCI, "superterran_mach_php", "blobs", "sha256")
+	var manifest ociManifest
+	index, _ := readExportIndex(dir)
+	readJSONFile(filepath.Join(blobs, digestHex(index.Images[1].Digest)), &manifest)
+
+	ioutil.WriteFile(filepath.Join(blobs, digestHex(manifest.Layers[1].Digest)), []byte("damaged"), 0644)
+
+	err = loadExportedImage(context.Background(), cli, dir, index.Images[1])
+	assert.Error(t, err, "a damaged layer fails the load")
+}
+
+func Test_loadExportedImagesErrors(t *testing.T) {
+
+	dir, cli := testExport(t)
+
+	cli.response = `{"errorDetail":{"message":"no space left on device"},"error":"no space left on device"}` + "\n"
+
+	err := loadExportedImages(context.Background(), cli, dir, ioutil.Discard)
+	assert.EqualError(t, err, "superterran/mach:php-8.1: no space left on device")
+
+	empty := testExportDir(t)
+	os.MkdirAll(empty, 0755)
+
+	err = loadExportedImages(context.Background(), cli, empty, ioutil.Discard)
+	assert.Error(t, err, "a directory without exported images")
+}
@@ -0,0 +1,151 @@
+// Cmd lock records the digest every tag was pushed with, so stacks can deploy exactly what was built
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+// LockFile is the file pushed digests are recorded in, meant to be committed with the images. Set with
+// `lock_file` in config.
+var LockFile string = "mach.lock"
+
+const lockFileHeader = "# written by mach build, records the digest each tag was last pushed with\n"
+
+// imageLock is the content of the lock file, tags mapped to the digest they were pushed with
+type imageLock struct {
+	Images map[string]string `yaml:"images"`
+}
+
+// lockFilename returns the lock file to use, from config or the default
+func lockFilename() string {
+
+	if filename := viper.GetString("lock_file"); filename != "" {
+		return filename
+	}
+
+	return LockFile
+}
+
+// loadImageLock reads a lock file, a file that doesn't exist yet is an empty lock
+func loadImageLock(filename string) (*imageLock, error) {
+
+	lock := &imageLock{Images: map[string]string{}}
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return lock, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(content, lock); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	if lock.Images == nil {
+		lock.Images = map[string]string{}
+	}
+
+	return lock, nil
+}
+
+// save writes the lock file, tags are sorted so the file diffs cleanly
+func (l *imageLock) save(filename string) error {
+
+	var buff bytes.Buffer
+	buff.WriteString(lockFileHeader)
+
+	enc := yaml.NewEncoder(&buff)
+	enc.SetIndent(2)
+	if err := enc.Encode(l); err != nil {
+		return err
+	}
+	enc.Close()
+
+	return ioutil.WriteFile(filename, buff.Bytes(), 0644)
+}
+
+// digest looks up the digest of an image. The image is either a full tag as it was pushed, or the
+// `image[:variant]` form used by `mach build`, like `php/8.1:fpm`, which is resolved to the tag its Dockerfile
+// gets, or looked up under the docker registry when the Dockerfile isn't around.
+func (l *imageLock) digest(image string) (string, error) {
+
+	if digest, ok := l.Images[image]; ok {
+		return digest, nil
+	}
+
+	if tag, err := resolveImageTag(image); err == nil {
+		if digest, ok := l.Images[tag]; ok {
+			return digest, nil
+		}
+	}
+
+	registry := viper.GetString("docker_registry")
+	if registry == "" {
+		registry = DockerRegistry
+	}
+
+	separator := viper.GetString("image_name_separator")
+	if separator == "" {
+		separator = ImageNameSeparator
+	}
+
+	name := strings.Replace(strings.ReplaceAll(image, "/", separator), ":", "-", 1)
+	if digest, ok := l.Images[registry+":"+name]; ok {
+		return digest, nil
+	}
+
+	return "", fmt.Errorf("no digest for %s in %s, push it with mach build first", image, lockFilename())
+}
+
+// imageDigest is the `imageDigest` template function, returning the digest an image was last pushed with
+func imageDigest(image string) (string, error) {
+
+	lock, err := loadImageLock(lockFilename())
+	if err != nil {
+		return "", err
+	}
+
+	return lock.digest(image)
+}
+
+// updateImageLock records the digests of every tag pushed by a build, the lock file is only written when
+// something was pushed.
+func updateImageLock(results []*buildResult) error {
+
+	pushed := map[string]string{}
+	for _, result := range results {
+		if result.Build == nil {
+			continue
+		}
+		for tag, digest := range result.Build.Digests {
+			if digest != "" {
+				pushed[tag] = digest
+			}
+		}
+	}
+
+	if len(pushed) == 0 {
+		return nil
+	}
+
+	filename := lockFilename()
+
+	lock, err := loadImageLock(filename)
+	if err != nil {
+		return err
+	}
+
+	for tag, digest := range pushed {
+		lock.Images[tag] = digest
+	}
+
+	return lock.save(filename)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_updateImageLock(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "mach-lock")
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "mach.lock")
+	viper.Set("lock_file", filename)
+	defer viper.Set("lock_file", "")
+
+	ioutil.WriteFile(filename, []byte("images:\n  superterran/mach:node: sha256:old\n  superterran/mach:php: sha256:old\n"), 0644)
+
+	results := []*buildResult{
+		{Node: &buildNode{Tag: "superterran/mach:php"}, Build: &imageBuild{Digests: map[string]string{"superterran/mach:php": "sha256:new"}}},
+		{Node: &buildNode{Tag: "superterran/mach:base"}, Skipped: "stopped after an earlier failure"},
+	}
+
+	assert.NoError(t, updateImageLock(results))
+
+	content, _ := ioutil.ReadFile(filename)
+	assert.True(t, strings.HasPrefix(string(content), lockFileHeader))
+
+	lock, err := loadImageLock(filename)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"superterran/mach:node": "sha256:old",
+		"superterran/mach:php":  "sha256:new",
+	}, lock.Images, "tags that were not pushed keep their digest")
+}
+
+func Test_updateImageLockNothingPushed(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "mach-lock")
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "mach.lock")
+	viper.Set("lock_file", filename)
+	defer viper.Set("lock_file", "")
+
+	assert.NoError(t, updateImageLock([]*buildResult{{Node: &buildNode{Tag: "superterran/mach:php"}, Build: &imageBuild{}}}))
+
+	_, err := os.Stat(filename)
+	assert.True(t, os.IsNotExist(err), "no lock file should be written when nothing was pushed")
+}
+
+func Test_imageDigestTemplateFunc(t *testing.T) {
+
+	dir, _ := ioutil.TempDir("", "mach-lock")
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "mach.lock")
+	viper.Set("lock_file", filename)
+	defer viper.Set("lock_file", "")
+
+	DockerRegistry = "superterran/mach"
+
+	lock := &imageLock{Images: map[string]string{"superterran/mach:php-8.1": "sha256:abc"}}
+	assert.NoError(t, lock.save(filename))
+
+	out, err := renderTestTemplate(t, `{{ imageDigest "php:8.1" }} {{ imageDigest "superterran/mach:php-8.1" }}`, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:abc sha256:abc", out)
+
+	_, err = renderTestTemplate(t, `{{ imageDigest "node" }}`, nil, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "no digest for node")
+}
@@ -0,0 +1,201 @@
+// Cmd manifest reads the optional mach.image.yaml next to a Dockerfile, which tunes how the image is built
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	units "github.com/docker/go-units"
+	"gopkg.in/yaml.v3"
+)
+
+// ImageManifestFilename is the name of the per-image manifest, looked up in the directory of each Dockerfile
+var ImageManifestFilename string = "mach.image.yaml"
+
+// imageManifest declares build settings for the Dockerfiles in a directory. Anything under `variants` only
+// applies to the matching `Dockerfile-<variant>` and is merged over the top level settings, maps key by key,
+// while lists and single values replace the top level ones.
+type imageManifest struct {
+	Args   map[string]string `yaml:"args"`
+	Target string            `yaml:"target"`
+	Labels map[string]string `yaml:"labels"`
+	Tags   []string          `yaml:"tags"`
+	// TagTemplates replace the `tag_template` config for these images
+	TagTemplates []string `yaml:"tag_templates"`
+	// Repository is the repository these images are pushed to, instead of being tags in docker_registry
+	Repository string                   `yaml:"repository"`
+	Network    string                   `yaml:"network"`
+	ExtraHosts []string                 `yaml:"extra_hosts"`
+	ShmSize    string                   `yaml:"shm_size"`
+	Pull       string                   `yaml:"pull"`
+	Variants   map[string]imageManifest `yaml:"variants"`
+}
+
+// loadImageManifest reads the manifest for a Dockerfile and resolves the overrides for its variant. A missing
+// manifest is not an error, it just means the defaults are used.
+func loadImageManifest(filename string) (imageManifest, error) {
+
+	var manifest imageManifest
+
+	path := filepath.Join(filepath.Dir(filename), ImageManifestFilename)
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		manifest.Repository = configRepository(filename)
+		return manifest, nil
+	} else if err != nil {
+		return manifest, err
+	}
+
+	if err := yaml.Unmarshal(content, &manifest); err != nil {
+		return manifest, fmt.Errorf("%s: %v", path, err)
+	}
+
+	if override, ok := manifest.Variants[fileVariant(filename)]; ok {
+		manifest = manifest.merge(override)
+	}
+
+	manifest.Variants = nil
+
+	if manifest.Repository == "" {
+		manifest.Repository = configRepository(filename)
+	}
+
+	switch manifest.Pull {
+	case "", "always", "missing":
+	default:
+		return manifest, fmt.Errorf("%s: pull must be `always` or `missing`, not `%s`", path, manifest.Pull)
+	}
+
+	if manifest.ShmSize != "" {
+		if _, err := units.RAMInBytes(manifest.ShmSize); err != nil {
+			return manifest, fmt.Errorf("%s: invalid shm_size: %v", path, err)
+		}
+	}
+
+	return manifest, nil
+}
+
+// merge returns a copy of the manifest with the override laid over it
+func (m imageManifest) merge(override imageManifest) imageManifest {
+
+	merged := m
+	merged.Args = mergeStringMaps(m.Args, override.Args)
+	merged.Labels = mergeStringMaps(m.Labels, override.Labels)
+
+	if override.Tags != nil {
+		merged.Tags = override.Tags
+	}
+
+	if override.Repository != "" {
+		merged.Repository = override.Repository
+	}
+
+	if override.TagTemplates != nil {
+		merged.TagTemplates = override.TagTemplates
+	}
+
+	if override.ExtraHosts != nil {
+		merged.ExtraHosts = override.ExtraHosts
+	}
+
+	if override.Target != "" {
+		merged.Target = override.Target
+	}
+
+	if override.Network != "" {
+		merged.Network = override.Network
+	}
+
+	if override.ShmSize != "" {
+		merged.ShmSize = override.ShmSize
+	}
+
+	if override.Pull != "" {
+		merged.Pull = override.Pull
+	}
+
+	return merged
+}
+
+// apply copies the manifest settings into the options handed to the docker daemon
+func (m imageManifest) apply(opts *types.ImageBuildOptions) {
+
+	if len(m.Args) > 0 {
+		opts.BuildArgs = map[string]*string{}
+		for key, value := range m.Args {
+			value := value
+			opts.BuildArgs[key] = &value
+		}
+	}
+
+	opts.Target = m.Target
+	opts.Labels = m.Labels
+	opts.NetworkMode = m.Network
+	opts.ExtraHosts = m.ExtraHosts
+	opts.PullParent = m.Pull == "always"
+
+	if m.ShmSize != "" {
+		opts.ShmSize, _ = units.RAMInBytes(m.ShmSize)
+	}
+
+	opts.Tags = append(opts.Tags, m.extraTags()...)
+}
+
+// extraTags resolves the additional tags of the manifest. A tag on its own is a tag in the repository of the
+// image, or the configured registry, anything that looks like a full image reference is used as-is.
+func (m imageManifest) extraTags() []string {
+
+	var tags []string
+
+	repository := m.Repository
+	if repository == "" {
+		repository = DockerRegistry
+	}
+
+	for _, tag := range m.Tags {
+		if strings.ContainsAny(tag, "/:") || repository == "" {
+			tags = append(tags, tag)
+		} else {
+			tags = append(tags, repository+":"+tag)
+		}
+	}
+
+	return tags
+}
+
+// withExtraTags returns the tag for a Dockerfile along with the other tags from its tag templates, and any
+// extra tags its manifest declares
+func withExtraTags(filename string, mach_tag string) []string {
+
+	tags := []string{mach_tag}
+
+	if templateTags, err := imageTags(filename); err == nil {
+		tags = appendUnique(tags, templateTags...)
+	}
+
+	manifest, _ := loadImageManifest(filename)
+
+	return appendUnique(tags, manifest.extraTags()...)
+}
+
+func mergeStringMaps(base map[string]string, override map[string]string) map[string]string {
+
+	if len(base) == 0 && len(override) == 0 {
+		return base
+	}
+
+	merged := map[string]string{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range override {
+		merged[key] = value
+	}
+
+	return merged
+}
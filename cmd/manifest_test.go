@@ -0,0 +1,77 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_loadImageManifestMissing(t *testing.T) {
+
+	manifest, err := loadImageManifest("images/none/Dockerfile")
+
+	assert.NoError(t, err, "a missing manifest should not be an error")
+	assert.Empty(t, manifest.Args)
+}
+
+func Test_loadImageManifestVariant(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", ImageManifestFilename), []byte(`
+args:
+  PHP_VERSION: "8.1"
+  COMPOSER: "2"
+labels:
+  maintainer: mach
+tags: [php-latest]
+target: runtime
+shm_size: 1g
+pull: always
+variants:
+  go:
+    args:
+      PHP_VERSION: "7.4"
+    tags: []
+`), 0644)
+
+	base, err := loadImageManifest(filepath.Join(dir, "php", "Dockerfile"))
+	assert.NoError(t, err)
+
+	variant, err := loadImageManifest(filepath.Join(dir, "php", "Dockerfile-go"))
+	assert.NoError(t, err)
+
+	assert.Equal(t, "8.1", base.Args["PHP_VERSION"])
+	assert.Equal(t, "7.4", variant.Args["PHP_VERSION"], "variant args should override")
+	assert.Equal(t, "2", variant.Args["COMPOSER"], "variant args should be merged with the top level")
+	assert.Equal(t, []string{"superterran/mach:php", "superterran/mach:php-latest"}, withExtraTags(filepath.Join(dir, "php", "Dockerfile"), "superterran/mach:php"))
+	assert.Empty(t, variant.extraTags(), "variant tags should replace the top level tags")
+
+	opts := types.ImageBuildOptions{Tags: []string{"superterran/mach:php"}}
+	base.apply(&opts)
+
+	assert.Equal(t, "8.1", *opts.BuildArgs["PHP_VERSION"])
+	assert.Equal(t, "runtime", opts.Target)
+	assert.Equal(t, int64(1024*1024*1024), opts.ShmSize)
+	assert.True(t, opts.PullParent)
+	assert.Equal(t, "mach", opts.Labels["maintainer"])
+	assert.Equal(t, []string{"superterran/mach:php", "superterran/mach:php-latest"}, opts.Tags)
+}
+
+func Test_loadImageManifestInvalidPull(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", ImageManifestFilename), []byte("pull: sometimes\n"), 0644)
+
+	_, err := loadImageManifest(filepath.Join(dir, "php", "Dockerfile"))
+
+	assert.Error(t, err, "an unknown pull policy should be rejected")
+}
@@ -0,0 +1,851 @@
+// Cmd packages finds what is installed in an image, from its package databases and the lockfiles in it
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+)
+
+// maxPackageFileSize is the largest package database or lockfile read from an image
+const maxPackageFileSize = 64 << 20
+
+// rpmQueryFormat lists rpm packages a line each, rpm databases are read by running rpm in the image
+const rpmQueryFormat = "%{NAME}\t%{VERSION}-%{RELEASE}\t%{ARCH}\t%{LICENSE}\n"
+
+// lockfileTypes maps the lockfiles packages are read from to their package URL type
+var lockfileTypes = map[string]string{
+	"package-lock.json": "npm",
+	"yarn.lock":         "npm",
+	"composer.lock":     "composer",
+	"Gemfile.lock":      "gem",
+	"Pipfile.lock":      "pypi",
+	"poetry.lock":       "pypi",
+	"Cargo.lock":        "cargo",
+	"go.sum":            "golang",
+}
+
+// rpmDatabases are the files that mean an image has rpm packages
+var rpmDatabases = []string{
+	"/var/lib/rpm/Packages",
+	"/var/lib/rpm/Packages.db",
+	"/var/lib/rpm/rpmdb.sqlite",
+	"/usr/lib/sysimage/rpm/rpmdb.sqlite",
+}
+
+// imagePackage is a package installed in an image
+type imagePackage struct {
+	Name    string
+	Version string
+	// Type is the package URL type, like `deb` or `npm`
+	Type    string
+	Arch    string
+	License string
+	// Origin is the source package an OS package was built from, which advisories are written against
+	Origin string
+	// Source is the file in the image the package was found in
+	Source string
+}
+
+// osRelease is the distribution of an image, from /etc/os-release
+type osRelease struct {
+	ID         string
+	VersionID  string
+	PrettyName string
+}
+
+// imageContents is what was found in the filesystem of an image
+type imageContents struct {
+	OS       osRelease
+	Packages []imagePackage
+	// files holds the package databases and lockfiles, by absolute path
+	files map[string][]byte
+}
+
+// purl returns the package URL of a package, `pkg:deb/debian/curl@7.74.0-1.3?arch=amd64`
+func (p imagePackage) purl(release osRelease) string {
+
+	var namespace string
+	name := p.Name
+
+	switch p.Type {
+	case "deb", "rpm", "apk":
+		namespace = release.ID
+	case "npm":
+		if strings.HasPrefix(name, "@") && strings.Contains(name, "/") {
+			parts := strings.SplitN(name, "/", 2)
+			namespace = strings.Replace(parts[0], "@", "%40", 1)
+			name = parts[1]
+		}
+	case "composer", "golang":
+		if i := strings.LastIndex(name, "/"); i >= 0 {
+			namespace = name[:i]
+			name = name[i+1:]
+		}
+	}
+
+	purl := "pkg:" + p.Type + "/"
+	if namespace != "" {
+		purl += namespace + "/"
+	}
+	purl += url.PathEscape(name)
+
+	if p.Version != "" {
+		purl += "@" + url.PathEscape(p.Version)
+	}
+
+	var qualifiers []string
+	if p.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(p.Arch))
+	}
+	if release.VersionID != "" && (p.Type == "deb" || p.Type == "rpm" || p.Type == "apk") {
+		qualifiers = append(qualifiers, "distro="+url.QueryEscape(release.ID+"-"+release.VersionID))
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+
+	return purl
+}
+
+// packageFileKind returns what a file in an image is to the SBOM: `dpkg`, `apk`, `rpm`, `os-release`, or a
+// lockfile type, and empty for everything else
+func packageFileKind(name string) string {
+
+	switch {
+	case name == "/var/lib/dpkg/status" || strings.HasPrefix(name, "/var/lib/dpkg/status.d/"):
+		return "dpkg"
+	case name == "/lib/apk/db/installed":
+		return "apk"
+	case name == "/etc/os-release" || name == "/usr/lib/os-release":
+		return "os-release"
+	}
+
+	for _, db := range rpmDatabases {
+		if name == db {
+			return "rpm"
+		}
+	}
+
+	// npm keeps a copy of the lockfile in node_modules, and dependencies ship their own
+	if strings.Contains(name, "/node_modules/") || strings.HasPrefix(name, "/proc/") || strings.HasPrefix(name, "/sys/") {
+		return ""
+	}
+
+	return lockfileTypes[path.Base(name)]
+}
+
+// readImageContents reads the package databases and lockfiles from an image exported with ImageSave, the
+// layers are laid over each other the way the image's filesystem is, whiteouts and all.
+func readImageContents(r io.Reader) (*imageContents, error) {
+
+	var manifest []struct {
+		Layers []string
+	}
+
+	layers := map[string]*layerFiles{}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if header.Name == "manifest.json" {
+			if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+				return nil, fmt.Errorf("manifest.json: %v", err)
+			}
+			continue
+		}
+
+		layer, err := readLayerFiles(tr)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", header.Name, err)
+		}
+
+		if layer != nil {
+			layers[header.Name] = layer
+		}
+	}
+
+	if len(manifest) == 0 {
+		return nil, fmt.Errorf("no manifest.json in the exported image")
+	}
+
+	contents := &imageContents{files: map[string][]byte{}}
+
+	for _, name := range manifest[0].Layers {
+		layer, ok := layers[name]
+		if !ok {
+			return nil, fmt.Errorf("layer %s is missing from the exported image", name)
+		}
+		layer.applyTo(contents.files)
+	}
+
+	contents.OS = parseOSRelease(contents.files)
+
+	return contents, nil
+}
+
+// layerFiles is what a layer adds and removes
+type layerFiles struct {
+	files     map[string][]byte
+	whiteouts []string
+	opaque    []string
+}
+
+// readLayerFiles reads the package files from a layer, it returns nil for anything that isn't a layer
+func readLayerFiles(r io.Reader) (*layerFiles, error) {
+
+	br := bufio.NewReaderSize(r, 1024)
+
+	magic, _ := br.Peek(512)
+
+	var layer io.Reader = br
+	switch {
+	case len(magic) >= 2 && magic[0] == 0x1f && magic[1] == 0x8b:
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		layer = gz
+	case len(magic) < 262 || string(magic[257:262]) != "ustar":
+		return nil, nil
+	}
+
+	files := &layerFiles{files: map[string][]byte{}}
+
+	tr := tar.NewReader(layer)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		name := path.Clean("/" + header.Name)
+		dir, base := path.Split(name)
+
+		switch {
+		case base == ".wh..wh..opq":
+			files.opaque = append(files.opaque, path.Clean(dir))
+			continue
+		case strings.HasPrefix(base, ".wh."):
+			files.whiteouts = append(files.whiteouts, path.Join(dir, strings.TrimPrefix(base, ".wh.")))
+			continue
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		switch packageFileKind(name) {
+		case "":
+			continue
+		case "rpm":
+			// the database is read by rpm itself, all that matters is that it is there
+			files.files[name] = nil
+			continue
+		}
+
+		content, err := ioutil.ReadAll(io.LimitReader(tr, maxPackageFileSize))
+		if err != nil {
+			return nil, err
+		}
+		files.files[name] = content
+	}
+
+	return files, nil
+}
+
+// applyTo lays the layer over the files of the layers below it
+func (l *layerFiles) applyTo(files map[string][]byte) {
+
+	removed := append(append([]string{}, l.opaque...), l.whiteouts...)
+
+	for name := range files {
+		for _, gone := range removed {
+			if name == gone || strings.HasPrefix(name, strings.TrimSuffix(gone, "/")+"/") {
+				delete(files, name)
+				break
+			}
+		}
+	}
+
+	for name, content := range l.files {
+		files[name] = content
+	}
+}
+
+// hasRPMDatabase reports if the image has rpm packages installed
+func (c *imageContents) hasRPMDatabase() bool {
+
+	for _, db := range rpmDatabases {
+		if _, ok := c.files[db]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readPackages parses every package database and lockfile found in the image, in path order
+func (c *imageContents) readPackages() error {
+
+	var names []string
+	for name := range c.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var packages []imagePackage
+		var err error
+
+		content := c.files[name]
+
+		switch kind := packageFileKind(name); kind {
+		case "dpkg":
+			packages = parseDpkgStatus(content)
+		case "apk":
+			packages = parseApkInstalled(content)
+		case "", "rpm", "os-release":
+			continue
+		default:
+			packages, err = parseLockfile(path.Base(name), content)
+		}
+
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+
+		for i := range packages {
+			packages[i].Source = name
+		}
+
+		c.Packages = append(c.Packages, packages...)
+	}
+
+	return nil
+}
+
+// readRPMPackages lists the rpm packages of an image by running rpm in a container of it
+func (c *imageContents) readRPMPackages(ctx context.Context, cli client.APIClient, image string) error {
+
+	return withContainer(ctx, cli, image, testKeepAlive, true, func(id string) error {
+		result, err := execInContainer(ctx, cli, id, []string{"rpm", "-qa", "--qf", rpmQueryFormat}, "root")
+		if err != nil {
+			return err
+		}
+
+		if result.ExitCode != 0 {
+			return fmt.Errorf("rpm -qa exited with %d: %s", result.ExitCode, strings.TrimSpace(result.Stderr))
+		}
+
+		c.Packages = append(c.Packages, parseRPMList(result.Stdout)...)
+
+		return nil
+	})
+}
+
+// readImagePackages exports an image from the local daemon and finds the packages in it, the rpm database is
+// read by running rpm in a container of the image. That takes an image that can run rpm, so when it can't
+// the rpm packages are left out with a warning, rather than failing the whole image.
+func readImagePackages(ctx context.Context, cli client.APIClient, tag string) (*imageContents, error) {
+
+	saved, err := cli.ImageSave(ctx, []string{tag})
+	if err != nil {
+		return nil, err
+	}
+	defer saved.Close()
+
+	contents, err := readImageContents(saved)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := contents.readPackages(); err != nil {
+		return nil, err
+	}
+
+	if contents.hasRPMDatabase() {
+		if err := contents.readRPMPackages(ctx, cli, tag); err != nil {
+			color.New(color.FgYellow).Fprintf(os.Stderr, "warning: %s: the rpm packages are left out, they could not be read: %v\n", tag, err)
+		}
+	}
+
+	return contents, nil
+}
+
+// parseOSRelease reads the distribution from os-release, /etc/os-release wins over /usr/lib/os-release
+func parseOSRelease(files map[string][]byte) osRelease {
+
+	var release osRelease
+
+	content, ok := files["/etc/os-release"]
+	if !ok {
+		content = files["/usr/lib/os-release"]
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		parts := strings.SplitN(strings.TrimSpace(line), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.Trim(parts[1], `"'`)
+		switch parts[0] {
+		case "ID":
+			release.ID = value
+		case "VERSION_ID":
+			release.VersionID = value
+		case "PRETTY_NAME":
+			release.PrettyName = value
+		}
+	}
+
+	return release
+}
+
+// parseStanzas splits a dpkg or apk database into its entries, each a map of field to value. Continuation
+// lines of a field are left out, nothing read here spans lines.
+func parseStanzas(content []byte, separator string) []map[string]string {
+
+	var stanzas []map[string]string
+	current := map[string]string{}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if strings.TrimSpace(line) == "" {
+			if len(current) > 0 {
+				stanzas = append(stanzas, current)
+				current = map[string]string{}
+			}
+			continue
+		}
+
+		if strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t") {
+			continue
+		}
+
+		parts := strings.SplitN(line, separator, 2)
+		if len(parts) == 2 {
+			current[parts[0]] = strings.TrimSpace(parts[1])
+		}
+	}
+
+	if len(current) > 0 {
+		stanzas = append(stanzas, current)
+	}
+
+	return stanzas
+}
+
+// parseDpkgStatus reads the installed packages from a dpkg status file
+func parseDpkgStatus(content []byte) []imagePackage {
+
+	var packages []imagePackage
+
+	for _, stanza := range parseStanzas(content, ":") {
+		if stanza["Package"] == "" {
+			continue
+		}
+
+		// distroless images have no Status, the files in status.d are all installed
+		if status, ok := stanza["Status"]; ok && !strings.HasSuffix(status, " installed") {
+			continue
+		}
+
+		// Source is the source package when it is named differently, with its version when that differs too
+		origin := strings.Fields(stanza["Source"])
+		if len(origin) == 0 {
+			origin = []string{stanza["Package"]}
+		}
+
+		packages = append(packages, imagePackage{Name: stanza["Package"], Version: stanza["Version"], Type: "deb", Arch: stanza["Architecture"], Origin: origin[0]})
+	}
+
+	return packages
+}
+
+// parseApkInstalled reads the installed packages from the apk database
+func parseApkInstalled(content []byte) []imagePackage {
+
+	var packages []imagePackage
+
+	for _, stanza := range parseStanzas(content, ":") {
+		if stanza["P"] == "" {
+			continue
+		}
+
+		origin := stanza["o"]
+		if origin == "" {
+			origin = stanza["P"]
+		}
+
+		packages = append(packages, imagePackage{Name: stanza["P"], Version: stanza["V"], Type: "apk", Arch: stanza["A"], License: stanza["L"], Origin: origin})
+	}
+
+	return packages
+}
+
+// parseRPMList reads the packages listed by rpm with rpmQueryFormat
+func parseRPMList(output string) []imagePackage {
+
+	var packages []imagePackage
+
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Split(strings.TrimRight(line, "\r"), "\t")
+		if len(fields) < 4 || fields[0] == "" || fields[0] == "gpg-pubkey" {
+			continue
+		}
+
+		arch := fields[2]
+		if arch == "(none)" {
+			arch = ""
+		}
+
+		packages = append(packages, imagePackage{Name: fields[0], Version: fields[1], Type: "rpm", Arch: arch, License: fields[3]})
+	}
+
+	return packages
+}
+
+// parseLockfile reads the packages pinned by a lockfile
+func parseLockfile(name string, content []byte) ([]imagePackage, error) {
+
+	switch name {
+	case "package-lock.json":
+		return parsePackageLock(content)
+	case "yarn.lock":
+		return parseYarnLock(content), nil
+	case "composer.lock":
+		return parseComposerLock(content)
+	case "Gemfile.lock":
+		return parseGemfileLock(content), nil
+	case "Pipfile.lock":
+		return parsePipfileLock(content)
+	case "poetry.lock", "Cargo.lock":
+		return parseTOMLPackages(content, lockfileTypes[name]), nil
+	case "go.sum":
+		return parseGoSum(content), nil
+	}
+
+	return nil, nil
+}
+
+func parsePackageLock(content []byte) ([]imagePackage, error) {
+
+	type dependency struct {
+		Version      string                `json:"version"`
+		License      string                `json:"license"`
+		Dependencies map[string]dependency `json:"dependencies"`
+	}
+
+	var lock struct {
+		Packages     map[string]dependency `json:"packages"`
+		Dependencies map[string]dependency `json:"dependencies"`
+	}
+
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var packages []imagePackage
+
+	add := func(name string, dep dependency) {
+		key := name + "@" + dep.Version
+		if name == "" || dep.Version == "" || seen[key] {
+			return
+		}
+		seen[key] = true
+		packages = append(packages, imagePackage{Name: name, Version: dep.Version, Type: "npm", License: dep.License})
+	}
+
+	// lockfile version 2 and up list every package by its path in node_modules
+	if len(lock.Packages) > 0 {
+		for location, dep := range lock.Packages {
+			i := strings.LastIndex(location, "node_modules/")
+			if i < 0 {
+				continue
+			}
+			add(location[i+len("node_modules/"):], dep)
+		}
+	} else {
+		var walk func(deps map[string]dependency)
+		walk = func(deps map[string]dependency) {
+			for name, dep := range deps {
+				add(name, dep)
+				walk(dep.Dependencies)
+			}
+		}
+		walk(lock.Dependencies)
+	}
+
+	sortPackages(packages)
+
+	return packages, nil
+}
+
+// parseYarnLock reads both the classic yarn.lock format and the yaml one of yarn 2 and up
+func parseYarnLock(content []byte) []imagePackage {
+
+	seen := map[string]bool{}
+	var packages []imagePackage
+	var name string
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.HasPrefix(line, " ") {
+			// `"@babel/core@^7.0.0", "@babel/core@^7.1.0":` or `"lodash@npm:^4.17.21":`
+			spec := strings.Trim(strings.TrimSpace(strings.SplitN(strings.TrimSuffix(line, ":"), ",", 2)[0]), `"`)
+			name = ""
+			if i := strings.LastIndex(spec, "@"); i > 0 {
+				name = spec[:i]
+			}
+			name = strings.TrimSuffix(name, "@npm")
+			if strings.HasPrefix(spec, "__metadata") {
+				name = ""
+			}
+			continue
+		}
+
+		field := strings.TrimSpace(line)
+		if name == "" || !strings.HasPrefix(field, "version") || strings.HasPrefix(line, "    ") {
+			continue
+		}
+
+		version := strings.Trim(strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(field, "version"), ":")), `"`)
+		if key := name + "@" + version; !seen[key] {
+			seen[key] = true
+			packages = append(packages, imagePackage{Name: name, Version: version, Type: "npm"})
+		}
+		name = ""
+	}
+
+	return packages
+}
+
+func parseComposerLock(content []byte) ([]imagePackage, error) {
+
+	type composerPackage struct {
+		Name    string   `json:"name"`
+		Version string   `json:"version"`
+		License []string `json:"license"`
+	}
+
+	var lock struct {
+		Packages    []composerPackage `json:"packages"`
+		PackagesDev []composerPackage `json:"packages-dev"`
+	}
+
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+
+	var packages []imagePackage
+	for _, pkg := range append(lock.Packages, lock.PackagesDev...) {
+		packages = append(packages, imagePackage{Name: pkg.Name, Version: pkg.Version, Type: "composer", License: strings.Join(pkg.License, " OR ")})
+	}
+
+	return packages, nil
+}
+
+// parseGemfileLock reads the gems from the specs of the GEM section, the lines indented more are dependencies
+func parseGemfileLock(content []byte) []imagePackage {
+
+	var packages []imagePackage
+	var inSpecs bool
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimRight(line, "\r")
+
+		if !strings.HasPrefix(line, " ") {
+			inSpecs = false
+			continue
+		}
+
+		if strings.TrimSpace(line) == "specs:" {
+			inSpecs = true
+			continue
+		}
+
+		if !inSpecs || !strings.HasPrefix(line, "    ") || strings.HasPrefix(line, "     ") {
+			continue
+		}
+
+		fields := strings.SplitN(strings.TrimSpace(line), " ", 2)
+		if len(fields) == 2 {
+			packages = append(packages, imagePackage{Name: fields[0], Version: strings.Trim(fields[1], "()"), Type: "gem"})
+		}
+	}
+
+	return packages
+}
+
+func parsePipfileLock(content []byte) ([]imagePackage, error) {
+
+	var lock struct {
+		Default map[string]struct {
+			Version string `json:"version"`
+		} `json:"default"`
+		Develop map[string]struct {
+			Version string `json:"version"`
+		} `json:"develop"`
+	}
+
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+
+	var packages []imagePackage
+	for name, pkg := range lock.Default {
+		packages = append(packages, imagePackage{Name: name, Version: strings.TrimPrefix(pkg.Version, "=="), Type: "pypi"})
+	}
+	for name, pkg := range lock.Develop {
+		packages = append(packages, imagePackage{Name: name, Version: strings.TrimPrefix(pkg.Version, "=="), Type: "pypi"})
+	}
+
+	sortPackages(packages)
+
+	return packages, nil
+}
+
+// parseTOMLPackages reads the `[[package]]` tables of poetry.lock and Cargo.lock
+func parseTOMLPackages(content []byte, packageType string) []imagePackage {
+
+	var packages []imagePackage
+	var current *imagePackage
+
+	flush := func() {
+		if current != nil && current.Name != "" {
+			packages = append(packages, *current)
+		}
+		current = nil
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "[") {
+			flush()
+			if line == "[[package]]" {
+				current = &imagePackage{Type: packageType}
+			}
+			continue
+		}
+
+		if current == nil {
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		switch strings.TrimSpace(parts[0]) {
+		case "name":
+			current.Name = value
+		case "version":
+			current.Version = value
+		}
+	}
+
+	flush()
+
+	return packages
+}
+
+// parseGoSum reads the modules of a go.sum, the lines for just their go.mod are left out
+func parseGoSum(content []byte) []imagePackage {
+
+	seen := map[string]bool{}
+	var packages []imagePackage
+
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || strings.HasSuffix(fields[1], "/go.mod") {
+			continue
+		}
+
+		if key := fields[0] + "@" + fields[1]; !seen[key] {
+			seen[key] = true
+			packages = append(packages, imagePackage{Name: fields[0], Version: fields[1], Type: "golang"})
+		}
+	}
+
+	return packages
+}
+
+func sortPackages(packages []imagePackage) {
+
+	sort.Slice(packages, func(i, j int) bool {
+		if packages[i].Name != packages[j].Name {
+			return packages[i].Name < packages[j].Name
+		}
+		return packages[i].Version < packages[j].Version
+	})
+}
+
+// describe returns a one line summary of what was found, for the build output
+func (c *imageContents) describe() string {
+
+	counts := map[string]int{}
+	for _, pkg := range c.Packages {
+		counts[pkg.Type]++
+	}
+
+	var types []string
+	for packageType := range counts {
+		types = append(types, packageType)
+	}
+	sort.Strings(types)
+
+	var buff bytes.Buffer
+	fmt.Fprintf(&buff, "%d packages", len(c.Packages))
+	for i, packageType := range types {
+		if i == 0 {
+			buff.WriteString(" (")
+		} else {
+			buff.WriteString(", ")
+		}
+		fmt.Fprintf(&buff, "%d %s", counts[packageType], packageType)
+		if i == len(types)-1 {
+			buff.WriteString(")")
+		}
+	}
+
+	return buff.String()
+}
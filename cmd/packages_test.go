@@ -0,0 +1,220 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testLayer builds a layer tarball from file contents by path, gzipped when asked
+func testLayer(t *testing.T, files map[string]string, gzipped bool) []byte {
+
+	var buff bytes.Buffer
+	tw := tar.NewWriter(&buff)
+
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			assert.FailNow(t, err.Error())
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+
+	if !gzipped {
+		return buff.Bytes()
+	}
+
+	var zipped bytes.Buffer
+	gz := gzip.NewWriter(&zipped)
+	gz.Write(buff.Bytes())
+	gz.Close()
+
+	return zipped.Bytes()
+}
+
+// testSavedImage builds what ImageSave returns for an image with the layers given, bottom first
+func testSavedImage(t *testing.T, layers ...[]byte) *bytes.Buffer {
+
+	var names []string
+	files := map[string][]byte{"config.json": []byte(`{"architecture": "amd64"}`)}
+
+	for i, layer := range layers {
+		name := fmt.Sprintf("layer%d/layer.tar", i)
+		names = append(names, name)
+		files[name] = layer
+	}
+
+	manifest, _ := json.Marshal([]map[string]interface{}{{"Config": "config.json", "Layers": names}})
+	files["manifest.json"] = manifest
+
+	var buff bytes.Buffer
+	tw := tar.NewWriter(&buff)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		tw.Write(content)
+	}
+	tw.Close()
+
+	return &buff
+}
+
+func Test_readImageContents(t *testing.T) {
+
+	saved := testSavedImage(t,
+		testLayer(t, map[string]string{
+			"etc/os-release":                       "ID=debian\nVERSION_ID=\"11\"\nPRETTY_NAME=\"Debian GNU/Linux 11 (bullseye)\"\n",
+			"var/lib/dpkg/status":                  "Package: base-files\nStatus: install ok installed\nVersion: 11.1\nArchitecture: amd64\n",
+			"app/old/composer.lock":                `{"packages": [{"name": "monolog/monolog", "version": "2.0.0"}]}`,
+			"app/node_modules/x/package-lock.json": `{"packages": {"node_modules/left-pad": {"version": "1.0.0"}}}`,
+			"usr/bin/curl":                         "binary",
+		}, false),
+		testLayer(t, map[string]string{
+			"var/lib/dpkg/status":   "Package: base-files\nStatus: install ok installed\nVersion: 11.1\nArchitecture: amd64\n\nPackage: libcurl4\nStatus: install ok installed\nSource: curl\nVersion: 7.74.0-1.3\nArchitecture: amd64\n\nPackage: removed\nStatus: deinstall ok config-files\nVersion: 1\n",
+			"app/.wh.old":           "",
+			"app/package-lock.json": `{"packages": {"": {"name": "app"}, "node_modules/@babel/core": {"version": "7.18.0", "license": "MIT"}}}`,
+		}, true),
+	)
+
+	contents, err := readImageContents(saved)
+	assert.NoError(t, err)
+
+	assert.Equal(t, osRelease{ID: "debian", VersionID: "11", PrettyName: "Debian GNU/Linux 11 (bullseye)"}, contents.OS)
+	assert.NotContains(t, contents.files, "/app/old/composer.lock", "a whiteout removes files of the layers below")
+	assert.NotContains(t, contents.files, "/app/node_modules/x/package-lock.json")
+	assert.False(t, contents.hasRPMDatabase())
+
+	assert.NoError(t, contents.readPackages())
+	assert.Equal(t, []imagePackage{
+		{Name: "@babel/core", Version: "7.18.0", Type: "npm", License: "MIT", Source: "/app/package-lock.json"},
+		{Name: "base-files", Version: "11.1", Type: "deb", Arch: "amd64", Origin: "base-files", Source: "/var/lib/dpkg/status"},
+		{Name: "libcurl4", Version: "7.74.0-1.3", Type: "deb", Arch: "amd64", Origin: "curl", Source: "/var/lib/dpkg/status"},
+	}, contents.Packages)
+
+	assert.Equal(t, "3 packages (2 deb, 1 npm)", contents.describe())
+
+	_, err = readImageContents(bytes.NewBufferString("not a tarball"))
+	assert.Error(t, err)
+}
+
+func Test_layerOpaqueDirectory(t *testing.T) {
+
+	contents, err := readImageContents(testSavedImage(t,
+		testLayer(t, map[string]string{"srv/a/yarn.lock": "", "srv/b/yarn.lock": "", "var/lib/rpm/rpmdb.sqlite": "db"}, false),
+		testLayer(t, map[string]string{"srv/a/.wh..wh..opq": ""}, false),
+	))
+
+	assert.NoError(t, err)
+	assert.NotContains(t, contents.files, "/srv/a/yarn.lock")
+	assert.Contains(t, contents.files, "/srv/b/yarn.lock")
+	assert.True(t, contents.hasRPMDatabase())
+}
+
+func Test_parseApkInstalled(t *testing.T) {
+
+	actual := parseApkInstalled([]byte("C:Q1abc=\nP:musl\nV:1.2.3-r0\nA:x86_64\nL:MIT\n\nP:ssl_client\nV:1.35.0-r17\nA:x86_64\nL:GPL-2.0-only\no:busybox\n"))
+
+	assert.Equal(t, []imagePackage{
+		{Name: "musl", Version: "1.2.3-r0", Type: "apk", Arch: "x86_64", License: "MIT", Origin: "musl"},
+		{Name: "ssl_client", Version: "1.35.0-r17", Type: "apk", Arch: "x86_64", License: "GPL-2.0-only", Origin: "busybox"},
+	}, actual)
+}
+
+func Test_parseRPMList(t *testing.T) {
+
+	actual := parseRPMList("bash\t5.1.8-4.el9\tx86_64\tGPLv3+\ngpg-pubkey\t8483c65d-5ccc5b19\t(none)\tpubkey\ntzdata\t2022a-1.el9\tnoarch\tPublic Domain\n")
+
+	assert.Equal(t, []imagePackage{
+		{Name: "bash", Version: "5.1.8-4.el9", Type: "rpm", Arch: "x86_64", License: "GPLv3+"},
+		{Name: "tzdata", Version: "2022a-1.el9", Type: "rpm", Arch: "noarch", License: "Public Domain"},
+	}, actual)
+}
+
+func Test_parseLockfiles(t *testing.T) {
+
+	packages := func(name string, content string) []string {
+		parsed, err := parseLockfile(name, []byte(content))
+		assert.NoError(t, err, name)
+
+		var names []string
+		for _, pkg := range parsed {
+			names = append(names, pkg.Type+":"+pkg.Name+"@"+pkg.Version)
+		}
+		return names
+	}
+
+	assert.Equal(t, []string{"npm:a@1.0.0", "npm:b@2.0.0"}, packages("package-lock.json",
+		`{"lockfileVersion": 1, "dependencies": {"a": {"version": "1.0.0", "dependencies": {"b": {"version": "2.0.0"}}}}}`))
+
+	assert.Equal(t, []string{"npm:@babel/core@7.18.0", "npm:lodash@4.17.21", "npm:left-pad@1.3.0"}, packages("yarn.lock", `# yarn lockfile v1
+
+"@babel/core@^7.0.0", "@babel/core@^7.1.0":
+  version "7.18.0"
+  dependencies:
+    lodash "^4.17.0"
+
+lodash@^4.17.0:
+  version "4.17.21"
+
+__metadata:
+  version: 6
+
+"left-pad@npm:^1.3.0":
+  version: 1.3.0
+`))
+
+	assert.Equal(t, []string{"composer:monolog/monolog@2.8.0", "composer:phpunit/phpunit@9.5.0"}, packages("composer.lock",
+		`{"packages": [{"name": "monolog/monolog", "version": "2.8.0", "license": ["MIT"]}], "packages-dev": [{"name": "phpunit/phpunit", "version": "9.5.0"}]}`))
+
+	assert.Equal(t, []string{"gem:rack@2.2.4", "gem:rails@7.0.3"}, packages("Gemfile.lock", `GEM
+  remote: https://rubygems.org/
+  specs:
+    rack (2.2.4)
+    rails (7.0.3)
+      rack (>= 2.2)
+
+PLATFORMS
+  ruby
+
+DEPENDENCIES
+  rails
+`))
+
+	assert.Equal(t, []string{"pypi:pytest@7.1.2", "pypi:requests@2.28.1"}, packages("Pipfile.lock",
+		`{"default": {"requests": {"version": "==2.28.1"}}, "develop": {"pytest": {"version": "==7.1.2"}}}`))
+
+	assert.Equal(t, []string{"cargo:serde@1.0.140", "cargo:app@0.1.0"}, packages("Cargo.lock", `version = 3
+
+[[package]]
+name = "serde"
+version = "1.0.140"
+source = "registry+https://github.com/rust-lang/crates.io-index"
+
+[[package]]
+name = "app"
+version = "0.1.0"
+dependencies = [
+ "serde",
+]
+`))
+
+	assert.Equal(t, []string{"golang:github.com/spf13/cobra@v1.5.0"}, packages("go.sum", `github.com/spf13/cobra v1.5.0 h1:abc=
+github.com/spf13/cobra v1.5.0/go.mod h1:def=
+github.com/spf13/pflag v1.0.5/go.mod h1:ghi=
+`))
+}
+
+func Test_purl(t *testing.T) {
+
+	debian := osRelease{ID: "debian", VersionID: "11"}
+
+	assert.Equal(t, "pkg:deb/debian/curl@7.74.0-1.3?arch=amd64&distro=debian-11", imagePackage{Name: "curl", Version: "7.74.0-1.3", Type: "deb", Arch: "amd64"}.purl(debian))
+	assert.Equal(t, "pkg:npm/%40babel/core@7.18.0", imagePackage{Name: "@babel/core", Version: "7.18.0", Type: "npm"}.purl(debian))
+	assert.Equal(t, "pkg:composer/monolog/monolog@2.8.0", imagePackage{Name: "monolog/monolog", Version: "2.8.0", Type: "composer"}.purl(debian))
+	assert.Equal(t, "pkg:golang/github.com/spf13/cobra@v1.5.0", imagePackage{Name: "github.com/spf13/cobra", Version: "v1.5.0", Type: "golang"}.purl(debian))
+	assert.Equal(t, "pkg:gem/rack", imagePackage{Name: "rack", Type: "gem"}.purl(debian))
+}
@@ -0,0 +1,210 @@
+// Cmd plan shows what a build would do, without building, pushing or talking to the docker daemon
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+)
+
+// Plan prints the build plan instead of building, as a `table` or `json`, set with `--plan`
+var Plan string = ""
+
+// The status of an image in a build plan
+const (
+	planBuild     = "build"
+	planUpToDate  = "up-to-date"
+	planUnchecked = "unchecked"
+	planFailed    = "failed"
+)
+
+// buildPlan is what a build would do, in build order
+type buildPlan struct {
+	Images []*plannedImage `json:"images"`
+}
+
+// plannedImage is what a build would do with a single image. Status is `up-to-date` when the registry has an
+// image with the same content hash, and `unchecked` when the registry isn't looked at, in which case the local
+// daemon may still have it. It is `failed` when the Dockerfile can't be rendered, with the Error.
+type plannedImage struct {
+	Order       int           `json:"order"`
+	Dockerfile  string        `json:"dockerfile"`
+	Tags        []string      `json:"tags"`
+	After       []string      `json:"after,omitempty"`
+	Pushes      []plannedPush `json:"pushes"`
+	ContentHash string        `json:"content_hash"`
+	Status      string        `json:"status"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// plannedPush is a tag that would be pushed, and the target it would go to
+type plannedPush struct {
+	Target string `json:"target"`
+	Tag    string `json:"tag"`
+}
+
+// newBuildPlan works out what a build of the nodes would do, the registry is only asked about content
+// hashes with CheckRegistry.
+func newBuildPlan(nodes []*buildNode, targets []pushTarget) (*buildPlan, error) {
+
+	if len(targets) == 0 {
+		targets = []pushTarget{{Name: DockerRegistry}}
+	}
+
+	plan := &buildPlan{Images: []*plannedImage{}}
+
+	for i, node := range nodes {
+		image := &plannedImage{
+			Order:      i + 1,
+			Dockerfile: node.Filename,
+			Tags:       withExtraTags(node.Filename, node.Tag),
+			Pushes:     []plannedPush{},
+			Status:     planUnchecked,
+		}
+
+		for _, parent := range node.Parents {
+			image.After = append(image.After, parent.Filename)
+		}
+
+		if node.Err != nil {
+			image.Status, image.Error = planFailed, node.Err.Error()
+			plan.Images = append(plan.Images, image)
+			continue
+		}
+
+		hash, err := node.ContentHash()
+		if err != nil {
+			return nil, err
+		}
+		image.ContentHash = hash
+
+		switch {
+		case Force:
+			image.Status = planBuild
+		case CheckRegistry && registryHasContentHash(node.Tag, hash):
+			image.Status = planUpToDate
+		case CheckRegistry:
+			image.Status = planBuild
+		}
+
+		if !Nopush && !pushesNowhere(node.Filename) && image.Status != planUpToDate {
+			foreign := foreignTags(node.Filename)
+			for _, tag := range image.Tags {
+				if foreign[tag] {
+					image.Pushes = append(image.Pushes, plannedPush{Target: repositoryOf(tag), Tag: tag})
+				}
+			}
+			for _, target := range targets {
+				for _, tag := range image.Tags {
+					if !foreign[tag] && target.matches(tagName(tag)) {
+						image.Pushes = append(image.Pushes, plannedPush{Target: target.name(), Tag: target.targetRef(tag)})
+					}
+				}
+			}
+		}
+
+		plan.Images = append(plan.Images, image)
+	}
+
+	return plan, nil
+}
+
+// writeJSON writes the plan as indented JSON
+func (p *buildPlan) writeJSON(w io.Writer) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(p)
+}
+
+// writeTable writes the plan as a table with a row for every push, or every tag when nothing is pushed
+func (p *buildPlan) writeTable(w io.Writer) error {
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "#\tDOCKERFILE\tSTATUS\tTAG\tPUSH TO\tAFTER")
+
+	for _, image := range p.Images {
+		var rows [][2]string
+		for _, push := range image.Pushes {
+			rows = append(rows, [2]string{push.Tag, push.Target})
+		}
+		if len(rows) == 0 {
+			for _, tag := range image.Tags {
+				rows = append(rows, [2]string{tag, "-"})
+			}
+		}
+
+		// images built from several others need more rows than they have pushes
+		for len(rows) < len(image.After) {
+			rows = append(rows, [2]string{"", ""})
+		}
+
+		for i, row := range rows {
+			after := ""
+			if i < len(image.After) {
+				after = image.After[i]
+			}
+
+			if i == 0 {
+				if after == "" {
+					after = "-"
+				}
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", strconv.Itoa(image.Order), image.Dockerfile, image.Status, row[0], row[1], after)
+				continue
+			}
+
+			fmt.Fprintf(tw, "\t\t\t%s\t%s\t%s\n", row[0], row[1], after)
+		}
+	}
+
+	return tw.Flush()
+}
+
+// writeBuildPlan writes the plan for the nodes in the Plan format
+func writeBuildPlan(w io.Writer, nodes []*buildNode) error {
+
+	targets, err := pushTargets()
+	if err != nil {
+		return err
+	}
+
+	plan, err := newBuildPlan(nodes, targets)
+	if err != nil {
+		return err
+	}
+
+	switch Plan {
+	case "json":
+		err = plan.writeJSON(w)
+	case "table":
+		err = plan.writeTable(w)
+	default:
+		return checkPlanFormat(Plan)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	// the plan is written whole, but a Dockerfile that can't be rendered fails it
+	for _, node := range nodes {
+		if node.Err != nil {
+			return newBuildError(stageTemplate, node.Tag, node.Err)
+		}
+	}
+
+	return nil
+}
+
+func checkPlanFormat(format string) error {
+
+	if format != "table" && format != "json" {
+		return fmt.Errorf("unknown plan format %q, use table or json", format)
+	}
+
+	return nil
+}
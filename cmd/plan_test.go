@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newBuildPlan(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{
+		"base": "FROM alpine:3.16\n",
+		"app":  "FROM superterran/mach:base\n",
+	})
+	defer os.RemoveAll(dir)
+
+	BuildImageDirname = dir
+	defer func() { BuildImageDirname = "images" }()
+
+	DockerRegistry = "superterran/mach"
+	defer func() { DockerRegistry = "" }()
+
+	// other tests leave it set
+	Nopush = false
+
+	nodes, err := planBuildOrder(findDockerfiles(nil))
+	assert.NoError(t, err)
+
+	targets := []pushTarget{
+		{Name: "hub"},
+		{Name: "mirror", Host: "registry.example.com", Repository: "mirror/mach", Tags: []string{"app*"}},
+	}
+
+	plan, err := newBuildPlan(nodes, targets)
+	assert.NoError(t, err)
+	assert.Len(t, plan.Images, 2)
+
+	base, app := plan.Images[0], plan.Images[1]
+
+	assert.Equal(t, filepath.Join(dir, "base", "Dockerfile"), base.Dockerfile)
+	assert.Equal(t, 1, base.Order)
+	assert.Equal(t, []string{"superterran/mach:base"}, base.Tags)
+	assert.Equal(t, []plannedPush{{Target: "hub", Tag: "superterran/mach:base"}}, base.Pushes)
+	assert.Equal(t, planUnchecked, base.Status, "without --check-registry nothing is looked up")
+	assert.True(t, strings.HasPrefix(base.ContentHash, "sha256:"))
+
+	assert.Equal(t, 2, app.Order)
+	assert.Equal(t, []string{base.Dockerfile}, app.After)
+	assert.Equal(t, []plannedPush{
+		{Target: "hub", Tag: "superterran/mach:app"},
+		{Target: "mirror", Tag: "registry.example.com/mirror/mach:app"},
+	}, app.Pushes)
+
+	Nopush = true
+	Force = true
+	defer func() { Nopush = false; Force = false }()
+
+	plan, err = newBuildPlan(nodes, targets)
+	assert.NoError(t, err)
+	assert.Empty(t, plan.Images[0].Pushes)
+	assert.Equal(t, planBuild, plan.Images[0].Status)
+}
+
+func Test_writeBuildPlan(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"base": "FROM alpine:3.16\n"})
+	defer os.RemoveAll(dir)
+
+	BuildImageDirname = dir
+	defer func() { BuildImageDirname = "images" }()
+
+	viper.Set("push_targets", nil)
+
+	// without a docker registry nothing is pushed
+	defer func() { Nopush = false }()
+
+	nodes, err := planBuildOrder(findDockerfiles(nil))
+	assert.NoError(t, err)
+
+	Plan = "json"
+	defer func() { Plan = "" }()
+
+	var out bytes.Buffer
+	assert.NoError(t, writeBuildPlan(&out, nodes))
+
+	var plan buildPlan
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &plan))
+	assert.Len(t, plan.Images, 1)
+
+	Plan = "table"
+	out.Reset()
+	assert.NoError(t, writeBuildPlan(&out, nodes))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Regexp(t, `^#\s+DOCKERFILE\s+STATUS\s+TAG\s+PUSH TO\s+AFTER$`, lines[0])
+	assert.Contains(t, lines[1], "unchecked")
+
+	Plan = "yaml"
+	assert.Error(t, writeBuildPlan(&out, nodes))
+}
+
+func Test_writeBuildPlanTemplateError(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{
+		"base": "FROM alpine:3.16\n{{ if }}\n",
+		"app":  "FROM alpine:3.16\n",
+	})
+	defer os.RemoveAll(dir)
+
+	BuildImageDirname = dir
+	defer func() { BuildImageDirname = "images" }()
+
+	DockerRegistry = "superterran/mach"
+	defer func() { DockerRegistry = "" }()
+
+	nodes, err := planBuildOrder(findDockerfiles(nil))
+	assert.NoError(t, err)
+
+	Plan = "json"
+	defer func() { Plan = "" }()
+
+	var out bytes.Buffer
+	err = writeBuildPlan(&out, nodes)
+	assert.Equal(t, ExitTemplateFailure, exitCode(err), "a broken template fails the plan")
+
+	var plan buildPlan
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &plan), "after the whole plan is written")
+
+	if assert.Len(t, plan.Images, 2) {
+		assert.Equal(t, planFailed, plan.Images[1].Status)
+		assert.NotEmpty(t, plan.Images[1].Error)
+		assert.Equal(t, planUnchecked, plan.Images[0].Status)
+	}
+}
+
+func Test_buildPlanUnknownFormat(t *testing.T) {
+
+	// images that can't be planned show the format is checked before planning starts
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = writeTestImages(t, map[string]string{
+		"one": "FROM superterran/mach:two\n",
+		"two": "FROM superterran/mach:one\n",
+	})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "images" }()
+
+	Plan = "yaml"
+	defer func() { Plan = "" }()
+
+	assert.EqualError(t, MainBuildFlow(nil), `unknown plan format "yaml", use table or json`)
+}
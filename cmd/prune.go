@@ -0,0 +1,529 @@
+// Cmd prune deletes the tags of branches that are gone from the registry, and those outside the retention policy
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var pruneCmd = CreatePruneCmd()
+
+// PruneDryRun prints what would be pruned without deleting anything, set with `--dry-run`
+var PruneDryRun bool = false
+
+// PruneKeep is how many of the newest branch tags of each image are always kept, set with `prune_keep` in
+// config or `--keep`
+var PruneKeep int = 0
+
+// PruneMaxAge prunes branch tags older than this even when their branch is live, `720h` or `30d`. Set with
+// `prune_max_age` in config or `--max-age`
+var PruneMaxAge string = ""
+
+// PruneProtect are patterns of tags that are never pruned, like `*-hotfix-*`, set with `prune_protect` in config
+var PruneProtect []string
+
+// The markers are rendered into the tag templates in place of the parts that change from build to build, which
+// turns the tags into patterns matching every tag the template has produced.
+const (
+	pruneBranchMarker = "MACHPRUNEBRANCH"
+	pruneSHAMarker    = "MACHPRUNESHA"
+	pruneDateMarker   = "MACHPRUNEDATE"
+)
+
+var pruneMarkers = strings.NewReplacer(pruneBranchMarker, "(.+)", pruneSHAMarker, "[0-9a-f]{7}", pruneDateMarker, "[0-9]{8}")
+
+// tagHashSuffix is the hash sanitizeTag appends to tags it had to change
+var tagHashSuffix = regexp.MustCompile(`-[0-9a-f]{7}$`)
+
+// tagPattern matches the tags a tag template gives an image, on the default branch, or on any other branch
+// when Branch is set. The branch is then the first group of the pattern.
+type tagPattern struct {
+	Filename   string
+	Repository string
+	Branch     bool
+	// Unselected is set for the patterns of images that weren't asked for, they only keep the tags of those
+	// images from being taken for branch tags of the others
+	Unselected bool
+	pattern    *regexp.Regexp
+	// literal is the length of the tag outside of the markers, when patterns overlap the longest wins
+	literal int
+	// others are the branches the tags of other images in the repository would be on by this pattern, the
+	// `fpm` of `example-fpm` for `example-(.+)`, which are never taken for branches
+	others map[string]bool
+}
+
+// prunedTag is a branch tag in the registry
+type prunedTag struct {
+	Tag      string
+	Filename string
+	// Branch is the branch as it is in the tag, after sanitizeTag
+	Branch  string
+	Created time.Time
+	// Reason is why the tag is pruned, empty when it is kept
+	Reason string
+}
+
+func CreatePruneCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune [docker-image[:tag]]",
+		Short: "Deletes the tags of branches that no longer exist from the registry",
+		Long: `Lists the tags of the repositories the Dockerfiles are pushed to, picks out the tags built on a branch
+	by matching them against the tag templates, and deletes those of branches that are gone from the local git
+	repository, local and remote-tracking branches alike, so run it after a git fetch --prune. Branch tags older
+	than --max-age are deleted even when the branch is live, and the --keep newest branch tags of each image are
+	always kept. Tags of the default branch, releases and tags mach doesn't recognise are never touched.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runPrune(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+	pruneCmd.Flags().BoolVar(&PruneDryRun, "dry-run", PruneDryRun, "print the tags that would be deleted without deleting them")
+
+	pruneCmd.Flags().Int("keep", PruneKeep, "number of the newest branch tags of each image to always keep")
+	viper.SetDefault("prune_keep", PruneKeep)
+	viper.BindPFlag("prune_keep", pruneCmd.Flags().Lookup("keep"))
+
+	pruneCmd.Flags().String("max-age", PruneMaxAge, "delete branch tags older than this even when their branch is live, like 720h or 30d")
+	viper.SetDefault("prune_max_age", PruneMaxAge)
+	viper.BindPFlag("prune_max_age", pruneCmd.Flags().Lookup("max-age"))
+
+}
+
+func runPrune(cmd *cobra.Command, args []string) error {
+
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	DefaultGitBranch = viper.GetString("defaultGitBranch")
+
+	PruneKeep = viper.GetInt("prune_keep")
+
+	PruneMaxAge = viper.GetString("prune_max_age")
+
+	PruneProtect = viper.GetStringSlice("prune_protect")
+
+	return MainPruneFlow(nil, args)
+}
+
+// MainPruneFlow prunes the repositories of the Dockerfiles matching the arguments, or of every Dockerfile in
+// the build directory. Output goes to out, or the terminal when it is nil.
+func MainPruneFlow(out io.Writer, args []string) error {
+
+	maxAge, err := parseMaxAge(PruneMaxAge)
+	if err != nil {
+		return err
+	}
+
+	branches, err := liveBranches(".")
+	if err != nil {
+		return fmt.Errorf("prune tells live branches from the git repository in the working directory: %v", err)
+	}
+
+	selected := map[string]bool{}
+	for _, filename := range findDockerfiles(args) {
+		selected[filename] = true
+	}
+
+	// every image's patterns are needed to tell its tags apart from the branch tags of the selected ones
+	var all []string
+	for _, filename := range findDockerfiles(nil) {
+		all = appendUnique(all, filename)
+	}
+	for filename := range selected {
+		all = appendUnique(all, filename)
+	}
+
+	patterns, err := tagPatterns(all)
+	if err != nil {
+		return err
+	}
+
+	repositories := selectPatterns(patterns, selected)
+	if len(repositories) == 0 {
+		return fmt.Errorf("nothing to prune, the images are not pushed to a registry")
+	}
+
+	for _, repository := range repositories {
+		image, err := parseRegistryImage(repository)
+		if err != nil {
+			return err
+		}
+
+		auth, err := registryAuth(image.Host)
+		if err != nil {
+			return err
+		}
+
+		registry := newRegistryClient(image.Host, auth.Username, auth.Password)
+
+		if err := pruneRepository(out, registry, repository, image.Repository, patterns[repository], branches, maxAge, time.Now()); err != nil {
+			return fmt.Errorf("%s: %v", repository, err)
+		}
+	}
+
+	return nil
+}
+
+// selectPatterns marks the patterns of the images that aren't selected, and returns the repositories the
+// selected images are pushed to
+func selectPatterns(patterns map[string][]*tagPattern, selected map[string]bool) []string {
+
+	var repositories []string
+
+	for repository, list := range patterns {
+		wanted := false
+		for _, pattern := range list {
+			pattern.Unselected = !selected[pattern.Filename]
+			wanted = wanted || !pattern.Unselected
+		}
+		if wanted {
+			repositories = append(repositories, repository)
+		}
+	}
+
+	sort.Strings(repositories)
+
+	return repositories
+}
+
+// pruneRepository prunes a single repository, name is how it is printed and path how the registry knows it.
+// Deleting a manifest deletes every tag pointing at it, so tags sharing their manifest with a tag that is kept
+// are kept too.
+func pruneRepository(out io.Writer, registry *registryClient, name string, path string, patterns []*tagPattern, branches map[string]bool, maxAge time.Duration, now time.Time) error {
+
+	tags, err := registry.tags(path)
+	if err != nil {
+		return err
+	}
+	sort.Strings(tags)
+
+	candidates := branchTags(tags, patterns, branches)
+
+	if PruneKeep > 0 || maxAge > 0 {
+		for _, candidate := range candidates {
+			config, err := registry.imageConfig(path, candidate.Tag)
+			if err != nil {
+				return err
+			}
+			if config != nil {
+				candidate.Created = config.Created
+			}
+		}
+	}
+
+	applyPruneRetention(candidates, PruneKeep, maxAge, now)
+
+	pruned := map[string]*prunedTag{}
+	for _, candidate := range candidates {
+		if candidate.Reason != "" {
+			pruned[candidate.Tag] = candidate
+		}
+	}
+
+	verb := "deleted"
+	if PruneDryRun {
+		verb = "would delete"
+	}
+
+	if len(pruned) == 0 {
+		printStatus(out, color.New(color.FgGreen), fmt.Sprintf("nothing to prune in %s, %d tag(s)", name, len(tags)))
+		return nil
+	}
+
+	digests := map[string]string{}
+	kept := map[string]string{}
+
+	for _, tag := range tags {
+		digest, err := registry.manifestDigest(path, tag)
+		if err != nil {
+			return err
+		}
+
+		digests[tag] = digest
+		if _, ok := pruned[tag]; !ok && digest != "" && kept[digest] == "" {
+			kept[digest] = tag
+		}
+	}
+
+	deleted := map[string]bool{}
+	count := 0
+
+	for _, tag := range tags {
+		candidate, ok := pruned[tag]
+		if !ok || digests[tag] == "" {
+			continue
+		}
+
+		if other := kept[digests[tag]]; other != "" {
+			printStatus(out, color.New(color.FgHiYellow), fmt.Sprintf("keeping %s:%s, it shares its manifest with %s:%s", name, tag, name, other))
+			continue
+		}
+
+		if !PruneDryRun && !deleted[digests[tag]] {
+			if err := registry.deleteManifest(path, digests[tag]); err != nil {
+				return err
+			}
+		}
+		deleted[digests[tag]] = true
+		count++
+
+		printStatus(out, color.New(color.FgRed), fmt.Sprintf("%s %s:%s (%s)", verb, name, tag, candidate.Reason))
+	}
+
+	printStatus(out, color.New(color.FgGreen), fmt.Sprintf("%s %d of %d tag(s) in %s", verb, count, len(tags), name))
+
+	return nil
+}
+
+// branchTags picks the tags built on a branch out of a repository's tags, with the Reason set for those of
+// branches that are gone. Protected tags and tags of the default branch are left out, as are tags that
+// don't match a template at all and the tags of unselected images.
+func branchTags(tags []string, patterns []*tagPattern, branches map[string]bool) []*prunedTag {
+
+	var candidates []*prunedTag
+
+	for _, tag := range tags {
+		if pruneProtected(tag) {
+			continue
+		}
+
+		var best *tagPattern
+		var branch string
+
+		for _, pattern := range patterns {
+			match := pattern.pattern.FindStringSubmatch(tag)
+			if match == nil {
+				continue
+			}
+			if !pattern.Branch {
+				best = nil
+				break
+			}
+			if pattern.others[match[1]] {
+				continue
+			}
+			if best == nil || pattern.literal > best.literal {
+				best, branch = pattern, match[1]
+			}
+		}
+
+		if best == nil || best.Unselected {
+			continue
+		}
+
+		candidate := &prunedTag{Tag: tag, Filename: best.Filename, Branch: branch}
+		if !branchTagLive(tag, branch, branches) {
+			candidate.Reason = fmt.Sprintf("branch %s is gone", branch)
+		}
+
+		candidates = append(candidates, candidate)
+	}
+
+	return candidates
+}
+
+// tagCutLength is the length past which a tag may have been cut down by sanitizeTag
+const tagCutLength = maxTagLength - 16
+
+// branchTagLive reports if the branch part of a tag belongs to a live branch. sanitizeTag turns characters
+// that can't be in a tag into dashes and appends a hash, and cuts long tags down, so a branch is live if it
+// cleans up to the branch in the tag, with or without the hash, or starts with it when the tag is that long.
+// Guessing wrong keeps a tag, it never deletes one.
+func branchTagLive(tag string, branch string, branches map[string]bool) bool {
+
+	if branches[branch] {
+		return true
+	}
+
+	stripped := tagHashSuffix.ReplaceAllString(branch, "")
+
+	for live := range branches {
+		clean := invalidTagChars.ReplaceAllString(live, "-")
+		if clean == branch || clean == stripped {
+			return true
+		}
+		if len(tag) > tagCutLength && stripped != "" && strings.HasPrefix(clean, stripped) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyPruneRetention marks the branch tags older than maxAge for pruning, then keeps the newest of each
+// image whatever their branch
+func applyPruneRetention(candidates []*prunedTag, keep int, maxAge time.Duration, now time.Time) {
+
+	if maxAge > 0 {
+		for _, candidate := range candidates {
+			if candidate.Reason == "" && !candidate.Created.IsZero() && now.Sub(candidate.Created) > maxAge {
+				candidate.Reason = fmt.Sprintf("older than %s", formatAge(maxAge))
+			}
+		}
+	}
+
+	if keep <= 0 {
+		return
+	}
+
+	images := map[string][]*prunedTag{}
+	for _, candidate := range candidates {
+		images[candidate.Filename] = append(images[candidate.Filename], candidate)
+	}
+
+	for _, tags := range images {
+		tags := tags
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].Created.After(tags[j].Created)
+		})
+
+		for i := 0; i < keep && i < len(tags); i++ {
+			tags[i].Reason = ""
+		}
+	}
+}
+
+// pruneProtected reports if a tag matches one of the PruneProtect patterns
+func pruneProtected(tag string) bool {
+
+	for _, pattern := range PruneProtect {
+		if matched, _ := path.Match(pattern, tag); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tagPatterns renders the tag templates of the Dockerfiles with the markers in place, once for the default
+// branch and once for any other, into patterns grouped by the repository the tags are pushed to. Images
+// that aren't pushed anywhere are left out.
+func tagPatterns(filenames []string) (map[string][]*tagPattern, error) {
+
+	patterns := map[string][]*tagPattern{}
+	seen := map[string]bool{}
+
+	// the default branch tags of each image, by repository
+	defaults := map[string]map[string]string{}
+
+	for _, filename := range filenames {
+		for _, branch := range []bool{false, true} {
+			ctx := newTagContext(filename)
+			ctx.Release, ctx.SHA, ctx.Date = "", pruneSHAMarker, pruneDateMarker
+
+			ctx.Branch = DefaultGitBranch
+			ctx.setBranchSuffix("")
+			if branch {
+				ctx.Branch = pruneBranchMarker
+				ctx.setBranchSuffix("-" + pruneBranchMarker)
+			}
+
+			refs, err := renderTags(filename, ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, ref := range refs {
+				tag := tagName(ref)
+				repository := strings.TrimSuffix(ref, ":"+tag)
+
+				if repository == ref || (branch && !strings.Contains(tag, pruneBranchMarker)) {
+					continue
+				}
+
+				if !branch {
+					if defaults[repository] == nil {
+						defaults[repository] = map[string]string{}
+					}
+					defaults[repository][tag] = filename
+				}
+
+				expr := "^" + pruneMarkers.Replace(regexp.QuoteMeta(tag)) + "$"
+				key := fmt.Sprintf("%s %s %v", repository, expr, branch)
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+
+				pattern, err := regexp.Compile(expr)
+				if err != nil {
+					return nil, err
+				}
+
+				patterns[repository] = append(patterns[repository], &tagPattern{
+					Filename:   filename,
+					Repository: repository,
+					Branch:     branch,
+					pattern:    pattern,
+					literal:    len(strings.NewReplacer(pruneBranchMarker, "", pruneSHAMarker, "", pruneDateMarker, "").Replace(tag)),
+					others:     map[string]bool{},
+				})
+			}
+		}
+	}
+
+	for repository, list := range patterns {
+		for _, pattern := range list {
+			for tag, filename := range defaults[repository] {
+				if match := pattern.pattern.FindStringSubmatch(tag); pattern.Branch && match != nil && filename != pattern.Filename {
+					pattern.others[match[1]] = true
+				}
+			}
+		}
+	}
+
+	return patterns, nil
+}
+
+// parseMaxAge parses a duration, which can also be given in days, `30d`. Empty means no maximum.
+func parseMaxAge(age string) (time.Duration, error) {
+
+	if age == "" {
+		return 0, nil
+	}
+
+	if strings.HasSuffix(age, "d") {
+		if days, err := strconv.Atoi(strings.TrimSuffix(age, "d")); err == nil && days >= 0 {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+
+	duration, err := time.ParseDuration(age)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("invalid max age %q, use a duration like 720h or 30d", age)
+	}
+
+	return duration, nil
+}
+
+// formatAge prints whole days as days, the way they are usually configured
+func formatAge(age time.Duration) string {
+
+	if age%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", age/(24*time.Hour))
+	}
+
+	return age.String()
+}
@@ -0,0 +1,300 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPruneRegistry is a registry serving tags of one repository two to a page, each with the manifest
+// digest and created time given, and recording the manifests deleted
+type testPruneRegistry struct {
+	*httptest.Server
+	digests map[string]string
+	created map[string]time.Time
+	deleted []string
+}
+
+func newTestPruneRegistry(t *testing.T, repository string, digests map[string]string, created map[string]time.Time) *testPruneRegistry {
+
+	registry := &testPruneRegistry{digests: digests, created: created}
+
+	var tags []string
+	for tag := range digests {
+		tags = append(tags, tag)
+	}
+
+	registry.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		prefix := "/v2/" + repository + "/"
+
+		switch {
+		case r.URL.Path == prefix+"tags/list":
+			page := tags
+			if r.URL.Query().Get("last") == "" {
+				page = tags[:2]
+				w.Header().Set("Link", fmt.Sprintf(`<%s?n=2&last=%s>; rel="next"`, r.URL.Path, tags[1]))
+			} else {
+				page = tags[2:]
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"name": repository, "tags": page})
+		case strings.HasPrefix(r.URL.Path, prefix+"manifests/sha256:") && r.Method == http.MethodDelete:
+			registry.deleted = append(registry.deleted, strings.TrimPrefix(r.URL.Path, prefix+"manifests/"))
+			w.WriteHeader(http.StatusAccepted)
+		case strings.HasPrefix(r.URL.Path, prefix+"manifests/"):
+			tag := strings.TrimPrefix(r.URL.Path, prefix+"manifests/")
+			if registry.digests[tag] == "" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", registry.digests[tag])
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+				"config":    map[string]string{"digest": "sha256:config-" + tag},
+			})
+		case strings.HasPrefix(r.URL.Path, prefix+"blobs/sha256:config-"):
+			tag := strings.TrimPrefix(r.URL.Path, prefix+"blobs/sha256:config-")
+			json.NewEncoder(w).Encode(map[string]interface{}{"created": registry.created[tag]})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	t.Cleanup(registry.Close)
+
+	return registry
+}
+
+// testPrunePatterns are the patterns of php and php/Dockerfile-go with the default template
+func testPrunePatterns(t *testing.T) []*tagPattern {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	ioutil.WriteFile(filepath.Join(dir, "php", "Dockerfile-go"), []byte("FROM alpine\n"), 0644)
+
+	DockerRegistry = "superterran/mach"
+	defer func() { DockerRegistry = "" }()
+
+	patterns, err := tagPatterns([]string{filepath.Join(dir, "php", "Dockerfile"), filepath.Join(dir, "php", "Dockerfile-go")})
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+
+	return patterns["superterran/mach"]
+}
+
+func Test_tagPatterns(t *testing.T) {
+
+	patterns := testPrunePatterns(t)
+
+	if !assert.Len(t, patterns, 4) {
+		return
+	}
+
+	assert.Equal(t, "^php$", patterns[0].pattern.String())
+	assert.Equal(t, "^php-(.+)$", patterns[1].pattern.String())
+	assert.True(t, patterns[1].Branch)
+	assert.Equal(t, "^php-go-(.+)$", patterns[3].pattern.String())
+
+	DockerRegistry = ""
+
+	none, err := tagPatterns([]string{"../examples/images/example/Dockerfile"})
+	assert.NoError(t, err)
+	assert.Empty(t, none, "images that aren't pushed have nothing to prune")
+}
+
+func Test_branchTags(t *testing.T) {
+
+	PruneProtect = []string{"php-keep-*"}
+	defer func() { PruneProtect = nil }()
+
+	live := sanitizeTag("php-go-feature/new-php")
+	branches := map[string]bool{"main": true, "feature/new-php": true, "fix": true}
+
+	tags := branchTags([]string{"php", "php-go", "php-fix", "php-gone", "php-go-gone", live, "php-keep-me", "node"}, testPrunePatterns(t), branches)
+
+	reasons := map[string]string{}
+	for _, tag := range tags {
+		reasons[tag.Tag] = tag.Reason
+	}
+
+	assert.Equal(t, map[string]string{
+		"php-fix":     "",
+		"php-gone":    "branch gone is gone",
+		"php-go-gone": "branch gone is gone",
+		live:          "",
+	}, reasons, "default branch, protected and unknown tags are left out")
+
+	assert.True(t, strings.HasSuffix(tags[2].Filename, "Dockerfile-go"), "the most specific template wins")
+}
+
+func Test_branchTagsSharedPrefix(t *testing.T) {
+
+	BuildImageDirname = writeTestImages(t, map[string]string{"example": "FROM alpine\n", "example/fpm": "FROM alpine\n", "other": "FROM alpine\n"})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	DockerRegistry = "superterran/mach"
+	defer func() { DockerRegistry = "" }()
+
+	patterns, err := tagPatterns(findDockerfiles(nil))
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+
+	selected := map[string]bool{}
+	for _, filename := range findDockerfiles([]string{"example"}) {
+		selected[filename] = true
+	}
+
+	assert.Equal(t, []string{"superterran/mach"}, selectPatterns(patterns, selected))
+
+	branches := map[string]bool{"main": true}
+	tags := []string{"example", "example-fpm", "example-gone", "example-fpm-gone", "other-gone"}
+
+	var actual []string
+	for _, tag := range branchTags(tags, patterns["superterran/mach"], branches) {
+		actual = append(actual, tag.Tag)
+	}
+
+	assert.Equal(t, []string{"example-gone"}, actual, "the tags of example-fpm are not branch tags of example, and it wasn't selected")
+
+	// without the patterns of example-fpm, its tag is still not taken for the branch fpm of example
+	var examples []*tagPattern
+	for _, pattern := range patterns["superterran/mach"] {
+		if filepath.Base(filepath.Dir(pattern.Filename)) == "example" {
+			examples = append(examples, pattern)
+		}
+	}
+
+	actual = nil
+	for _, tag := range branchTags(tags, examples, branches) {
+		actual = append(actual, tag.Tag)
+	}
+
+	assert.NotContains(t, actual, "example-fpm")
+}
+
+func Test_branchTagLive(t *testing.T) {
+
+	branches := map[string]bool{"feature/" + strings.Repeat("x", 150): true}
+
+	cut := sanitizeTag("php-feature/" + strings.Repeat("x", 150))
+	assert.True(t, branchTagLive(cut, strings.TrimPrefix(cut, "php-"), branches), "long branches are cut down")
+
+	assert.False(t, branchTagLive("php-feature-x", "feature-x", branches))
+}
+
+func Test_applyPruneRetention(t *testing.T) {
+
+	now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	tags := []*prunedTag{
+		{Tag: "php-a", Filename: "php", Created: now.Add(-48 * time.Hour)},
+		{Tag: "php-b", Filename: "php", Created: now.Add(-12 * time.Hour), Reason: "branch b is gone"},
+		{Tag: "php-c", Filename: "php", Created: now.Add(-72 * time.Hour), Reason: "branch c is gone"},
+		{Tag: "node-a", Filename: "node", Created: now.Add(-72 * time.Hour)},
+	}
+
+	applyPruneRetention(tags, 1, 24*time.Hour, now)
+
+	assert.Equal(t, "older than 1d", tags[0].Reason)
+	assert.Equal(t, "", tags[1].Reason, "the newest tag of each image is kept")
+	assert.Equal(t, "branch c is gone", tags[2].Reason)
+	assert.Equal(t, "", tags[3].Reason)
+}
+
+func Test_pruneRepository(t *testing.T) {
+
+	now := time.Now()
+
+	registry := newTestPruneRegistry(t, "superterran/mach", map[string]string{
+		"php":         "sha256:1",
+		"php-fix":     "sha256:2",
+		"php-gone":    "sha256:3",
+		"php-go-gone": "sha256:1",
+		"php-old":     "sha256:4",
+	}, map[string]time.Time{"php-fix": now, "php-gone": now, "php-old": now})
+
+	client := newRegistryClient(strings.TrimPrefix(registry.URL, "http://"), "", "")
+	branches := map[string]bool{"main": true, "fix": true}
+
+	PruneDryRun = true
+
+	var out bytes.Buffer
+	err := pruneRepository(&out, client, "superterran/mach", "superterran/mach", testPrunePatterns(t), branches, 0, now)
+	assert.NoError(t, err)
+	assert.Empty(t, registry.deleted, "a dry run deletes nothing")
+	assert.Contains(t, out.String(), "would delete superterran/mach:php-gone (branch gone is gone)")
+	assert.Contains(t, out.String(), "would delete 2 of 5 tag(s) in superterran/mach")
+
+	PruneDryRun = false
+
+	out.Reset()
+	err = pruneRepository(&out, client, "superterran/mach", "superterran/mach", testPrunePatterns(t), branches, 0, now)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"sha256:3", "sha256:4"}, registry.deleted)
+	assert.Contains(t, out.String(), "keeping superterran/mach:php-go-gone, it shares its manifest with superterran/mach:php")
+
+	PruneKeep = 1
+	defer func() { PruneKeep = 0 }()
+
+	registry.deleted = nil
+	registry.created["php-old"] = now.Add(time.Hour)
+
+	err = pruneRepository(ioutil.Discard, client, "superterran/mach", "superterran/mach", testPrunePatterns(t), branches, 0, now)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sha256:3"}, registry.deleted, "the newest branch tag is kept")
+}
+
+func Test_liveBranches(t *testing.T) {
+
+	dir := t.TempDir()
+
+	_, err := liveBranches(dir)
+	assert.Error(t, err, "outside of a git repository")
+
+	repo, _ := git.PlainInit(dir, false)
+	ioutil.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\n"), 0644)
+	commitAll(t, repo, "first")
+
+	head, _ := repo.Head()
+	repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/feature/new-php", head.Hash()))
+	repo.Storer.SetReference(plumbing.NewHashReference("refs/remotes/origin/fix", head.Hash()))
+	repo.Storer.SetReference(plumbing.NewSymbolicReference("refs/remotes/origin/HEAD", "refs/remotes/origin/fix"))
+
+	branches, err := liveBranches(dir)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{head.Name().Short(): true, "feature/new-php": true, "fix": true}, branches)
+}
+
+func Test_parseMaxAge(t *testing.T) {
+
+	age, err := parseMaxAge("30d")
+	assert.NoError(t, err)
+	assert.Equal(t, 720*time.Hour, age)
+
+	age, err = parseMaxAge("36h")
+	assert.NoError(t, err)
+	assert.Equal(t, 36*time.Hour, age)
+
+	age, err = parseMaxAge("")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), age)
+
+	_, err = parseMaxAge("a month")
+	assert.Error(t, err)
+}
@@ -0,0 +1,386 @@
+// Cmd registry is a small client for the Docker Registry HTTP API V2, for the things the docker daemon can't tell us
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/reference"
+)
+
+// registryManifestTypes are the manifest formats we accept from a registry, image indexes are resolved to
+// the linux/amd64 image, or the first one listed.
+var registryManifestTypes = []string{
+	"application/vnd.docker.distribution.manifest.v2+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.oci.image.index.v1+json",
+}
+
+// registryClient talks to a single registry, answering bearer and basic auth challenges as they come up
+type registryClient struct {
+	// Host is the registry host, `registry-1.docker.io` for docker hub
+	Host string
+	// Scheme is `https`, or `http` for registries on localhost
+	Scheme   string
+	Username string
+	Password string
+
+	client *http.Client
+	token  string
+	basic  bool
+}
+
+// registryImage is an image reference split into the parts the registry API needs
+type registryImage struct {
+	Host       string
+	Repository string
+	Tag        string
+}
+
+type registryManifest struct {
+	MediaType string `json:"mediaType"`
+	Config    struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+	Manifests []struct {
+		Digest   string `json:"digest"`
+		Platform struct {
+			OS           string `json:"os"`
+			Architecture string `json:"architecture"`
+		} `json:"platform"`
+	} `json:"manifests"`
+}
+
+// parseRegistryImage splits a reference like `superterran/mach:php` into registry host, repository and tag
+func parseRegistryImage(ref string) (registryImage, error) {
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return registryImage{}, err
+	}
+
+	image := registryImage{
+		Host:       reference.Domain(named),
+		Repository: reference.Path(named),
+		Tag:        "latest",
+	}
+
+	if tagged, ok := named.(reference.Tagged); ok {
+		image.Tag = tagged.Tag()
+	}
+
+	if image.Host == "docker.io" {
+		image.Host = "registry-1.docker.io"
+	}
+
+	return image, nil
+}
+
+func newRegistryClient(host string, username string, password string) *registryClient {
+
+	scheme := "https"
+	if strings.HasPrefix(host, "localhost") || strings.HasPrefix(host, "127.0.0.1") {
+		scheme = "http"
+	}
+
+	return &registryClient{
+		Host:     host,
+		Scheme:   scheme,
+		Username: username,
+		Password: password,
+		client:   &http.Client{Timeout: time.Minute},
+	}
+}
+
+// do sends a request to the registry, authenticating and retrying once if the registry asks for it
+func (r *registryClient) do(method string, path string, accept []string) (*http.Response, error) {
+
+	send := func() (*http.Response, error) {
+		req, err := http.NewRequest(method, r.Scheme+"://"+r.Host+path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(accept) > 0 {
+			req.Header.Set("Accept", strings.Join(accept, ", "))
+		}
+
+		if r.token != "" {
+			req.Header.Set("Authorization", "Bearer "+r.token)
+		} else if r.basic {
+			req.SetBasicAuth(r.Username, r.Password)
+		}
+
+		return r.client.Do(req)
+	}
+
+	res, err := send()
+	if err != nil || res.StatusCode != http.StatusUnauthorized {
+		return res, err
+	}
+
+	challenge := res.Header.Get("WWW-Authenticate")
+	res.Body.Close()
+
+	if err := r.authenticate(challenge); err != nil {
+		return nil, err
+	}
+
+	return send()
+}
+
+var challengeParamPattern = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// authenticate answers a WWW-Authenticate challenge, fetching a bearer token from the auth realm when asked
+func (r *registryClient) authenticate(challenge string) error {
+
+	if strings.HasPrefix(strings.ToLower(challenge), "basic") {
+		r.basic = true
+		return nil
+	}
+
+	params := map[string]string{}
+	for _, match := range challengeParamPattern.FindAllStringSubmatch(challenge, -1) {
+		params[match[1]] = match[2]
+	}
+
+	if params["realm"] == "" {
+		return fmt.Errorf("%s: unsupported auth challenge %q", r.Host, challenge)
+	}
+
+	query := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			query.Set(key, params[key])
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodGet, params["realm"]+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	if r.Username != "" {
+		req.SetBasicAuth(r.Username, r.Password)
+	}
+
+	res, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: authentication failed: %s", r.Host, res.Status)
+	}
+
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&token); err != nil {
+		return err
+	}
+
+	r.token = token.Token
+	if r.token == "" {
+		r.token = token.AccessToken
+	}
+
+	return nil
+}
+
+// getJSON fetches a registry path and decodes the body, a 404 is reported with found set to false
+func (r *registryClient) getJSON(path string, accept []string, v interface{}) (bool, error) {
+
+	res, err := r.do(http.MethodGet, path, accept)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		io.Copy(ioutil.Discard, res.Body)
+		return false, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s%s: %s", r.Host, path, res.Status)
+	}
+
+	return true, json.NewDecoder(res.Body).Decode(v)
+}
+
+// registryImageConfig is the part of an image config we read from the registry
+type registryImageConfig struct {
+	Created time.Time `json:"created"`
+	Config  struct {
+		Labels map[string]string `json:"Labels"`
+	} `json:"config"`
+}
+
+// imageLabels returns the labels of an image in the registry, nil if the tag doesn't exist
+func (r *registryClient) imageLabels(repository string, tag string) (map[string]string, error) {
+
+	config, err := r.imageConfig(repository, tag)
+	if err != nil || config == nil {
+		return nil, err
+	}
+
+	if config.Config.Labels == nil {
+		return map[string]string{}, nil
+	}
+
+	return config.Config.Labels, nil
+}
+
+// imageConfig returns the config of an image in the registry, nil if the tag doesn't exist
+func (r *registryClient) imageConfig(repository string, tag string) (*registryImageConfig, error) {
+
+	var manifest registryManifest
+
+	found, err := r.getJSON("/v2/"+repository+"/manifests/"+tag, registryManifestTypes, &manifest)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	if len(manifest.Manifests) > 0 {
+		digest := manifest.Manifests[0].Digest
+		for _, m := range manifest.Manifests {
+			if m.Platform.OS == "linux" && m.Platform.Architecture == "amd64" {
+				digest = m.Digest
+				break
+			}
+		}
+
+		manifest = registryManifest{}
+		found, err = r.getJSON("/v2/"+repository+"/manifests/"+digest, registryManifestTypes, &manifest)
+		if err != nil || !found {
+			return nil, err
+		}
+	}
+
+	var config registryImageConfig
+
+	found, err = r.getJSON("/v2/"+repository+"/blobs/"+manifest.Config.Digest, nil, &config)
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+var nextLinkPattern = regexp.MustCompile(`<([^>]+)>\s*;\s*rel="?next"?`)
+
+// tags lists the tags of a repository, following the Link headers of paginated responses
+func (r *registryClient) tags(repository string) ([]string, error) {
+
+	var tags []string
+
+	path := "/v2/" + repository + "/tags/list?n=1000"
+	for path != "" {
+		res, err := r.do(http.MethodGet, path, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusNotFound {
+			res.Body.Close()
+			return nil, nil
+		}
+
+		if res.StatusCode != http.StatusOK {
+			res.Body.Close()
+			return nil, fmt.Errorf("%s%s: %s", r.Host, path, res.Status)
+		}
+
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		tags = append(tags, page.Tags...)
+
+		path = ""
+		if match := nextLinkPattern.FindStringSubmatch(res.Header.Get("Link")); match != nil {
+			next, err := url.Parse(match[1])
+			if err != nil {
+				return nil, err
+			}
+			path = next.RequestURI()
+		}
+	}
+
+	return tags, nil
+}
+
+// manifestDigest returns the digest of the manifest a tag points at, empty if the tag doesn't exist. Registries
+// that leave the Docker-Content-Digest header off a HEAD request get the manifest fetched and hashed instead.
+func (r *registryClient) manifestDigest(repository string, tag string) (string, error) {
+
+	path := "/v2/" + repository + "/manifests/" + tag
+
+	for _, method := range []string{http.MethodHead, http.MethodGet} {
+		res, err := r.do(method, path, registryManifestTypes)
+		if err != nil {
+			return "", err
+		}
+
+		content, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return "", err
+		}
+
+		switch {
+		case res.StatusCode == http.StatusNotFound:
+			return "", nil
+		case res.StatusCode != http.StatusOK:
+			return "", fmt.Errorf("%s%s: %s", r.Host, path, res.Status)
+		case res.Header.Get("Docker-Content-Digest") != "":
+			return res.Header.Get("Docker-Content-Digest"), nil
+		case method == http.MethodGet:
+			sum := sha256.Sum256(content)
+			return "sha256:" + hex.EncodeToString(sum[:]), nil
+		}
+	}
+
+	return "", nil
+}
+
+// deleteManifest deletes a manifest by digest, along with every tag pointing at it. A manifest that is
+// already gone is not an error.
+func (r *registryClient) deleteManifest(repository string, digest string) error {
+
+	path := "/v2/" + repository + "/manifests/" + digest
+
+	res, err := r.do(http.MethodDelete, path, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(ioutil.Discard, res.Body)
+
+	switch res.StatusCode {
+	case http.StatusAccepted, http.StatusOK, http.StatusNotFound:
+		return nil
+	case http.StatusMethodNotAllowed:
+		return fmt.Errorf("%s does not allow deleting manifests, a registry:2 container needs REGISTRY_STORAGE_DELETE_ENABLED=true", r.Host)
+	}
+
+	return fmt.Errorf("%s%s: %s", r.Host, path, res.Status)
+}
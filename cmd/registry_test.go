@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestRegistry serves a single image with the given labels, behind a bearer token challenge
+func newTestRegistry(t *testing.T, repository string, tag string, labels map[string]string) *httptest.Server {
+
+	var server *httptest.Server
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		if r.URL.Path == "/token" {
+			json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test",scope="repository:`+repository+`:pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		switch r.URL.Path {
+		case "/v2/" + repository + "/manifests/" + tag:
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+				"config":    map[string]string{"digest": "sha256:config"},
+			})
+		case "/v2/" + repository + "/blobs/sha256:config":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"config": map[string]interface{}{"Labels": labels},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+
+	return server
+}
+
+func Test_parseRegistryImage(t *testing.T) {
+
+	image, err := parseRegistryImage("superterran/mach:php")
+	assert.NoError(t, err)
+	assert.Equal(t, registryImage{Host: "registry-1.docker.io", Repository: "superterran/mach", Tag: "php"}, image)
+
+	image, err = parseRegistryImage("localhost:5000/mach")
+	assert.NoError(t, err)
+	assert.Equal(t, registryImage{Host: "localhost:5000", Repository: "mach", Tag: "latest"}, image)
+}
+
+func Test_registryImageLabels(t *testing.T) {
+
+	server := newTestRegistry(t, "superterran/mach", "php", map[string]string{contentHashLabel: "sha256:abc"})
+	defer server.Close()
+
+	registry := newRegistryClient(strings.TrimPrefix(server.URL, "http://"), "", "")
+
+	labels, err := registry.imageLabels("superterran/mach", "php")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:abc", labels[contentHashLabel])
+
+	labels, err = registry.imageLabels("superterran/mach", "missing")
+	assert.NoError(t, err, "a missing tag is not an error")
+	assert.Nil(t, labels)
+}
+
+func Test_registryManifestDigestAndDelete(t *testing.T) {
+
+	manifest := `{"mediaType": "application/vnd.docker.distribution.manifest.v2+json"}`
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodDelete:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		case r.URL.Path == "/v2/mach/manifests/php":
+			w.Write([]byte(manifest))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	registry := newRegistryClient(strings.TrimPrefix(server.URL, "http://"), "", "")
+
+	sum := sha256.Sum256([]byte(manifest))
+
+	digest, err := registry.manifestDigest("mach", "php")
+	assert.NoError(t, err)
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), digest, "without the digest header the manifest is hashed")
+
+	digest, err = registry.manifestDigest("mach", "missing")
+	assert.NoError(t, err)
+	assert.Equal(t, "", digest)
+
+	err = registry.deleteManifest("mach", "sha256:abc")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "REGISTRY_STORAGE_DELETE_ENABLED")
+}
@@ -0,0 +1,291 @@
+// Cmd report writes machine-readable reports of a build, for pipelines and CI dashboards to pick up
+package cmd
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// ReportJSON is the file a JSON report of the build is written to, set with `--report-json`
+var ReportJSON string = ""
+
+// ReportJUnit is the file a JUnit XML report of the build is written to, set with `--report-junit`
+var ReportJUnit string = ""
+
+// The status of an image in a build report
+const (
+	reportBuilt    = "built"
+	reportUpToDate = "up-to-date"
+	reportFailed   = "failed"
+	reportSkipped  = "skipped"
+)
+
+// buildReport is everything a build did, in build order
+type buildReport struct {
+	Started  time.Time      `json:"started"`
+	Duration float64        `json:"duration"`
+	Images   []*imageReport `json:"images"`
+}
+
+// imageReport is how a single image fared, durations are in seconds
+type imageReport struct {
+	Dockerfile      string            `json:"dockerfile"`
+	Tag             string            `json:"tag"`
+	Tags            []string          `json:"tags"`
+	ImageID         string            `json:"image_id,omitempty"`
+	Digests         map[string]string `json:"digests,omitempty"`
+	Pushes          []pushResult      `json:"pushes,omitempty"`
+	Size            int64             `json:"size,omitempty"`
+	SBOM            string            `json:"sbom,omitempty"`
+	Vulnerabilities map[string]int    `json:"vulnerabilities,omitempty"`
+	Export          string            `json:"export,omitempty"`
+	Duration        float64           `json:"duration"`
+	Status          string            `json:"status"`
+	Stage           string            `json:"stage,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// newBuildReport collects the results of a build that started at the given time
+func newBuildReport(started time.Time, results []*buildResult) *buildReport {
+
+	report := &buildReport{
+		Started:  started,
+		Duration: time.Since(started).Seconds(),
+		Images:   []*imageReport{},
+	}
+
+	for _, result := range results {
+		image := &imageReport{
+			Dockerfile: result.Node.Filename,
+			Tag:        result.Node.Tag,
+			Tags:       []string{result.Node.Tag},
+			Duration:   result.Duration.Seconds(),
+		}
+
+		if build := result.Build; build != nil {
+			if len(build.Tags) > 0 {
+				image.Tags = build.Tags
+			}
+			image.ImageID = build.ID
+			image.Digests = build.Digests
+			image.Pushes = build.Pushes
+			image.Size = build.Size
+			image.SBOM = build.SBOM
+			image.Vulnerabilities = build.Vulnerabilities
+			if build.Export != nil {
+				image.Export = filepath.Join(ExportDir, build.Export.Path)
+			}
+		}
+
+		switch {
+		case result.Err != nil:
+			image.Status = reportFailed
+			image.Error = result.Err.Error()
+			var failure *buildError
+			if errors.As(result.Err, &failure) {
+				image.Stage = failure.Stage
+				image.Error = failure.Err.Error()
+			}
+		case result.Skipped != "":
+			image.Status = reportSkipped
+			image.Error = result.Skipped
+		case result.Build != nil && result.Build.Skipped:
+			image.Status = reportUpToDate
+		default:
+			image.Status = reportBuilt
+		}
+
+		report.Images = append(report.Images, image)
+	}
+
+	return report
+}
+
+// writeJSON writes the report as indented JSON
+func (r *buildReport) writeJSON(w io.Writer) error {
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(r)
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr,omitempty"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the report as JUnit XML, with every image as a test case. Images that were up to date
+// pass, images that were never attempted are skipped.
+func (r *buildReport) writeJUnit(w io.Writer) error {
+
+	suite := junitTestSuite{
+		Name:      "mach build",
+		Time:      fmt.Sprintf("%.3f", r.Duration),
+		Timestamp: r.Started.Format(time.RFC3339),
+	}
+
+	for _, image := range r.Images {
+		testCase := junitTestCase{
+			Name:      image.Tag,
+			ClassName: image.Dockerfile,
+			Time:      fmt.Sprintf("%.3f", image.Duration),
+		}
+
+		switch image.Status {
+		case reportFailed:
+			suite.Failures++
+			testCase.Failure = &junitMessage{Message: image.Stage + " failed", Type: image.Stage, Text: image.Error}
+		case reportSkipped:
+			suite.Skipped++
+			testCase.Skipped = &junitMessage{Message: image.Error}
+		default:
+			testCase.SystemOut = image.Status
+			if image.ImageID != "" {
+				testCase.SystemOut += " " + image.ImageID
+			}
+		}
+
+		suite.Tests++
+		suite.Cases = append(suite.Cases, testCase)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(junitTestSuites{Suites: []junitTestSuite{suite}}); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// writeBuildReports writes the reports asked for with ReportJSON and ReportJUnit
+func writeBuildReports(started time.Time, results []*buildResult) error {
+
+	if ReportJSON == "" && ReportJUnit == "" {
+		return nil
+	}
+
+	report := newBuildReport(started, results)
+
+	if ReportJSON != "" {
+		if err := writeReportFile(ReportJSON, report.writeJSON); err != nil {
+			return err
+		}
+	}
+
+	if ReportJUnit != "" {
+		if err := writeReportFile(ReportJUnit, report.writeJUnit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// reportStdout is where reports written to `-` go, the stdout mach started with
+var reportStdout io.Writer = os.Stdout
+
+// redirectBuildOutput sends everything a build prints to stderr when a report is written to stdout, so the
+// report can be piped on as it is. The function returned puts the output back.
+func redirectBuildOutput() (func(), error) {
+
+	if ReportJSON == "-" && ReportJUnit == "-" {
+		return nil, fmt.Errorf("only one of --report-json and --report-junit can be written to stdout")
+	}
+
+	if ReportJSON != "-" && ReportJUnit != "-" {
+		return func() {}, nil
+	}
+
+	stdout, output := os.Stdout, color.Output
+	os.Stdout, color.Output = os.Stderr, color.Error
+
+	return func() { os.Stdout, color.Output = stdout, output }, nil
+}
+
+// failBuildPlan writes the reports of a build that could not be planned, and returns why it couldn't
+func failBuildPlan(started time.Time, filenames []string, err error) error {
+
+	if reportErr := writeBuildReports(started, failedPlanResults(filenames, err)); reportErr != nil {
+		color.Red("could not write the build report: %v", reportErr)
+	}
+
+	return err
+}
+
+// failedPlanResults are the results of a build that could not be planned, every Dockerfile failed with the
+// reason, so the reports still say what happened
+func failedPlanResults(filenames []string, err error) []*buildResult {
+
+	var results []*buildResult
+
+	for _, filename := range filenames {
+		node := &buildNode{Filename: filename, Tag: filename}
+		if tags, tagErr := imageTags(filename); tagErr == nil {
+			node.Tag = tags[0]
+		}
+
+		results = append(results, &buildResult{Node: node, Err: err})
+	}
+
+	return results
+}
+
+// writeReportFile writes a report to a file, `-` writes it to stdout
+func writeReportFile(filename string, write func(io.Writer) error) error {
+
+	if filename == "-" {
+		return write(reportStdout)
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testBuildResults() []*buildResult {
+
+	base := &buildNode{Filename: "images/base/Dockerfile", Tag: "superterran/mach:base"}
+	php := &buildNode{Filename: "images/php/Dockerfile", Tag: "superterran/mach:php"}
+	node := &buildNode{Filename: "images/node/Dockerfile", Tag: "superterran/mach:node"}
+	child := &buildNode{Filename: "images/child/Dockerfile", Tag: "superterran/mach:child"}
+
+	return []*buildResult{
+		{
+			Node: base,
+			Build: &imageBuild{
+				Tag:     base.Tag,
+				Tags:    []string{base.Tag, "superterran/mach:latest"},
+				ID:      "sha256:abc",
+				Size:    1024,
+				SBOM:    "superterran_mach_base.spdx.json",
+				Digests: map[string]string{base.Tag: "sha256:def"},
+			},
+			Duration: 2 * time.Second,
+		},
+		{Node: php, Build: &imageBuild{Tag: php.Tag, Tags: []string{php.Tag}, ID: "sha256:123", Skipped: true, Export: &exportedImage{Path: "superterran_mach_php.tar"}}},
+		{Node: node, Build: &imageBuild{Tag: node.Tag}, Err: newBuildError(stagePush, node.Tag, errors.New("denied"))},
+		{Node: child, Skipped: "superterran/mach:node was not built"},
+	}
+}
+
+func Test_newBuildReport(t *testing.T) {
+
+	report := newBuildReport(time.Now(), testBuildResults())
+
+	assert.Len(t, report.Images, 4)
+
+	base := report.Images[0]
+	assert.Equal(t, "images/base/Dockerfile", base.Dockerfile)
+	assert.Equal(t, []string{"superterran/mach:base", "superterran/mach:latest"}, base.Tags)
+	assert.Equal(t, "sha256:abc", base.ImageID)
+	assert.Equal(t, "sha256:def", base.Digests["superterran/mach:base"])
+	assert.Equal(t, int64(1024), base.Size)
+	assert.Equal(t, "superterran_mach_base.spdx.json", base.SBOM)
+	assert.Equal(t, 2.0, base.Duration)
+	assert.Equal(t, reportBuilt, base.Status)
+
+	assert.Equal(t, reportUpToDate, report.Images[1].Status)
+	assert.Equal(t, "superterran_mach_php.tar", report.Images[1].Export, "up to date images are exported too")
+
+	assert.Equal(t, reportFailed, report.Images[2].Status)
+	assert.Equal(t, stagePush, report.Images[2].Stage)
+	assert.Equal(t, "denied", report.Images[2].Error)
+
+	assert.Equal(t, reportSkipped, report.Images[3].Status)
+	assert.Equal(t, []string{"superterran/mach:child"}, report.Images[3].Tags, "images never attempted still report their tag")
+
+	var buff bytes.Buffer
+	assert.NoError(t, report.writeJSON(&buff))
+
+	var decoded map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buff.Bytes(), &decoded))
+	assert.Len(t, decoded["images"], 4)
+}
+
+func Test_buildReportJUnit(t *testing.T) {
+
+	var buff bytes.Buffer
+	assert.NoError(t, newBuildReport(time.Now(), testBuildResults()).writeJUnit(&buff))
+
+	xml := buff.String()
+
+	assert.True(t, strings.HasPrefix(xml, "<?xml"))
+	assert.Contains(t, xml, `<testsuite name="mach build" tests="4" failures="1" skipped="1"`)
+	assert.Contains(t, xml, `<testcase name="superterran/mach:base" classname="images/base/Dockerfile" time="2.000">`)
+	assert.Contains(t, xml, `<failure message="push failed" type="push">denied</failure>`)
+	assert.Contains(t, xml, `<skipped message="superterran/mach:node was not built"></skipped>`)
+}
+
+func Test_redirectBuildOutput(t *testing.T) {
+
+	defer func() { ReportJSON, ReportJUnit = "", "" }()
+
+	stdout := os.Stdout
+
+	ReportJSON, ReportJUnit = "-", "-"
+	_, err := redirectBuildOutput()
+	assert.Error(t, err, "two reports can't share stdout")
+
+	ReportJSON, ReportJUnit = "build.json", ""
+	restore, err := redirectBuildOutput()
+	assert.NoError(t, err)
+	assert.Equal(t, stdout, os.Stdout, "the output stays put when no report goes to stdout")
+	restore()
+
+	ReportJSON = "-"
+	restore, err = redirectBuildOutput()
+	assert.NoError(t, err)
+	assert.Equal(t, os.Stderr, os.Stdout, "the build prints to stderr while the report has stdout")
+	restore()
+	assert.Equal(t, stdout, os.Stdout)
+}
+
+func Test_writeBuildReportsFailedPlan(t *testing.T) {
+
+	var out bytes.Buffer
+	reportStdout = &out
+	defer func() { reportStdout = os.Stdout }()
+
+	ReportJSON = "-"
+	defer func() { ReportJSON = "" }()
+
+	err := failBuildPlan(time.Now(), []string{"images/php/Dockerfile"}, errors.New("dependency cycle detected"))
+	assert.EqualError(t, err, "dependency cycle detected")
+
+	var report buildReport
+	assert.NoError(t, json.Unmarshal(out.Bytes(), &report), "the report is the only thing on stdout")
+
+	if assert.Len(t, report.Images, 1) {
+		assert.Equal(t, reportFailed, report.Images[0].Status)
+		assert.Equal(t, "dependency cycle detected", report.Images[0].Error)
+	}
+}
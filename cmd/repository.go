@@ -0,0 +1,82 @@
+// Cmd repository maps images to their own repositories, for registries organised as one repository per image
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/spf13/viper"
+)
+
+// DefaultRepositoryTagTemplate tags images that have their own repository, `org/php:8.1-fpm`
+const DefaultRepositoryTagTemplate = "{{.VariantTag}}"
+
+// configRepository returns the repository config gives an image: the entry for its path under `repositories`,
+// or its name under `image_repository_prefix`. It is empty when images are tags in docker_registry.
+func configRepository(filename string) string {
+
+	path := imagePath(filename)
+
+	// viper lowercases keys, so directories are matched regardless of case
+	for dir, repository := range viper.GetStringMapString("repositories") {
+		if strings.EqualFold(strings.Trim(dir, "/"), path) {
+			return repository
+		}
+	}
+
+	if prefix := viper.GetString("image_repository_prefix"); prefix != "" {
+		return strings.TrimSuffix(prefix, "/") + "/" + imageName(filename)
+	}
+
+	return ""
+}
+
+// imageRepository returns the repository of an image, from its manifest or config. It is empty when the image
+// is a tag in docker_registry.
+func imageRepository(filename string) string {
+
+	manifest, err := loadImageManifest(filename)
+	if err != nil {
+		return configRepository(filename)
+	}
+
+	return manifest.Repository
+}
+
+// pushesNowhere reports if an image has nowhere to be pushed to: it has no repository of its own and there is
+// no docker_registry, so its tags are bare names
+func pushesNowhere(filename string) bool {
+
+	return DockerRegistry == "" && imageRepository(filename) == ""
+}
+
+// repositoryOf returns the repository part of an image reference, `registry.example.com/org/php` for
+// `registry.example.com/org/php:8.1`, docker hub references are kept short.
+func repositoryOf(ref string) string {
+
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return strings.TrimSuffix(ref, ":"+tagName(ref))
+	}
+
+	return reference.FamiliarName(reference.TrimNamed(named))
+}
+
+// resolveImageTag returns the tag of an image given in the `image[:variant]` form used by `mach build`,
+// `php/8.1:fpm`, by finding its Dockerfile.
+func resolveImageTag(image string) (string, error) {
+
+	var variant string
+	if i := strings.Index(image, ":"); i >= 0 {
+		variant = image[i+1:]
+	}
+
+	for _, filename := range findDockerfiles([]string{image}) {
+		if fileVariant(filename) == variant {
+			return getTag(filename), nil
+		}
+	}
+
+	return "", fmt.Errorf("no Dockerfile for %s in %s", image, BuildImageDirname)
+}
@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_imageRepository(t *testing.T) {
+
+	BuildImageDirname = writeTestImages(t, map[string]string{"example": "FROM alpine\n", "php/8.1": "FROM alpine\n", "node": "FROM alpine\n"})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	DockerRegistry = "superterran/mach"
+
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "example", ImageManifestFilename), []byte("repository: org/example\ntags: [stable]\n"), 0644)
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "example", "Dockerfile-go"), []byte("FROM alpine\n"), 0644)
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "php", "API_VERSION"), []byte("8.1"), 0644)
+
+	viper.Set("repositories", map[string]interface{}{"php/8.1": "org/php"})
+	defer viper.Set("repositories", nil)
+
+	example := filepath.Join(BuildImageDirname, "example", "Dockerfile")
+	php := filepath.Join(BuildImageDirname, "php", "8.1", "Dockerfile")
+	node := filepath.Join(BuildImageDirname, "node", "Dockerfile")
+
+	assert.Equal(t, "org/example", imageRepository(example), "the image manifest should set the repository")
+	assert.Equal(t, "org/php", imageRepository(php), "config should map directories to repositories")
+	assert.Equal(t, "", imageRepository(node))
+
+	assert.Equal(t, "org/example:latest", getTag(example))
+	assert.Equal(t, "org/example:go", getTag(filepath.Join(BuildImageDirname, "example", "Dockerfile-go")))
+	assert.Equal(t, "org/php:8.1", getTag(php))
+	assert.Equal(t, "superterran/mach:node", getTag(node), "images without a repository stay tags in docker_registry")
+
+	assert.Equal(t, []string{"org/example:latest", "org/example:stable"}, withExtraTags(example, getTag(example)),
+		"extra tags should go to the image repository")
+
+	tag, err := resolveImageTag("example:go")
+	assert.NoError(t, err)
+	assert.Equal(t, "org/example:go", tag)
+
+	out, err := renderTestTemplate(t, `{{ imageTag "php/8.1" }}`, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "org/php:8.1", out)
+
+	viper.Set("image_repository_prefix", "registry.example.com/org")
+	defer viper.Set("image_repository_prefix", "")
+
+	assert.Equal(t, "registry.example.com/org/node:latest", getTag(node), "the prefix should give every image its own repository")
+}
+
+func Test_pushesNowhere(t *testing.T) {
+
+	BuildImageDirname = writeTestImages(t, map[string]string{"example": "FROM alpine\n", "node": "FROM alpine\n"})
+	defer os.RemoveAll(BuildImageDirname)
+	defer func() { BuildImageDirname = "." }()
+
+	DockerRegistry = ""
+
+	ioutil.WriteFile(filepath.Join(BuildImageDirname, "example", ImageManifestFilename), []byte("repository: org/example\n"), 0644)
+
+	example := filepath.Join(BuildImageDirname, "example", "Dockerfile")
+	node := filepath.Join(BuildImageDirname, "node", "Dockerfile")
+
+	_, err := imageTags(node)
+	assert.NoError(t, err)
+	assert.False(t, Nopush, "rendering tags should not turn pushing off")
+
+	assert.True(t, pushesNowhere(node))
+	assert.False(t, pushesNowhere(example), "an image with its own repository is pushed without a docker_registry")
+
+	DockerRegistry = "superterran/mach"
+	defer func() { DockerRegistry = "" }()
+
+	assert.False(t, pushesNowhere(node))
+}
+
+func Test_pushTargetWithImageRepository(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+
+	target := pushTarget{Host: "registry.example.com", Repository: "mirror"}
+
+	assert.Equal(t, "registry.example.com/mirror:php", target.targetRef("superterran/mach:php"))
+	assert.Equal(t, "registry.example.com/org/example:go", target.targetRef("org/example:go"),
+		"images with their own repository should keep it on other registries")
+	assert.Equal(t, "org/example:go", pushTarget{Repository: "mirror"}.targetRef("ghcr.io/org/example:go"))
+}
+
+func Test_pushTargetWithoutDockerRegistry(t *testing.T) {
+
+	DockerRegistry = ""
+
+	target := pushTarget{Host: "registry.example.com", Repository: "mirror"}
+
+	assert.Equal(t, "registry.example.com/org/example:latest", target.targetRef("org/example:latest"))
+	assert.Equal(t, "registry.example.com/org/php:latest", target.targetRef("org/php:latest"),
+		"images with their own repository should not overwrite each other in the target")
+	assert.Equal(t, "registry.example.com/mirror:node", target.targetRef("node"))
+}
@@ -36,6 +36,7 @@ func CreateRootCmd() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:              "mach",
 		TraverseChildren: true,
+		SilenceErrors:    true,
 		Short:            "Tool for mocking out environments with docker",
 		Long: `A tool for provisioning and running docker compositions both locally and in the cloud.
 		
@@ -51,7 +52,7 @@ func Execute() {
 	err := rootCmd.Execute()
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(1)
+		os.Exit(exitCode(err))
 	}
 }
 
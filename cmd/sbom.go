@@ -0,0 +1,462 @@
+// Cmd sbom writes a software bill of materials for built images, in SPDX or CycloneDX JSON
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var sbomCmd = CreateSbomCmd()
+
+// SBOMFormat is the format of the SBOMs written during a build, `spdx` or `cyclonedx`, none when empty. Set
+// with `--sbom`
+var SBOMFormat string = ""
+
+// SBOMDir is where SBOMs are written, next to the build report when it is not set. Set with `sbom_dir` in
+// config, or `--output-dir` for `mach sbom`
+var SBOMDir string = ""
+
+// The formats an SBOM can be written in
+const (
+	sbomSPDX      = "spdx"
+	sbomCycloneDX = "cyclonedx"
+)
+
+// imageSBOM is what is inside an image, ready to be written as an SBOM
+type imageSBOM struct {
+	Tag      string
+	ImageID  string
+	Created  time.Time
+	Contents *imageContents
+}
+
+func CreateSbomCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "sbom [docker-image[:tag]]",
+		Short: "Writes a software bill of materials for built images",
+		Long: `Exports the image last built from each Dockerfile, or those passed as arguments, and lists the OS packages
+	from the dpkg, apk and rpm databases along with the packages pinned by lockfiles found in the image, as an SPDX
+	or CycloneDX JSON document.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runSbom(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(sbomCmd)
+
+	sbomCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+	sbomCmd.Flags().String("format", sbomSPDX, "SBOM format, spdx or cyclonedx")
+
+	sbomCmd.Flags().String("output-dir", "", "write an SBOM file per image to this directory instead of stdout")
+
+}
+
+func runSbom(cmd *cobra.Command, args []string) error {
+
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	BuildVariantFromParam = viper.GetString("variant")
+
+	SBOMFormat, _ = cmd.Flags().GetString("format")
+
+	SBOMDir, _ = cmd.Flags().GetString("output-dir")
+
+	return MainSbomFlow(cmd.OutOrStdout(), args)
+}
+
+// MainSbomFlow writes an SBOM in SBOMFormat for the image of every Dockerfile matching the arguments, to w, or
+// a file each in SBOMDir when it is set.
+func MainSbomFlow(w io.Writer, args []string) error {
+
+	if err := checkSBOMFormat(SBOMFormat); err != nil {
+		return err
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range findDockerfiles(args) {
+		tag := getTag(filename)
+
+		sbom, err := newImageSBOM(context.Background(), cli, tag)
+		if err != nil {
+			return fmt.Errorf("%s: %v", tag, err)
+		}
+
+		if SBOMDir == "" {
+			if err := sbom.write(w, SBOMFormat); err != nil {
+				return err
+			}
+			continue
+		}
+
+		path, err := sbom.writeFile(SBOMDir, SBOMFormat)
+		if err != nil {
+			return err
+		}
+
+		color.Green("wrote %s, %s", path, sbom.Contents.describe())
+	}
+
+	return nil
+}
+
+func checkSBOMFormat(format string) error {
+
+	if format != sbomSPDX && format != sbomCycloneDX {
+		return fmt.Errorf("unknown SBOM format %q, use spdx or cyclonedx", format)
+	}
+
+	return nil
+}
+
+// newImageSBOM exports an image from the local daemon and finds the packages in it
+func newImageSBOM(ctx context.Context, cli client.APIClient, tag string) (*imageSBOM, error) {
+
+	inspect, _, err := cli.ImageInspectWithRaw(ctx, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	contents, err := readImagePackages(ctx, cli, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &imageSBOM{Tag: tag, ImageID: inspect.ID, Created: time.Now().UTC(), Contents: contents}, nil
+}
+
+// writeImageSBOM writes the SBOM of a freshly built image to SBOMDir, or next to the build report
+func writeImageSBOM(build *imageBuild, out io.Writer) error {
+
+	contents, err := build.packages()
+	if err != nil {
+		return err
+	}
+
+	sbom := &imageSBOM{Tag: build.Tag, ImageID: build.ID, Created: time.Now().UTC(), Contents: contents}
+
+	build.SBOM, err = sbom.writeFile(sbomDirectory(), SBOMFormat)
+	if err != nil {
+		return err
+	}
+
+	printStatus(out, color.New(color.FgGreen), fmt.Sprintf("wrote SBOM %s, %s", build.SBOM, sbom.Contents.describe()))
+
+	return nil
+}
+
+// sbomDirectory returns where builds write SBOMs: SBOMDir, or the directory of the build report
+func sbomDirectory() string {
+
+	if SBOMDir != "" {
+		return SBOMDir
+	}
+
+	for _, report := range []string{ReportJSON, ReportJUnit} {
+		if report != "" && report != "-" {
+			return filepath.Dir(report)
+		}
+	}
+
+	return "."
+}
+
+// tagFilename turns a tag into something safe to name a file after, `superterran_mach_php-8.1`
+func tagFilename(tag string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "@", "_").Replace(tag)
+}
+
+// sbomFilename returns the file an SBOM of a tag is written to, `superterran_mach_php-8.1.spdx.json`
+func sbomFilename(tag string, format string) string {
+
+	name := tagFilename(tag)
+
+	if format == sbomCycloneDX {
+		return name + ".cdx.json"
+	}
+
+	return name + ".spdx.json"
+}
+
+// writeFile writes the SBOM to its file in dir, returning the path
+func (s *imageSBOM) writeFile(dir string, format string) (string, error) {
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, sbomFilename(s.Tag, format))
+
+	return path, writeReportFile(path, func(w io.Writer) error {
+		return s.write(w, format)
+	})
+}
+
+// write writes the SBOM as indented JSON in the format given
+func (s *imageSBOM) write(w io.Writer, format string) error {
+
+	var document interface{}
+
+	switch format {
+	case sbomSPDX:
+		document = s.spdx()
+	case sbomCycloneDX:
+		document = s.cycloneDX()
+	default:
+		return checkSBOMFormat(format)
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(document)
+}
+
+type spdxDocument struct {
+	SPDXVersion       string             `json:"spdxVersion"`
+	DataLicense       string             `json:"dataLicense"`
+	SPDXID            string             `json:"SPDXID"`
+	Name              string             `json:"name"`
+	DocumentNamespace string             `json:"documentNamespace"`
+	CreationInfo      spdxCreationInfo   `json:"creationInfo"`
+	Packages          []spdxPackage      `json:"packages"`
+	Relationships     []spdxRelationship `json:"relationships"`
+}
+
+type spdxCreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+type spdxPackage struct {
+	Name             string            `json:"name"`
+	SPDXID           string            `json:"SPDXID"`
+	VersionInfo      string            `json:"versionInfo,omitempty"`
+	DownloadLocation string            `json:"downloadLocation"`
+	FilesAnalyzed    bool              `json:"filesAnalyzed"`
+	LicenseConcluded string            `json:"licenseConcluded"`
+	LicenseDeclared  string            `json:"licenseDeclared"`
+	LicenseComments  string            `json:"licenseComments,omitempty"`
+	SourceInfo       string            `json:"sourceInfo,omitempty"`
+	PrimaryPurpose   string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdx returns the SBOM as an SPDX 2.3 document, the image is a package containing all the others
+func (s *imageSBOM) spdx() spdxDocument {
+
+	doc := spdxDocument{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              s.Tag,
+		DocumentNamespace: "https://github.com/superterran/mach/sbom/" + strings.NewReplacer("/", "-", ":", "-").Replace(s.Tag) + "-" + newUUID(),
+		CreationInfo: spdxCreationInfo{
+			Created:  s.Created.Format(time.RFC3339),
+			Creators: []string{"Tool: mach"},
+		},
+		Packages: []spdxPackage{{
+			Name:             s.Tag,
+			SPDXID:           "SPDXRef-Image",
+			VersionInfo:      s.ImageID,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			PrimaryPurpose:   "CONTAINER",
+		}},
+		Relationships: []spdxRelationship{{SPDXElementID: "SPDXRef-DOCUMENT", RelationshipType: "DESCRIBES", RelatedSPDXElement: "SPDXRef-Image"}},
+	}
+
+	for i, pkg := range s.Contents.Packages {
+		id := "SPDXRef-Package-" + strconv.Itoa(i+1)
+
+		license, comment := spdxLicense(pkg.License)
+
+		doc.Packages = append(doc.Packages, spdxPackage{
+			Name:             pkg.Name,
+			SPDXID:           id,
+			VersionInfo:      pkg.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  license,
+			LicenseComments:  comment,
+			SourceInfo:       "found in " + pkg.Source,
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  pkg.purl(s.Contents.OS),
+			}},
+		})
+
+		doc.Relationships = append(doc.Relationships, spdxRelationship{SPDXElementID: "SPDXRef-Image", RelationshipType: "CONTAINS", RelatedSPDXElement: id})
+	}
+
+	return doc
+}
+
+// spdxLicenseExpression matches licenses already written as SPDX expressions, like `MIT OR Apache-2.0`
+var spdxLicenseExpression = regexp.MustCompile(`^\(?[A-Za-z0-9.+-]+\)?( (AND|OR|WITH) \(?[A-Za-z0-9.+-]+\)?)*$`)
+
+// spdxLicense returns the declared license of a package in SPDX. Licenses that aren't an SPDX expression,
+// like rpm's `GPLv2+ and LGPLv2+`, are NOASSERTION and kept as a comment instead.
+func spdxLicense(license string) (string, string) {
+
+	if license == "" {
+		return "NOASSERTION", ""
+	}
+
+	if spdxLicenseExpression.MatchString(license) {
+		return license, ""
+	}
+
+	return "NOASSERTION", "declared as " + license
+}
+
+type cycloneDXDocument struct {
+	BOMFormat    string               `json:"bomFormat"`
+	SpecVersion  string               `json:"specVersion"`
+	SerialNumber string               `json:"serialNumber"`
+	Version      int                  `json:"version"`
+	Metadata     cycloneDXMetadata    `json:"metadata"`
+	Components   []cycloneDXComponent `json:"components"`
+}
+
+type cycloneDXMetadata struct {
+	Timestamp string             `json:"timestamp"`
+	Tools     []cycloneDXTool    `json:"tools"`
+	Component cycloneDXComponent `json:"component"`
+}
+
+type cycloneDXTool struct {
+	Vendor string `json:"vendor"`
+	Name   string `json:"name"`
+}
+
+type cycloneDXComponent struct {
+	Type       string              `json:"type"`
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// cycloneDX returns the SBOM as a CycloneDX 1.4 document
+func (s *imageSBOM) cycloneDX() cycloneDXDocument {
+
+	doc := cycloneDXDocument{
+		BOMFormat:    "CycloneDX",
+		SpecVersion:  "1.4",
+		SerialNumber: "urn:uuid:" + newUUID(),
+		Version:      1,
+		Metadata: cycloneDXMetadata{
+			Timestamp: s.Created.Format(time.RFC3339),
+			Tools:     []cycloneDXTool{{Vendor: "superterran", Name: "mach"}},
+			Component: cycloneDXComponent{Type: "container", BOMRef: s.ImageID, Name: s.Tag, Version: s.ImageID},
+		},
+		Components: []cycloneDXComponent{},
+	}
+
+	if s.Contents.OS.ID != "" {
+		doc.Components = append(doc.Components, cycloneDXComponent{
+			Type:    "operating-system",
+			BOMRef:  "os:" + s.Contents.OS.ID,
+			Name:    s.Contents.OS.ID,
+			Version: s.Contents.OS.VersionID,
+		})
+	}
+
+	seen := map[string]bool{}
+
+	for _, pkg := range s.Contents.Packages {
+		purl := pkg.purl(s.Contents.OS)
+
+		// bom-refs have to be unique, the same package found in two lockfiles is listed once
+		if seen[purl] {
+			continue
+		}
+		seen[purl] = true
+
+		component := cycloneDXComponent{
+			Type:       "library",
+			BOMRef:     purl,
+			Name:       pkg.Name,
+			Version:    pkg.Version,
+			PURL:       purl,
+			Properties: []cycloneDXProperty{{Name: "mach:source", Value: pkg.Source}},
+		}
+
+		if pkg.License != "" {
+			var license cycloneDXLicense
+			license.License.Name = pkg.License
+			component.Licenses = []cycloneDXLicense{license}
+		}
+
+		doc.Components = append(doc.Components, component)
+	}
+
+	return doc
+}
+
+// newUUID returns a random version 4 UUID
+func newUUID() string {
+
+	var b [16]byte
+	rand.Read(b[:])
+
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,211 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeSaveClient stands in for the docker daemon exporting images
+type fakeSaveClient struct {
+	fakeContainerClient
+	saved  []byte
+	pulled []string
+}
+
+// ImagePull puts the image in the daemon, as if the registry had it
+func (f *fakeSaveClient) ImagePull(ctx context.Context, ref string, options types.ImagePullOptions) (io.ReadCloser, error) {
+
+	if f.images == nil {
+		f.images = map[string]types.ImageInspect{}
+	}
+	f.images[ref] = types.ImageInspect{ID: "sha256:pulled"}
+	f.pulled = append(f.pulled, ref)
+
+	return ioutil.NopCloser(strings.NewReader(`{"status": "Downloaded newer image"}`)), nil
+}
+
+func (f *fakeSaveClient) ImageSave(ctx context.Context, images []string) (io.ReadCloser, error) {
+	return ioutil.NopCloser(bytes.NewReader(f.saved)), nil
+}
+
+func testImageSBOM(t *testing.T) (*imageSBOM, *fakeSaveClient) {
+
+	saved := testSavedImage(t, testLayer(t, map[string]string{
+		"etc/os-release":        "ID=alpine\nVERSION_ID=3.16.0\n",
+		"lib/apk/db/installed":  "P:musl\nV:1.2.3-r0\nA:x86_64\nL:MIT\n\nP:busybox\nV:1.35.0-r17\nA:x86_64\nL:GPL-2.0-only\n",
+		"var/lib/rpm/Packages":  "",
+		"srv/app/composer.lock": `{"packages": [{"name": "monolog/monolog", "version": "2.8.0", "license": ["MIT"]}]}`,
+	}, false))
+
+	cli := &fakeSaveClient{
+		fakeContainerClient: fakeContainerClient{
+			fakeDockerClient: fakeDockerClient{images: map[string]types.ImageInspect{
+				"superterran/mach:php": {ID: "sha256:abc"},
+			}},
+			execs: map[string]fakeExec{
+				"rpm -qa --qf " + rpmQueryFormat: {stdout: "bash\t5.1.8-4.el9\tx86_64\tGPLv3+ and GPLv3+ with exceptions\n"},
+			},
+		},
+		saved: saved.Bytes(),
+	}
+
+	sbom, err := newImageSBOM(context.Background(), cli, "superterran/mach:php")
+	if err != nil {
+		assert.FailNow(t, err.Error())
+	}
+
+	return sbom, cli
+}
+
+func Test_newImageSBOM(t *testing.T) {
+
+	sbom, cli := testImageSBOM(t)
+
+	assert.Equal(t, "sha256:abc", sbom.ImageID)
+	assert.Len(t, sbom.Contents.Packages, 4)
+	assert.Equal(t, "bash", sbom.Contents.Packages[3].Name, "rpm packages are listed by running rpm in the image")
+	assert.True(t, cli.removed)
+}
+
+func Test_packagesFromRegistry(t *testing.T) {
+
+	os.Setenv("DOCKER_CONFIG", t.TempDir())
+	defer os.Unsetenv("DOCKER_CONFIG")
+
+	saved := testSavedImage(t, testLayer(t, map[string]string{
+		"etc/os-release":       "ID=alpine\nVERSION_ID=3.16.0\n",
+		"lib/apk/db/installed": "P:musl\nV:1.2.3-r0\nA:x86_64\nL:MIT\n",
+	}, false))
+
+	cli := &fakeSaveClient{saved: saved.Bytes()}
+
+	// up to date in the registry, but not in the daemon
+	build := &imageBuild{Tag: "superterran/mach:php", Skipped: true, SkipPush: true}
+
+	contents, err := build.packagesFrom(context.Background(), cli)
+	assert.NoError(t, err)
+	assert.Len(t, contents.Packages, 1)
+	assert.Equal(t, []string{"superterran/mach:php"}, cli.pulled, "an image only the registry has is pulled to be described")
+	assert.Equal(t, "sha256:pulled", build.ID)
+
+	build = &imageBuild{Tag: "superterran/mach:php", Skipped: true}
+
+	_, err = build.packagesFrom(context.Background(), cli)
+	assert.NoError(t, err)
+	assert.Len(t, cli.pulled, 1, "an image the daemon has is not pulled again")
+}
+
+func Test_readImagePackagesWithoutRPM(t *testing.T) {
+
+	saved := testSavedImage(t, testLayer(t, map[string]string{
+		"etc/os-release":       "ID=rocky\nVERSION_ID=9.0\n",
+		"var/lib/rpm/Packages": "",
+	}, false))
+
+	cli := &fakeSaveClient{
+		fakeContainerClient: fakeContainerClient{
+			execs: map[string]fakeExec{
+				"rpm -qa --qf " + rpmQueryFormat: {stderr: "rpm: not found\n", exitCode: 127},
+			},
+		},
+		saved: saved.Bytes(),
+	}
+
+	contents, err := readImagePackages(context.Background(), cli, "superterran/mach:rocky")
+	assert.NoError(t, err, "an image that can't run rpm still gets its other packages read")
+	assert.Empty(t, contents.Packages)
+	assert.True(t, cli.removed)
+}
+
+func Test_imageSBOMSPDX(t *testing.T) {
+
+	sbom, _ := testImageSBOM(t)
+
+	var buff bytes.Buffer
+	assert.NoError(t, sbom.write(&buff, sbomSPDX))
+
+	var doc spdxDocument
+	assert.NoError(t, json.Unmarshal(buff.Bytes(), &doc))
+
+	assert.Equal(t, "SPDX-2.3", doc.SPDXVersion)
+	assert.Equal(t, "superterran/mach:php", doc.Name)
+	assert.Len(t, doc.Packages, 5)
+	assert.Len(t, doc.Relationships, 5)
+
+	image, composer, rpm := doc.Packages[0], doc.Packages[3], doc.Packages[4]
+
+	assert.Equal(t, "SPDXRef-Image", image.SPDXID)
+	assert.Equal(t, "sha256:abc", image.VersionInfo)
+
+	assert.Equal(t, "monolog/monolog", composer.Name)
+	assert.Equal(t, "MIT", composer.LicenseDeclared)
+	assert.Equal(t, "found in /srv/app/composer.lock", composer.SourceInfo)
+	assert.Equal(t, "pkg:composer/monolog/monolog@2.8.0", composer.ExternalRefs[0].ReferenceLocator)
+
+	assert.Equal(t, "NOASSERTION", rpm.LicenseDeclared, "rpm licenses aren't SPDX expressions")
+	assert.Equal(t, "declared as GPLv3+ and GPLv3+ with exceptions", rpm.LicenseComments)
+	assert.Equal(t, "pkg:rpm/alpine/bash@5.1.8-4.el9?arch=x86_64&distro=alpine-3.16.0", rpm.ExternalRefs[0].ReferenceLocator)
+}
+
+func Test_imageSBOMCycloneDX(t *testing.T) {
+
+	sbom, _ := testImageSBOM(t)
+
+	var buff bytes.Buffer
+	assert.NoError(t, sbom.write(&buff, sbomCycloneDX))
+
+	var doc cycloneDXDocument
+	assert.NoError(t, json.Unmarshal(buff.Bytes(), &doc))
+
+	assert.Equal(t, "CycloneDX", doc.BOMFormat)
+	assert.Equal(t, "container", doc.Metadata.Component.Type)
+	assert.Len(t, doc.Components, 5)
+	assert.Equal(t, "operating-system", doc.Components[0].Type)
+	assert.Equal(t, "pkg:apk/alpine/musl@1.2.3-r0?arch=x86_64&distro=alpine-3.16.0", doc.Components[1].PURL)
+	assert.Equal(t, "MIT", doc.Components[1].Licenses[0].License.Name)
+
+	assert.Error(t, sbom.write(&buff, "swid"))
+}
+
+func Test_sbomDirectory(t *testing.T) {
+
+	assert.Equal(t, ".", sbomDirectory())
+
+	ReportJSON = "-"
+	ReportJUnit = filepath.Join("reports", "build.xml")
+	defer func() { ReportJSON = ""; ReportJUnit = "" }()
+
+	assert.Equal(t, "reports", sbomDirectory(), "SBOMs go next to the build report")
+
+	SBOMDir = "sboms"
+	defer func() { SBOMDir = "" }()
+
+	assert.Equal(t, "sboms", sbomDirectory())
+
+	assert.Equal(t, "superterran_mach_php-8.1.spdx.json", sbomFilename("superterran/mach:php-8.1", sbomSPDX))
+	assert.Equal(t, "superterran_mach_php-8.1.cdx.json", sbomFilename("superterran/mach:php-8.1", sbomCycloneDX))
+}
+
+func Test_imageSBOMWriteFile(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "mach-sbom")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sbom, _ := testImageSBOM(t)
+
+	path, err := sbom.writeFile(filepath.Join(dir, "sboms"), sbomCycloneDX)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "sboms", "superterran_mach_php.cdx.json"), path)
+	assert.FileExists(t, path)
+}
@@ -0,0 +1,456 @@
+// Cmd scan matches the packages in built images against a local database of OSV advisories, fully offline
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v3"
+)
+
+var scanCmd = CreateScanCmd()
+
+// ScanImages scans every built image before pushing it, set with `--scan`
+var ScanImages bool = false
+
+// ScanFailOn is the lowest severity that fails a scan, or `none`. Set with `scan_fail_on` in config, or `--fail-on`
+var ScanFailOn string = severityHigh
+
+// ScanIgnoreFile lists the advisories to ignore until a date, set with `scan_ignore_file` in config
+var ScanIgnoreFile string = ".mach-scan-ignore.yaml"
+
+// ScanFormat is how `mach scan` reports findings, `text` or `json`, set with `--format`
+var ScanFormat string = "text"
+
+// scanIgnoreDateFormat is the format of the expiry dates in the ignore file
+const scanIgnoreDateFormat = "2006-01-02"
+
+// scanIgnoreList is the ignore file
+type scanIgnoreList struct {
+	Ignore []scanIgnore `yaml:"ignore"`
+}
+
+// scanIgnore ignores an advisory, by ID or alias, optionally for a single package. Every entry has to
+// expire, after the expiry date it no longer applies.
+type scanIgnore struct {
+	ID      string `yaml:"id"`
+	Package string `yaml:"package"`
+	Reason  string `yaml:"reason"`
+	Expires string `yaml:"expires"`
+	expires time.Time
+}
+
+// scanResult is what a scan found in an image
+type scanResult struct {
+	Tag      string        `json:"tag"`
+	Packages int           `json:"packages"`
+	Findings []vulnFinding `json:"findings"`
+	// Failing counts the findings that fail the scan
+	Failing int `json:"failing"`
+}
+
+// scanFailure is an image with findings at or above the ScanFailOn severity
+type scanFailure struct {
+	Count  int
+	FailOn string
+}
+
+func (e *scanFailure) Error() string {
+	return fmt.Sprintf("%d vulnerabilit(ies) at or above %s severity", e.Count, e.FailOn)
+}
+
+func (e *scanFailure) ExitCode() int {
+	return ExitScanFailure
+}
+
+func CreateScanCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "scan [docker-image[:tag]]",
+		Short: "Matches the packages of built images against a local advisory database",
+		Long: `Exports the image last built from each Dockerfile, or those passed as arguments, finds the OS packages
+	and lockfile packages in it and matches them against the OSV advisories synced into the advisory_dir. Nothing
+	is looked up over the network. Findings at or above the --fail-on severity fail the scan, unless they are in
+	the ignore file and the entry hasn't expired.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runScan(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(scanCmd)
+
+	scanCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+	scanCmd.Flags().StringVar(&ScanFormat, "format", ScanFormat, "output format, text or json")
+
+	scanCmd.Flags().String("db", AdvisoryDir, "directory of OSV advisories, JSON files or zip exports")
+	viper.BindPFlag("advisory_dir", scanCmd.Flags().Lookup("db"))
+
+	scanCmd.Flags().String("fail-on", ScanFailOn, "lowest severity that fails the scan: critical, high, medium, low, unknown or none")
+	viper.SetDefault("scan_fail_on", ScanFailOn)
+	viper.BindPFlag("scan_fail_on", scanCmd.Flags().Lookup("fail-on"))
+
+	scanCmd.Flags().String("ignore-file", ScanIgnoreFile, "file of advisories to ignore until a date")
+	viper.SetDefault("scan_ignore_file", ScanIgnoreFile)
+	viper.BindPFlag("scan_ignore_file", scanCmd.Flags().Lookup("ignore-file"))
+
+}
+
+func runScan(cmd *cobra.Command, args []string) error {
+
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	BuildVariantFromParam = viper.GetString("variant")
+
+	AdvisoryDir = viper.GetString("advisory_dir")
+
+	ScanFailOn = viper.GetString("scan_fail_on")
+
+	ScanIgnoreFile = viper.GetString("scan_ignore_file")
+
+	return MainScanFlow(cmd.OutOrStdout(), args)
+}
+
+// MainScanFlow scans the images of the Dockerfiles matching the arguments, or every Dockerfile in the build
+// directory, writing the findings to w in ScanFormat. Images with failing findings come back as buildFailures.
+func MainScanFlow(w io.Writer, args []string) error {
+
+	if ScanFormat != "text" && ScanFormat != "json" {
+		return fmt.Errorf("unknown format %q, use text or json", ScanFormat)
+	}
+
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return err
+	}
+
+	results := []*scanResult{}
+	var failures buildFailures
+
+	for _, filename := range findDockerfiles(args) {
+		tag := getTag(filename)
+
+		contents, err := readImagePackages(context.Background(), cli, tag)
+		if err != nil {
+			return fmt.Errorf("%s: %v", tag, err)
+		}
+
+		result, err := scanImage(tag, contents, func(msg string) {
+			color.New(color.FgYellow).Fprintln(os.Stderr, msg)
+		})
+		if err != nil {
+			return err
+		}
+
+		results = append(results, result)
+
+		if ScanFormat == "text" {
+			if err := result.writeTable(w); err != nil {
+				return err
+			}
+		}
+
+		if err := result.failure(); err != nil {
+			failures = append(failures, newBuildError(stageScan, tag, err))
+		}
+	}
+
+	if ScanFormat == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			return err
+		}
+	}
+
+	if len(failures) > 0 {
+		return failures
+	}
+
+	return nil
+}
+
+// scanBuiltImage scans a freshly built image, printing what fails it and recording the counts on the build
+func scanBuiltImage(build *imageBuild, out io.Writer) error {
+
+	contents, err := build.packages()
+	if err != nil {
+		return err
+	}
+
+	result, err := scanImage(build.Tag, contents, func(msg string) {
+		printStatus(out, color.New(color.FgYellow), msg)
+	})
+	if err != nil {
+		return err
+	}
+
+	build.Vulnerabilities = result.counts()
+
+	for _, finding := range result.Findings {
+		if finding.failing() {
+			printStatus(out, color.New(color.FgRed), fmt.Sprintf("%s: %s %s in %s %s%s", build.Tag, finding.Severity, finding.ID, finding.Package, finding.Version, finding.fixedIn()))
+		}
+	}
+
+	c := color.New(color.FgGreen)
+	if result.Failing > 0 {
+		c = color.New(color.FgRed)
+	}
+	printStatus(out, c, fmt.Sprintf("scanned %s, %s", build.Tag, result.summary()))
+
+	return result.failure()
+}
+
+// scanImage matches the contents of an image against the AdvisoryDir database and applies the ignore file,
+// expired ignores are passed to warn
+func scanImage(tag string, contents *imageContents, warn func(string)) (*scanResult, error) {
+
+	if _, ok := vulnSeverityRank[ScanFailOn]; !ok && ScanFailOn != "none" {
+		return nil, fmt.Errorf("unknown severity %q, use critical, high, medium, low, unknown or none", ScanFailOn)
+	}
+
+	db, err := loadAdvisoryDB(AdvisoryDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ignores, err := loadScanIgnores(ScanIgnoreFile)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &scanResult{Tag: tag, Packages: len(contents.Packages), Findings: db.match(contents)}
+	if result.Findings == nil {
+		result.Findings = []vulnFinding{}
+	}
+
+	for _, expired := range applyScanIgnores(result.Findings, ignores, time.Now()) {
+		warn(fmt.Sprintf("%s: ignore of %s expired on %s and no longer applies", tag, expired.ID, expired.Expires))
+	}
+
+	for _, finding := range result.Findings {
+		if finding.failing() {
+			result.Failing++
+		}
+	}
+
+	return result, nil
+}
+
+// loadScanIgnores reads the ignore file, there being none is not an error
+func loadScanIgnores(filename string) ([]scanIgnore, error) {
+
+	if filename == "" {
+		return nil, nil
+	}
+
+	content, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	list := scanIgnoreList{}
+	if err := yaml.Unmarshal(content, &list); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	for i, ignore := range list.Ignore {
+		if ignore.ID == "" {
+			return nil, fmt.Errorf("%s: entry %d has no id", filename, i+1)
+		}
+
+		if ignore.Expires == "" {
+			return nil, fmt.Errorf("%s: ignore of %s has no expires date", filename, ignore.ID)
+		}
+
+		expires, err := time.Parse(scanIgnoreDateFormat, ignore.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("%s: ignore of %s expires on %q, use YYYY-MM-DD", filename, ignore.ID, ignore.Expires)
+		}
+
+		// an ignore lasts until the end of the day it expires on
+		list.Ignore[i].expires = expires.AddDate(0, 0, 1)
+	}
+
+	return list.Ignore, nil
+}
+
+// applyScanIgnores marks the findings ignored by entries that haven't expired, and returns the expired
+// entries that would have ignored a finding
+func applyScanIgnores(findings []vulnFinding, ignores []scanIgnore, now time.Time) []scanIgnore {
+
+	var expired []scanIgnore
+	warned := map[int]bool{}
+
+	for i := range findings {
+		for j, ignore := range ignores {
+			if !ignore.matches(findings[i]) {
+				continue
+			}
+
+			if !now.Before(ignore.expires) {
+				if !warned[j] {
+					warned[j] = true
+					expired = append(expired, ignore)
+				}
+				continue
+			}
+
+			findings[i].Ignored = ignore.Reason
+			if findings[i].Ignored == "" {
+				findings[i].Ignored = "ignored until " + ignore.Expires
+			}
+			break
+		}
+	}
+
+	return expired
+}
+
+// matches reports if an ignore applies to a finding, by its ID or one of its aliases
+func (i scanIgnore) matches(finding vulnFinding) bool {
+
+	if i.Package != "" && i.Package != finding.Package {
+		return false
+	}
+
+	if strings.EqualFold(i.ID, finding.ID) {
+		return true
+	}
+
+	for _, alias := range finding.Aliases {
+		if strings.EqualFold(i.ID, alias) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// failing reports if a finding fails the scan at the ScanFailOn severity
+func (f vulnFinding) failing() bool {
+
+	if f.Ignored != "" || ScanFailOn == "none" {
+		return false
+	}
+
+	return vulnSeverityRank[f.Severity] >= vulnSeverityRank[ScanFailOn]
+}
+
+func (f vulnFinding) fixedIn() string {
+
+	if f.Fixed == "" {
+		return ""
+	}
+
+	return ", fixed in " + f.Fixed
+}
+
+// failure returns the scanFailure when findings fail the scan
+func (r *scanResult) failure() error {
+
+	if r.Failing == 0 {
+		return nil
+	}
+
+	return &scanFailure{Count: r.Failing, FailOn: ScanFailOn}
+}
+
+// counts returns how many findings there are of each severity, leaving out ignored ones
+func (r *scanResult) counts() map[string]int {
+
+	counts := map[string]int{}
+	for _, finding := range r.Findings {
+		if finding.Ignored == "" {
+			counts[finding.Severity]++
+		}
+	}
+
+	return counts
+}
+
+// summary describes the findings, `3 vulnerabilities in 120 packages: 1 critical, 2 low, 1 ignored`
+func (r *scanResult) summary() string {
+
+	counts := r.counts()
+
+	var parts []string
+	for _, severity := range []string{severityCritical, severityHigh, severityMedium, severityLow, severityUnknown} {
+		if counts[severity] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[severity], severity))
+		}
+	}
+
+	ignored := len(r.Findings)
+	for _, count := range counts {
+		ignored -= count
+	}
+	if ignored > 0 {
+		parts = append(parts, fmt.Sprintf("%d ignored", ignored))
+	}
+
+	summary := fmt.Sprintf("%d vulnerabilities in %d packages", len(r.Findings)-ignored, r.Packages)
+	if len(parts) > 0 {
+		summary += ": " + strings.Join(parts, ", ")
+	}
+
+	return summary
+}
+
+// writeTable writes the findings of an image as a table, followed by the summary
+func (r *scanResult) writeTable(w io.Writer) error {
+
+	fmt.Fprintln(w, r.Tag)
+
+	if len(r.Findings) > 0 {
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+		fmt.Fprintln(tw, "SEVERITY\tID\tPACKAGE\tVERSION\tFIXED IN\tSOURCE\tIGNORED")
+
+		findings := append([]vulnFinding{}, r.Findings...)
+		sort.SliceStable(findings, func(i, j int) bool { return findings[i].Ignored == "" && findings[j].Ignored != "" })
+
+		for _, f := range findings {
+			fixed, ignored := f.Fixed, f.Ignored
+			if fixed == "" {
+				fixed = "-"
+			}
+			if ignored == "" {
+				ignored = "-"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", f.Severity, f.ID, f.Package, f.Version, fixed, f.Source, ignored)
+		}
+
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	_, err := fmt.Fprintln(w, r.summary())
+
+	return err
+}
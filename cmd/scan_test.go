@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// setupScan points the scan at the test advisories and an ignore file, putting the settings back afterwards
+func setupScan(t *testing.T, ignoreFile string) {
+
+	dir := writeTestAdvisories(t)
+
+	path := filepath.Join(dir, "ignore.yaml")
+	if err := ioutil.WriteFile(path, []byte(ignoreFile), 0644); err != nil {
+		assert.FailNow(t, err.Error())
+	}
+
+	AdvisoryDir, ScanIgnoreFile, ScanFailOn = dir, path, severityHigh
+
+	t.Cleanup(func() {
+		AdvisoryDir, ScanIgnoreFile, ScanFailOn = "", ".mach-scan-ignore.yaml", severityHigh
+	})
+}
+
+func Test_loadScanIgnores(t *testing.T) {
+
+	ignores, err := loadScanIgnores("does-not-exist.yaml")
+	assert.NoError(t, err, "the ignore file is optional")
+	assert.Nil(t, ignores)
+
+	dir, _ := ioutil.TempDir("", "mach-scan")
+	defer os.RemoveAll(dir)
+
+	for content, valid := range map[string]bool{
+		"ignore:\n  - id: CVE-2023-0286\n    expires: 2023-03-01\n":   true,
+		"ignore:\n  - id: CVE-2023-0286\n":                            false,
+		"ignore:\n  - id: CVE-2023-0286\n    expires: next week\n":    false,
+		"ignore:\n  - package: openssl\n    expires: 2023-03-01\n":    false,
+		"ignore:\n  - id: CVE-2023-0286\n    expires: [2023-03-01]\n": false,
+	} {
+		path := filepath.Join(dir, "ignore.yaml")
+		ioutil.WriteFile(path, []byte(content), 0644)
+
+		_, err := loadScanIgnores(path)
+		assert.Equal(t, valid, err == nil, content)
+	}
+}
+
+func Test_applyScanIgnores(t *testing.T) {
+
+	findings := []vulnFinding{
+		{ID: "DSA-5343-1", Aliases: []string{"CVE-2023-0286"}, Package: "openssl"},
+		{ID: "GHSA-35jh-r3h4-6jhm", Package: "lodash"},
+		{ID: "PYSEC-2022-1", Package: "Django"},
+	}
+
+	day := func(date string) time.Time {
+		parsed, _ := time.Parse(scanIgnoreDateFormat, date)
+		return parsed.AddDate(0, 0, 1)
+	}
+
+	ignores := []scanIgnore{
+		{ID: "cve-2023-0286", Reason: "no X.400 addresses", Expires: "2023-03-01", expires: day("2023-03-01")},
+		{ID: "GHSA-35jh-r3h4-6jhm", Package: "underscore", Expires: "2023-03-01", expires: day("2023-03-01")},
+		{ID: "PYSEC-2022-1", Expires: "2023-02-01", expires: day("2023-02-01")},
+	}
+
+	now := time.Date(2023, 3, 1, 23, 0, 0, 0, time.UTC)
+
+	expired := applyScanIgnores(findings, ignores, now)
+
+	assert.Equal(t, "no X.400 addresses", findings[0].Ignored, "ignores match aliases, until the end of the day")
+	assert.Equal(t, "", findings[1].Ignored, "the ignore is for another package")
+	assert.Equal(t, "", findings[2].Ignored)
+
+	if assert.Len(t, expired, 1) {
+		assert.Equal(t, "PYSEC-2022-1", expired[0].ID)
+	}
+
+	findings[0].Ignored = ""
+	applyScanIgnores(findings, ignores[1:], time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, "ignored until 2023-02-01", findings[2].Ignored)
+}
+
+func Test_scanImage(t *testing.T) {
+
+	setupScan(t, "ignore:\n  - id: GHSA-35jh-r3h4-6jhm\n    reason: not reachable\n    expires: 2999-01-01\n"+
+		"  - id: CVE-2023-0286\n    expires: 2001-01-01\n")
+
+	var warnings []string
+	result, err := scanImage("superterran/mach:php", testImageContents(), func(msg string) { warnings = append(warnings, msg) })
+	assert.NoError(t, err)
+
+	assert.Len(t, result.Findings, 3)
+	assert.Equal(t, 1, result.Failing, "the critical django finding, lodash is ignored and openssl has no severity")
+	assert.Equal(t, []string{"superterran/mach:php: ignore of CVE-2023-0286 expired on 2001-01-01 and no longer applies"}, warnings)
+	assert.Equal(t, map[string]int{severityCritical: 1, severityUnknown: 1}, result.counts())
+	assert.Equal(t, "2 vulnerabilities in 5 packages: 1 critical, 1 unknown, 1 ignored", result.summary())
+
+	err = result.failure()
+	assert.Equal(t, ExitScanFailure, exitCode(err))
+	assert.Equal(t, "1 vulnerabilit(ies) at or above high severity", err.Error())
+
+	ScanFailOn = severityUnknown
+	result, _ = scanImage("superterran/mach:php", testImageContents(), func(string) {})
+	assert.Equal(t, 2, result.Failing, "unknown fails on everything")
+
+	ScanFailOn = "none"
+	result, _ = scanImage("superterran/mach:php", testImageContents(), func(string) {})
+	assert.NoError(t, result.failure())
+
+	ScanFailOn = "severe"
+	_, err = scanImage("superterran/mach:php", testImageContents(), func(string) {})
+	assert.Error(t, err)
+}
+
+func Test_scanResultWriteTable(t *testing.T) {
+
+	setupScan(t, "ignore:\n  - id: GHSA-35jh-r3h4-6jhm\n    reason: not reachable\n    expires: 2999-01-01\n")
+
+	result, err := scanImage("superterran/mach:php", testImageContents(), func(string) {})
+	assert.NoError(t, err)
+
+	var buff bytes.Buffer
+	assert.NoError(t, result.writeTable(&buff))
+
+	lines := strings.Split(strings.TrimSpace(buff.String()), "\n")
+
+	assert.Len(t, lines, 6)
+	assert.Equal(t, "superterran/mach:php", lines[0])
+	assert.Regexp(t, `^SEVERITY\s+ID\s+PACKAGE`, lines[1])
+	assert.Regexp(t, `^critical\s+PYSEC-2022-1\s+Django\s+3.2.11\s+3.2.12\s+/srv/app/Pipfile.lock\s+-$`, lines[2])
+	assert.Regexp(t, `^high\s+GHSA-35jh-r3h4-6jhm\s+lodash.*not reachable$`, lines[4], "ignored findings come last")
+	assert.Equal(t, "2 vulnerabilities in 5 packages: 1 critical, 1 unknown, 1 ignored", lines[5])
+}
+
+func Test_scanBuiltImage(t *testing.T) {
+
+	setupScan(t, "")
+
+	build := &imageBuild{Tag: "superterran/mach:php", contents: testImageContents()}
+
+	var out bytes.Buffer
+	err := scanBuiltImage(build, &out)
+
+	assert.Equal(t, ExitScanFailure, exitCode(err))
+	assert.Equal(t, map[string]int{severityCritical: 1, severityHigh: 1, severityUnknown: 1}, build.Vulnerabilities)
+	assert.Contains(t, out.String(), "superterran/mach:php: critical PYSEC-2022-1 in Django 3.2.11, fixed in 3.2.12\n")
+	assert.Contains(t, out.String(), "scanned superterran/mach:php, 3 vulnerabilities in 5 packages")
+
+	ScanFailOn = severityCritical
+	build.contents = &imageContents{Packages: []imagePackage{{Name: "lodash", Version: "4.17.21", Type: "npm"}}}
+
+	out.Reset()
+	assert.NoError(t, scanBuiltImage(build, &out))
+	assert.Equal(t, "scanned superterran/mach:php, 0 vulnerabilities in 1 packages\n", out.String())
+}
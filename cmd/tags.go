@@ -0,0 +1,297 @@
+// Cmd tags works out the tags an image gets from the tag templates, and prints them with `mach tags`
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var tagsCmd = CreateTagsCmd()
+
+// DefaultTagTemplate gives images the tags mach has always given them, `v1-php-go-feature` for
+// `php/Dockerfile-go` with an API_VERSION of `v1` on the `feature` branch.
+const DefaultTagTemplate = "{{.APIVersion}}{{.Name}}{{.Variant}}{{.BranchSuffix}}"
+
+// maxTagLength is the longest tag the docker registry accepts
+const maxTagLength = 128
+
+// invalidTagChars matches runs of characters that can't be used in a docker tag
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]+`)
+
+func CreateTagsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "tags [docker-image[:tag]]",
+		Short: "Prints the tags each Dockerfile would be built with",
+		Long: `Renders the tag templates for every Dockerfile in the build directory, or the images
+	passed as arguments, and prints the tags without building anything.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cmd.SilenceUsage = true
+			return runTags(cmd, args)
+		},
+	}
+	return cmd
+}
+
+func init() {
+
+	rootCmd.AddCommand(tagsCmd)
+
+	tagsCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is loaded from working dir)")
+
+}
+
+func runTags(cmd *cobra.Command, args []string) error {
+
+	BuildImageDirname = viper.GetString("BuildImageDirname")
+
+	ImageNameSeparator = viper.GetString("image_name_separator")
+
+	DockerRegistry = viper.GetString("docker_registry")
+
+	BuildVariantFromParam = viper.GetString("variant")
+
+	return MainTagsFlow(cmd.OutOrStdout(), args)
+}
+
+// MainTagsFlow prints the tags of the Dockerfiles matching the arguments, or of every Dockerfile in the
+// build directory, the first tag listed is the one the image is built with.
+func MainTagsFlow(w io.Writer, args []string) error {
+
+	for _, filename := range findDockerfiles(args) {
+		tags, err := imageTags(filename)
+		if err != nil {
+			return err
+		}
+
+		manifest, err := loadImageManifest(filename)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(w, filename)
+		for _, tag := range appendUnique(tags, manifest.extraTags()...) {
+			fmt.Fprintln(w, "  "+tag)
+		}
+	}
+
+	return nil
+}
+
+// tagContext is the data tag templates are executed with. The fields ending up in the default tag come with
+// their separators, so that missing ones don't leave stray dashes behind.
+type tagContext struct {
+	// Name is the image name, its path in the build directory joined with the image_name_separator, `php-8.1`
+	Name string
+	// Path is the path of the image in the build directory, `php/8.1`
+	Path string
+	// Dir is the directory the Dockerfile lives in, `8.1`
+	Dir string
+	// Version is the content of the API_VERSION file for the image, if there is one
+	Version string
+	// APIVersion is the Version followed by a dash, or empty
+	APIVersion string
+	// FileVariant is the variant from the filename, `go` for `Dockerfile-go`
+	FileVariant string
+	// Variant is the FileVariant preceded by a dash. It is left empty when it is the same as the Version and
+	// there is no BranchSuffix, so `Dockerfile-v1` next to an API_VERSION of `v1` isn't tagged `v1-php-v1`.
+	Variant string
+	// Branch is the current git branch, empty with a detached HEAD
+	Branch string
+	// BranchSuffix is the branch preceded by a dash, empty on the default branch, for a release or when the
+	// branch is named after the Version. The `--variant` flag replaces it.
+	BranchSuffix string
+	// Release is the git tag at HEAD, set for release builds
+	Release string
+	// SHA is the short hash of the current git commit
+	SHA string
+	// Date is today, as `20060102`
+	Date string
+	// VariantTag is the Version, FileVariant and branch joined by dashes, or `latest` when they are all empty.
+	// This is the tag of images that have their own repository.
+	VariantTag string
+	// Registry is the docker registry repository images are pushed to
+	Registry string
+	// Repository is the repository of an image that has its own, empty when it is a tag in the Registry
+	Repository string
+}
+
+func newTagContext(filename string) tagContext {
+
+	ref := currentGitRef()
+	version := strings.TrimSpace(strings.TrimSuffix(getApiVersion(filename), "-"))
+
+	ctx := tagContext{
+		Name:        imageName(filename),
+		Path:        imagePath(filename),
+		Dir:         filepath.Base(filepath.Dir(filename)),
+		Version:     version,
+		FileVariant: fileVariant(filename),
+		Branch:      ref.Branch,
+		Release:     ref.Release,
+		SHA:         ref.SHA,
+		Date:        time.Now().Format("20060102"),
+		Registry:    DockerRegistry,
+		Repository:  imageRepository(filename),
+	}
+
+	if version != "" {
+		ctx.APIVersion = version + "-"
+	}
+
+	ctx.setBranchSuffix(getBranchVariant())
+
+	return ctx
+}
+
+// setBranchSuffix sets the BranchSuffix, and the Variant and VariantTag that depend on it
+func (ctx *tagContext) setBranchSuffix(suffix string) {
+
+	ctx.BranchSuffix, ctx.Variant = "", ""
+
+	if ctx.Version == "" || suffix != "-"+ctx.Version {
+		ctx.BranchSuffix = suffix
+	}
+
+	if ctx.FileVariant != "" && (ctx.FileVariant != ctx.Version || ctx.BranchSuffix != "") {
+		ctx.Variant = "-" + ctx.FileVariant
+	}
+
+	var parts []string
+	for _, part := range []string{ctx.Version, strings.TrimPrefix(ctx.Variant, "-"), strings.TrimPrefix(ctx.BranchSuffix, "-")} {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+
+	ctx.VariantTag = "latest"
+	if len(parts) > 0 {
+		ctx.VariantTag = strings.Join(parts, "-")
+	}
+}
+
+// tagTemplates returns the tag templates for a Dockerfile: `tag_templates` from its image manifest, otherwise
+// `tag_template` from config, which can be a single template or a list, otherwise DefaultTagTemplate. Images
+// with their own repository use `repository_tag_template` and DefaultRepositoryTagTemplate instead.
+func tagTemplates(filename string) []string {
+
+	manifest, err := loadImageManifest(filename)
+	if err == nil && len(manifest.TagTemplates) > 0 {
+		return manifest.TagTemplates
+	}
+
+	key, def := "tag_template", DefaultTagTemplate
+	if err == nil && manifest.Repository != "" {
+		key, def = "repository_tag_template", DefaultRepositoryTagTemplate
+	}
+
+	switch configured := viper.Get(key).(type) {
+	case string:
+		if configured != "" {
+			return []string{configured}
+		}
+	case []interface{}, []string:
+		if templates := viper.GetStringSlice(key); len(templates) > 0 {
+			return templates
+		}
+	}
+
+	return []string{def}
+}
+
+// imageTags renders the tag templates for a Dockerfile into full image tags, in the repository of the image or
+// the docker registry. The first is the tag the image is built with, templates that render to nothing are left
+// out, as are duplicates.
+func imageTags(filename string) ([]string, error) {
+
+	return renderTags(filename, newTagContext(filename))
+}
+
+// renderTags renders the tag templates for a Dockerfile with the given context
+func renderTags(filename string, ctx tagContext) ([]string, error) {
+
+	repository := ctx.Repository
+	if repository == "" {
+		repository = DockerRegistry
+	}
+
+	var tags []string
+
+	for _, text := range tagTemplates(filename) {
+		tpl := template.New("tag")
+		if _, err := tpl.Funcs(templateFuncs(tpl, filepath.Dir(filename))).Parse(text); err != nil {
+			return nil, fmt.Errorf("tag template %q: %v", text, err)
+		}
+
+		var rendered bytes.Buffer
+		if err := tpl.Execute(&rendered, ctx); err != nil {
+			return nil, fmt.Errorf("tag template %q: %v", text, err)
+		}
+
+		tag := strings.TrimSpace(rendered.String())
+		if tag == "" {
+			continue
+		}
+
+		tag = sanitizeTag(tag)
+
+		if repository != "" {
+			tag = repository + ":" + tag
+		}
+
+		tags = appendUnique(tags, tag)
+	}
+
+	if len(tags) == 0 {
+		return nil, fmt.Errorf("%s: the tag templates did not produce a tag", filename)
+	}
+
+	return tags, nil
+}
+
+// sanitizeTag turns a rendered tag into a valid docker tag: characters that aren't allowed become dashes, and
+// it is cut down to maxTagLength. When that changes anything, a short hash of the original is appended, so
+// `feature/new-php` and `feature-new-php` don't end up overwriting each other.
+func sanitizeTag(tag string) string {
+
+	clean := strings.TrimLeft(invalidTagChars.ReplaceAllString(tag, "-"), ".-")
+	if clean == tag && len(clean) <= maxTagLength {
+		return tag
+	}
+
+	sum := sha256.Sum256([]byte(tag))
+	suffix := hex.EncodeToString(sum[:])[:7]
+
+	if len(clean) > maxTagLength-len(suffix)-1 {
+		clean = clean[:maxTagLength-len(suffix)-1]
+	}
+
+	clean = strings.TrimRight(clean, ".-")
+	if clean == "" {
+		return suffix
+	}
+
+	return clean + "-" + suffix
+}
+
+// appendUnique appends the values that are not in the list yet
+func appendUnique(list []string, values ...string) []string {
+
+	for _, value := range values {
+		if !contains(list, value) {
+			list = append(list, value)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newTagContext(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", "API_VERSION"), []byte("8.1\n"), 0644)
+
+	ctx := newTagContext(filepath.Join(dir, "php", "Dockerfile-fpm.tpl"))
+	assert.Equal(t, "php", ctx.Dir)
+	assert.Equal(t, "8.1", ctx.Version)
+	assert.Equal(t, "8.1-", ctx.APIVersion)
+	assert.Equal(t, "fpm", ctx.FileVariant)
+	assert.Equal(t, "-fpm", ctx.Variant)
+
+	ctx = newTagContext(filepath.Join(dir, "php", "Dockerfile-8.1"))
+	assert.Equal(t, "", ctx.Variant, "a variant named after the API version should not be repeated")
+
+	BuildVariantFromParam = "rc"
+	defer func() { BuildVariantFromParam = "" }()
+
+	ctx = newTagContext(filepath.Join(dir, "php", "Dockerfile-8.1"))
+	assert.Equal(t, "-rc", ctx.BranchSuffix)
+	assert.Equal(t, "-8.1", ctx.Variant)
+}
+
+func Test_imageTagsDefaultTemplate(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+
+	tags, err := imageTags("../examples/images/example/Dockerfile-template.tpl")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"superterran/mach:v1-example-template"}, tags)
+}
+
+func Test_imageTagsTemplates(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n", "node": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", "API_VERSION"), []byte("8.1"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "node", ImageManifestFilename), []byte("tag_templates: ['node-{{ .Dir | upper }}']\n"), 0644)
+
+	DockerRegistry = "superterran/mach"
+	viper.Set("tag_template", []string{"{{.Version}}", "{{.Version}}-{{.Date}}", "{{ if .Branch }}{{.Version}}-{{.Branch}}{{ end }}", "{{.Version}}"})
+	defer viper.Set("tag_template", nil)
+
+	tags, err := imageTags(filepath.Join(dir, "php", "Dockerfile"))
+	assert.NoError(t, err)
+	assert.Equal(t, "superterran/mach:8.1", tags[0], "the first template gives the tag the image is built with")
+	assert.Len(t, tags, 2, "empty and duplicate tags should be left out")
+
+	tags, err = imageTags(filepath.Join(dir, "node", "Dockerfile"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"superterran/mach:node-NODE"}, tags, "the image manifest should replace the config")
+
+	viper.Set("tag_template", "{{ .Nope }}")
+
+	_, err = imageTags(filepath.Join(dir, "php", "Dockerfile"))
+	assert.Error(t, err)
+	assert.Equal(t, "superterran/mach:8.1-php", getTag(filepath.Join(dir, "php", "Dockerfile")), "getTag should fall back to the default template")
+}
+
+func Test_sanitizeTag(t *testing.T) {
+
+	assert.Equal(t, "v1-php-main", sanitizeTag("v1-php-main"), "valid tags should be left alone")
+
+	slash := sanitizeTag("v1-php-feature/new-php")
+	assert.Regexp(t, `^v1-php-feature-new-php-[0-9a-f]{7}$`, slash)
+	assert.NotEqual(t, sanitizeTag("v1-php-feature-new-php"), slash, "sanitized tags should not collide with real ones")
+
+	assert.Regexp(t, `^fix-[0-9a-f]{7}$`, sanitizeTag(".-fix"))
+
+	long := sanitizeTag("php-" + strings.Repeat("a", 200))
+	assert.Len(t, long, maxTagLength)
+	assert.NotEqual(t, long, sanitizeTag("php-"+strings.Repeat("a", 201)))
+}
+
+func Test_MainTagsFlow(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildImageDirname = "../examples/images"
+	defer func() { BuildImageDirname = "." }()
+
+	var buff bytes.Buffer
+	assert.NoError(t, MainTagsFlow(&buff, []string{"example:go"}))
+
+	assert.Contains(t, buff.String(), "../examples/images/example/Dockerfile-go\n  superterran/mach:v1-example-go\n")
+}
@@ -0,0 +1,295 @@
+// Cmd targets pushes built images to every registry they are published to
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/fatih/color"
+	"github.com/spf13/viper"
+)
+
+// pushTarget is a registry images are pushed to, set as a list under `push_targets` in config
+type pushTarget struct {
+	// Name is shown when reporting on the target, defaults to the repository
+	Name string `mapstructure:"name"`
+	// Host is the registry, the docker hub when empty
+	Host string `mapstructure:"host"`
+	// Repository is the repository in the registry, like `superterran/mach`
+	Repository string `mapstructure:"repository"`
+	// Username and Password for the registry, without them the docker cli credentials are used
+	Username string `mapstructure:"username"`
+	Password string `mapstructure:"password"`
+	// Tags limits the target to tags matching one of these patterns, like `php-*`
+	Tags []string `mapstructure:"tags"`
+}
+
+// pushResult is the outcome of pushing one tag to one target
+type pushResult struct {
+	Target string `json:"target"`
+	Tag    string `json:"tag"`
+	Digest string `json:"digest,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// pushFunc retags the source image as ref and pushes it with the given credentials, returning the digest
+type pushFunc func(source string, ref string, auth types.AuthConfig, out io.Writer) (string, error)
+
+// pushTargets returns the push targets from config, none means tags are pushed as they are built
+func pushTargets() ([]pushTarget, error) {
+
+	var targets []pushTarget
+	if err := viper.UnmarshalKey("push_targets", &targets); err != nil {
+		return nil, fmt.Errorf("push_targets: %v", err)
+	}
+
+	return targets, nil
+}
+
+// repository returns the repository images are pushed to, including the registry host when it isn't the
+// docker hub.
+func (t pushTarget) repository() string {
+
+	key := registryAuthKey(t.Host)
+	if key == dockerHubAuthKey {
+		return t.Repository
+	}
+
+	return key + "/" + t.Repository
+}
+
+func (t pushTarget) name() string {
+
+	if t.Name != "" {
+		return t.Name
+	}
+
+	return t.repository()
+}
+
+// matches reports if a tag, without the repository, passes the tag filter of the target
+func (t pushTarget) matches(tag string) bool {
+
+	if len(t.Tags) == 0 {
+		return true
+	}
+
+	for _, pattern := range t.Tags {
+		if ok, _ := path.Match(pattern, tag); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// auth returns the credentials for the target
+func (t pushTarget) auth() (types.AuthConfig, error) {
+
+	key := registryAuthKey(t.Host)
+	if t.Username != "" {
+		return types.AuthConfig{Username: t.Username, Password: t.Password, ServerAddress: key}, nil
+	}
+
+	return registryAuth(key)
+}
+
+// tagName returns the tag part of an image reference, `php` for `superterran/mach:php`
+func tagName(ref string) string {
+
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return "latest"
+	}
+
+	return ref[i+1:]
+}
+
+// targetRef returns the reference a tag is pushed to a target as. A target without a repository stands
+// for pushing the tag as it was built. Images with their own repository keep it, only the registry host
+// of the target is used for them.
+func (t pushTarget) targetRef(tag string) string {
+
+	if t.Repository == "" {
+		return tag
+	}
+
+	ownRepository := repositoryOf(tag) != DockerRegistry
+	if DockerRegistry == "" {
+		// without a docker_registry, only the tags of images with their own repository have one
+		ownRepository = strings.Contains(tag, ":")
+	}
+
+	if ownRepository {
+		path := repositoryOf(tag)
+		if named, err := reference.ParseNormalizedNamed(tag); err == nil {
+			path = reference.Path(named)
+		}
+
+		if key := registryAuthKey(t.Host); key != dockerHubAuthKey {
+			path = key + "/" + path
+		}
+
+		return path + ":" + tagName(tag)
+	}
+
+	if DockerRegistry == "" {
+		// the tag of an image without any repository is all tag
+		return t.repository() + ":" + tag
+	}
+
+	return t.repository() + ":" + tagName(tag)
+}
+
+// foreignTags returns the extra tags in an image's manifest that are full references naming a registry of
+// their own, like `ghcr.io/org/php:8.1` for an image pushed to the docker hub. They are pushed where they say,
+// whatever the target.
+func foreignTags(filename string) map[string]bool {
+
+	manifest, err := loadImageManifest(filename)
+	if err != nil {
+		return nil
+	}
+
+	repository := manifest.Repository
+	if repository == "" {
+		repository = DockerRegistry
+	}
+
+	home := "docker.io"
+	if named, err := reference.ParseNormalizedNamed(repository); err == nil {
+		home = reference.Domain(named)
+	}
+
+	foreign := map[string]bool{}
+
+	for _, tag := range manifest.extraTags() {
+		if named, err := reference.ParseNormalizedNamed(tag); err == nil && reference.Domain(named) != home {
+			foreign[tag] = true
+		}
+	}
+
+	return foreign
+}
+
+// pushToTargets pushes every tag of a build to each target it passes the filter of, without any targets the
+// tags are pushed as they are. Foreign tags are pushed once, where they say, with the credentials of their
+// own registry. A failing target does not stop the others, the failures are returned together once
+// everything has been tried. Every push is recorded in build.Pushes, and the digests of the successful ones
+// in build.Digests.
+func pushToTargets(build *imageBuild, targets []pushTarget, out io.Writer, push pushFunc) error {
+
+	if len(targets) == 0 {
+		targets = []pushTarget{{Name: DockerRegistry}}
+	}
+
+	var failed []string
+
+	// pushOne pushes a tag as ref and records it, reporting if it worked
+	pushOne := func(name string, tag string, ref string, auth types.AuthConfig, err error) bool {
+
+		result := pushResult{Target: name, Tag: ref}
+
+		var digest string
+		if err == nil {
+			digest, err = push(tag, ref, auth, out)
+		}
+
+		if err != nil {
+			result.Error = err.Error()
+			printStatus(out, color.New(color.FgRed), fmt.Sprintf("push of %s to %s failed: %v", ref, name, err))
+		} else {
+			result.Digest = digest
+			if build.Digests == nil {
+				build.Digests = map[string]string{}
+			}
+			build.Digests[ref] = digest
+			printStatus(out, color.New(color.FgGreen), fmt.Sprintf("pushed %s to %s", ref, name))
+		}
+
+		build.Pushes = append(build.Pushes, result)
+
+		return err == nil
+	}
+
+	foreign := foreignTags(build.Filename)
+
+	for _, tag := range build.Tags {
+		if foreign[tag] {
+			auth, err := registryAuth(imageAuthKey(tag))
+			if name := repositoryOf(tag); !pushOne(name, tag, tag, auth, err) {
+				failed = append(failed, name)
+			}
+		}
+	}
+
+	for _, target := range targets {
+
+		var targetFailed bool
+
+		for _, tag := range build.Tags {
+
+			if foreign[tag] || !target.matches(tagName(tag)) {
+				continue
+			}
+
+			ref := target.targetRef(tag)
+
+			var auth types.AuthConfig
+			var err error
+			if target.Repository == "" && target.Username == "" {
+				auth, err = registryAuth(imageAuthKey(ref))
+			} else {
+				auth, err = target.auth()
+			}
+
+			if !pushOne(target.name(), tag, ref, auth, err) {
+				targetFailed = true
+			}
+		}
+
+		if targetFailed {
+			failed = append(failed, target.name())
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("push to %s failed", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// printStatus reports on a push or check, in colour on the terminal when out is nil
+func printStatus(out io.Writer, c *color.Color, msg string) {
+
+	if out == nil {
+		c.Println(msg)
+		return
+	}
+
+	fmt.Fprintln(out, msg)
+}
+
+// tagAndPushImage is the pushFunc used by builds, tagging the built image for the target before pushing it
+func tagAndPushImage(source string, ref string, auth types.AuthConfig, out io.Writer) (string, error) {
+
+	if ref != source {
+		cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		if err != nil {
+			return "", err
+		}
+
+		if err := cli.ImageTag(context.Background(), source, ref); err != nil {
+			return "", err
+		}
+	}
+
+	return pushImageWithAuth(ref, auth, out)
+}
@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_pushTargets(t *testing.T) {
+
+	viper.Set("push_targets", []map[string]interface{}{
+		{"repository": "superterran/mach"},
+		{"name": "mirror", "host": "https://registry.example.com:5000", "repository": "mach", "username": "ci", "password": "secret", "tags": []string{"php-*"}},
+	})
+	defer viper.Set("push_targets", nil)
+
+	targets, err := pushTargets()
+	assert.NoError(t, err)
+	assert.Len(t, targets, 2)
+
+	assert.Equal(t, "superterran/mach", targets[0].name())
+	assert.Equal(t, "superterran/mach:php", targets[0].targetRef("superterran/mach:php"))
+
+	assert.Equal(t, "mirror", targets[1].name())
+	assert.Equal(t, "registry.example.com:5000/mach:php-8.1", targets[1].targetRef("superterran/mach:php-8.1"))
+	assert.True(t, targets[1].matches("php-8.1"))
+	assert.False(t, targets[1].matches("node"))
+
+	auth, err := targets[1].auth()
+	assert.NoError(t, err)
+	assert.Equal(t, "ci", auth.Username)
+	assert.Equal(t, "registry.example.com:5000", auth.ServerAddress)
+}
+
+func Test_pushTargetsMalformed(t *testing.T) {
+
+	viper.Set("push_targets", []interface{}{"superterran/mach"})
+	defer viper.Set("push_targets", nil)
+
+	_, err := pushTargets()
+	assert.Error(t, err, "a malformed push_targets should not fall back to the docker_registry")
+}
+
+func Test_pushToTargetsForeignTags(t *testing.T) {
+
+	defer writeDockerConfig(t, `{}`, nil)()
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", ImageManifestFilename), []byte("tags: [stable, ghcr.io/org/php:8.1]\n"), 0644)
+
+	DockerRegistry = "superterran/mach"
+	defer func() { DockerRegistry = "" }()
+
+	build := &imageBuild{
+		Filename: filepath.Join(dir, "php", "Dockerfile"),
+		Tag:      "superterran/mach:php",
+		Tags:     []string{"superterran/mach:php", "superterran/mach:stable", "ghcr.io/org/php:8.1"},
+	}
+
+	targets := []pushTarget{
+		{Host: "registry.example.com", Repository: "mach", Username: "ci", Password: "secret"},
+		{Name: "hub", Repository: "superterran/mach"},
+	}
+
+	var pushed []string
+	err := pushToTargets(build, targets, io.Discard, func(source string, ref string, auth types.AuthConfig, out io.Writer) (string, error) {
+		if strings.HasPrefix(ref, "ghcr.io/") {
+			assert.Empty(t, auth.Username, "the credentials of a target are not sent to another registry")
+		}
+		pushed = append(pushed, ref)
+		return "sha256:abc", nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"ghcr.io/org/php:8.1", "registry.example.com/mach:php", "registry.example.com/mach:stable", "superterran/mach:php", "superterran/mach:stable"}, pushed,
+		"an extra tag naming another registry is pushed once, where it says")
+	assert.Equal(t, "ghcr.io/org/php", build.Pushes[0].Target)
+}
+
+func Test_tagName(t *testing.T) {
+
+	assert.Equal(t, "php", tagName("superterran/mach:php"))
+	assert.Equal(t, "latest", tagName("localhost:5000/mach"))
+	assert.Equal(t, "v1", tagName("localhost:5000/mach:v1"))
+}
+
+func Test_pushToTargetsContinuesAfterFailure(t *testing.T) {
+
+	defer writeDockerConfig(t, `{}`, nil)()
+
+	targets := []pushTarget{
+		{Name: "hub", Repository: "superterran/mach"},
+		{Name: "mirror", Host: "registry.example.com", Repository: "mach", Username: "ci"},
+		{Name: "php-only", Host: "php.example.com", Repository: "mach", Tags: []string{"php*"}},
+	}
+
+	build := &imageBuild{Tag: "superterran/mach:node", Tags: []string{"superterran/mach:node", "superterran/mach:node-18"}}
+
+	var pushed []string
+	err := pushToTargets(build, targets, io.Discard, func(source string, ref string, auth types.AuthConfig, out io.Writer) (string, error) {
+		if auth.ServerAddress == "registry.example.com" {
+			assert.Equal(t, "ci", auth.Username)
+			return "", errors.New("unauthorized")
+		}
+		pushed = append(pushed, ref)
+		return "sha256:" + tagName(ref), nil
+	})
+
+	assert.EqualError(t, err, "push to mirror failed")
+
+	sort.Strings(pushed)
+	assert.Equal(t, []string{"superterran/mach:node", "superterran/mach:node-18"}, pushed, "a failing target should not stop the others")
+	assert.Len(t, build.Pushes, 4, "the filtered target should not push anything")
+	assert.Equal(t, "unauthorized", build.Pushes[2].Error)
+	assert.Equal(t, "sha256:node-18", build.Digests["superterran/mach:node-18"])
+	assert.NotContains(t, build.Digests, "registry.example.com/mach:node")
+}
+
+func Test_pushToTargetsWithoutTargets(t *testing.T) {
+
+	defer writeDockerConfig(t, `{}`, nil)()
+
+	DockerRegistry = "superterran/mach"
+	build := &imageBuild{Tags: []string{"superterran/mach:php"}}
+
+	err := pushToTargets(build, nil, io.Discard, func(source string, ref string, auth types.AuthConfig, out io.Writer) (string, error) {
+		assert.Equal(t, source, ref, "without targets tags are pushed as they are")
+		return "sha256:abc", nil
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []pushResult{{Target: "superterran/mach", Tag: "superterran/mach:php", Digest: "sha256:abc"}}, build.Pushes)
+}
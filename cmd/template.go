@@ -0,0 +1,191 @@
+// Cmd template parses Dockerfile and compose templates and holds the data made available to them
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+)
+
+// StrictTemplates makes a template fail when it refers to a key that does not exist, instead of rendering
+// `<no value>`. Set with `--strict` or `strict_templates`, it defaults to on when the CI environment variable is set.
+var StrictTemplates = os.Getenv("CI") != ""
+
+// templateError is a failure to parse or render a template, pointing at the file, and line and column when
+// known, of the template or include at fault.
+type templateError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *templateError) Error() string {
+
+	location := e.File
+	if e.Line > 0 {
+		location += ":" + strconv.Itoa(e.Line)
+	}
+	if e.Column > 0 {
+		location += ":" + strconv.Itoa(e.Column)
+	}
+
+	return location + ": " + e.Message
+}
+
+var templateErrorPattern = regexp.MustCompile(`template: ([^:\s]+):(\d+):(?:(\d+):)? `)
+
+// newTemplateError turns an error from text/template, which only knows template names, into a templateError
+// with the path of the file the name came from. An error raised in a template rendered by `include` comes
+// wrapped in the error of the caller, the innermost location is the one at fault.
+func newTemplateError(filename string, err error) error {
+
+	msg := err.Error()
+
+	matches := templateErrorPattern.FindAllStringSubmatchIndex(msg, -1)
+	if len(matches) == 0 {
+		return &templateError{File: filename, Message: msg}
+	}
+
+	match := matches[len(matches)-1]
+	name := msg[match[2]:match[3]]
+
+	// only the tpl files in includes are parsed from another file, a template defined inline with `{{ define }}`
+	// is at fault in the file that defines it
+	file := filename
+	if include := filepath.Join(filepath.Dir(filename), "includes", name); name != filepath.Base(filename) && isInclude(include) {
+		file = include
+	}
+
+	line, _ := strconv.Atoi(msg[match[4]:match[5]])
+
+	var column int
+	if match[6] >= 0 {
+		column, _ = strconv.Atoi(msg[match[6]:match[7]])
+	}
+
+	return &templateError{File: file, Line: line, Column: column, Message: msg[match[1]:]}
+}
+
+// isInclude reports if path is one of the tpl files parseTemplate parses from an includes directory
+func isInclude(path string) bool {
+
+	if filepath.Ext(path) != ".tpl" {
+		return false
+	}
+
+	info, err := os.Stat(path)
+
+	return err == nil && !info.IsDir()
+}
+
+// renderTemplate parses and executes a template, writing the output only if the whole template renders
+// cleanly, so a failed template never leaves half a file behind.
+func renderTemplate(wr io.Writer, filename string, data interface{}) error {
+
+	tpl, err := parseTemplate(filename)
+	if err != nil {
+		return newTemplateError(filename, err)
+	}
+
+	if StrictTemplates {
+		tpl.Option("missingkey=error")
+	}
+
+	var buf bytes.Buffer
+	if err := tpl.Execute(&buf, data); err != nil {
+		return newTemplateError(filename, err)
+	}
+
+	_, err = buf.WriteTo(wr)
+
+	return err
+}
+
+// parseTemplate parses a template file along with any tpl files in the `includes` sub directory next to it.
+// Dockerfile and compose templates both go through here, so they share the functions from templateFuncs.
+func parseTemplate(filename string) (*template.Template, error) {
+
+	tpl := template.New(filepath.Base(filename))
+	tpl.Funcs(templateFuncs(tpl, filepath.Dir(filename)))
+
+	if _, err := tpl.ParseFiles(filename); err != nil {
+		return nil, err
+	}
+
+	includes, _ := filepath.Glob(filepath.Dir(filename) + "/includes/*.tpl")
+	if len(includes) > 0 {
+		if _, err := tpl.ParseFiles(includes...); err != nil {
+			return nil, err
+		}
+	}
+
+	return tpl, nil
+}
+
+// dockerfileContext is the data a Dockerfile template is executed with, i.e. `{{ if eq .Variant "go" }}`
+type dockerfileContext struct {
+	// Filename is the name of the template file, i.e. `Dockerfile-go.tpl`
+	Filename string
+	// Name is the image name, `php-8.1` for `php/8.1/Dockerfile`
+	Name string
+	// Dir is the directory the Dockerfile lives in, `8.1` for `php/8.1/Dockerfile`
+	Dir string
+	// Variant is the variant from the filename, `go` for `Dockerfile-go`, empty for `Dockerfile`
+	Variant string
+	// APIVersion is the content of the API_VERSION file for the image, if there is one
+	APIVersion string
+	// Branch is the current git branch, empty with a detached HEAD
+	Branch string
+	// SHA is the short hash of the current git commit
+	SHA string
+	// Tag is the full tag the image is built with
+	Tag string
+	// Registry is the docker registry repository images are pushed to
+	Registry string
+	// Settings holds everything from .mach.yaml, the same data compose templates get
+	Settings map[string]interface{}
+	// Env holds the host environment variables allowed with `template_env`
+	Env map[string]string
+}
+
+func newDockerfileContext(filename string) dockerfileContext {
+
+	branch, sha := getGitHead()
+
+	return dockerfileContext{
+		Filename:   filepath.Base(filename),
+		Name:       imageName(filename),
+		Dir:        filepath.Base(filepath.Dir(filename)),
+		Variant:    fileVariant(filename),
+		APIVersion: strings.TrimSpace(strings.TrimSuffix(getApiVersion(filename), "-")),
+		Branch:     branch,
+		SHA:        sha,
+		Tag:        getTag(filename),
+		Registry:   DockerRegistry,
+		Settings:   viper.AllSettings(),
+		Env:        templateEnv(),
+	}
+}
+
+// templateEnv returns the host environment variables listed under `template_env` in .mach.yaml. Nothing
+// else from the environment is exposed to templates.
+func templateEnv() map[string]string {
+
+	env := map[string]string{}
+
+	for _, name := range viper.GetStringSlice("template_env") {
+		if value, ok := os.LookupEnv(name); ok {
+			env[name] = value
+		}
+	}
+
+	return env
+}
@@ -0,0 +1,155 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_newDockerfileContext(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	BuildVariantFromParam = ""
+
+	var actual = newDockerfileContext("../examples/images/example/Dockerfile-go")
+
+	assert.Equal(t, "example", actual.Name)
+	assert.Equal(t, "go", actual.Variant)
+	assert.Equal(t, "v1", actual.APIVersion)
+	assert.Equal(t, "superterran/mach:v1-example-go", actual.Tag)
+	assert.Equal(t, "superterran/mach", actual.Registry)
+}
+
+func Test_templateEnvAllowlist(t *testing.T) {
+
+	os.Setenv("MACH_TEST_ALLOWED", "yes")
+	os.Setenv("MACH_TEST_SECRET", "no")
+	viper.Set("template_env", []string{"MACH_TEST_ALLOWED"})
+	defer viper.Set("template_env", nil)
+
+	var actual = templateEnv()
+
+	assert.Equal(t, map[string]string{"MACH_TEST_ALLOWED": "yes"}, actual,
+		"only allowed environment variables should reach templates",
+	)
+}
+
+func Test_generateDockerfileTemplateContext(t *testing.T) {
+
+	DockerRegistry = "superterran/mach"
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n"})
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "php", "API_VERSION"), []byte("8.1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "php", "Dockerfile-fpm.tpl"), []byte(
+		"FROM php:{{ .APIVersion }}-{{ .Variant }}\nLABEL image={{ .Name }}\n"), 0644)
+
+	var buff bytes.Buffer
+	generateDockerfileTemplate(&buff, filepath.Join(dir, "php", "Dockerfile-fpm.tpl"))
+
+	assert.Equal(t, "FROM php:8.1-fpm\nLABEL image=php\n", buff.String())
+}
+
+func Test_renderTemplateStrictMissingKey(t *testing.T) {
+
+	StrictTemplates = true
+	defer func() { StrictTemplates = false }()
+
+	dir := writeTestImages(t, map[string]string{"satis": ""})
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "satis", "docker-compose.yml.tpl")
+	ioutil.WriteFile(filename, []byte("services:\n  satis:\n    environment:\n      - VIRTUAL_HOST={{ .domian_name }}\n"), 0644)
+
+	var buff bytes.Buffer
+	err := renderTemplate(&buff, filename, map[string]interface{}{"domain_name": "example.com"})
+
+	assert.Error(t, err, "a missing key should fail in strict mode")
+	assert.Contains(t, err.Error(), filename+":4:")
+	assert.Contains(t, err.Error(), "domian_name")
+	assert.Empty(t, buff.String(), "nothing should be written when the template fails")
+
+	StrictTemplates = false
+	err = renderTemplate(&buff, filename, map[string]interface{}{})
+
+	assert.NoError(t, err, "a missing key renders <no value> outside of strict mode")
+}
+
+func Test_renderTemplateIncludeErrorLocation(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": ""})
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "php", "includes"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "php", "includes", "run.tpl"), []byte("RUN true\n{{ .Missing }}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "php", "Dockerfile.tpl"), []byte("FROM alpine\n{{ template \"run.tpl\" . }}"), 0644)
+
+	err := generateDockerfileTemplate(&bytes.Buffer{}, filepath.Join(dir, "php", "Dockerfile.tpl"))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "php", "includes", "run.tpl")+":2:3:")
+}
+
+func Test_renderTemplateIncludeFuncErrorLocation(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": ""})
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "php", "includes"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "php", "includes", "run.tpl"), []byte("RUN true\n{{ required \"cmd\" .cmd }}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "php", "Dockerfile.tpl"), []byte("FROM alpine\n\n{{ include \"run.tpl\" . }}"), 0644)
+
+	err := generateDockerfileTemplate(&bytes.Buffer{}, filepath.Join(dir, "php", "Dockerfile.tpl"))
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), filepath.Join(dir, "php", "includes", "run.tpl")+":2:", "the include is at fault, not its caller")
+		assert.NotContains(t, err.Error(), "Dockerfile.tpl")
+	}
+}
+
+func Test_renderTemplateParseError(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n{{ if }}\n"})
+	defer os.RemoveAll(dir)
+
+	err := generateDockerfileTemplate(&bytes.Buffer{}, filepath.Join(dir, "php", "Dockerfile"))
+
+	assert.Error(t, err, "parse errors should be returned, not panic")
+	assert.Contains(t, err.Error(), filepath.Join(dir, "php", "Dockerfile")+":2")
+}
+
+func Test_newTemplateErrorInlineDefine(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": ""})
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "php", "includes"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "php", "includes", "run.tpl"), []byte("RUN true\n"), 0644)
+
+	filename := filepath.Join(dir, "php", "Dockerfile")
+
+	err := newTemplateError(filename, errors.New(`template: packages:3:9: executing "packages" at <.x>: map has no entry for key "x"`))
+	assert.EqualError(t, err, filename+`:3:9: executing "packages" at <.x>: map has no entry for key "x"`, "a template defined inline is at fault in its Dockerfile")
+
+	err = newTemplateError(filename, errors.New(`template: run.tpl:1:5: executing "run.tpl" at <.x>: map has no entry for key "x"`))
+	assert.EqualError(t, err, filepath.Join(dir, "php", "includes", "run.tpl")+`:1:5: executing "run.tpl" at <.x>: map has no entry for key "x"`)
+}
+
+func Test_renderTemplateInlineDefineErrorLocation(t *testing.T) {
+
+	dir := writeTestImages(t, map[string]string{"php": "FROM alpine\n{{ define \"packages\" }}\nRUN {{ required \"packages\" .packages }}\n{{ end }}\n{{ include \"packages\" . }}\n"})
+	defer os.RemoveAll(dir)
+
+	err := generateDockerfileTemplate(&bytes.Buffer{}, filepath.Join(dir, "php", "Dockerfile"))
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), filepath.Join(dir, "php", "Dockerfile")+":3:")
+		assert.NotContains(t, err.Error(), "includes")
+	}
+}
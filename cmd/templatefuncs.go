@@ -0,0 +1,164 @@
+// Cmd templatefuncs is the function library available to Dockerfile and compose templates
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"text/template"
+
+	"github.com/spf13/viper"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+	"gopkg.in/yaml.v3"
+)
+
+// templateFuncs returns the functions for a template. `include` renders other templates parsed into tpl, and
+// `fileContents` reads files relative to dir, the directory of the template being rendered.
+func templateFuncs(tpl *template.Template, dir string) template.FuncMap {
+
+	return template.FuncMap{
+		"default":  defaultValue,
+		"required": required,
+		"env":      allowedEnv,
+		"toYaml":   toYaml,
+		"toJson":   toJson,
+		"indent":   indent,
+		"nindent":  func(spaces int, s string) string { return "\n" + indent(spaces, s) },
+		"include": func(name string, data interface{}) (string, error) {
+			var buf bytes.Buffer
+			err := tpl.ExecuteTemplate(&buf, name, data)
+			return buf.String(), err
+		},
+		"fileContents": func(path string) (string, error) {
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(dir, path)
+			}
+			content, err := ioutil.ReadFile(path)
+			return string(content), err
+		},
+		"upper":       strings.ToUpper,
+		"lower":       strings.ToLower,
+		"title":       title,
+		"trim":        strings.TrimSpace,
+		"trimPrefix":  func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix":  func(suffix string, s string) string { return strings.TrimSuffix(s, suffix) },
+		"replace":     func(old string, new string, s string) string { return strings.ReplaceAll(s, old, new) },
+		"contains":    func(substr string, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":   func(prefix string, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":   func(suffix string, s string) bool { return strings.HasSuffix(s, suffix) },
+		"split":       func(sep string, s string) []string { return strings.Split(s, sep) },
+		"join":        join,
+		"quote":       func(s interface{}) string { return fmt.Sprintf("%q", fmt.Sprint(s)) },
+		"squote":      squote,
+		"imageDigest": imageDigest,
+		"imageTag":    resolveImageTag,
+	}
+}
+
+// title upper-cases the first letter of each word, leaving the rest as it is. A caser keeps state, so each call
+// gets its own.
+func title(s string) string {
+
+	return cases.Title(language.Und, cases.NoLower).String(s)
+}
+
+// squote wraps a value in single quotes for the shell, each quote inside it is closed, escaped and reopened
+func squote(s interface{}) string {
+
+	return "'" + strings.ReplaceAll(fmt.Sprint(s), "'", `'\''`) + "'"
+}
+
+// defaultValue returns the given value, or the default when it is empty, i.e. `{{ .Env.PHP | default "8.1" }}`
+func defaultValue(def interface{}, given ...interface{}) interface{} {
+
+	if len(given) == 0 || isEmpty(given[0]) {
+		return def
+	}
+
+	return given[0]
+}
+
+// required fails the render with the message when the value is empty, i.e. `{{ required "set domain_name" .domain_name }}`
+func required(msg string, value interface{}) (interface{}, error) {
+
+	if isEmpty(value) {
+		return nil, errors.New(msg)
+	}
+
+	return value, nil
+}
+
+// allowedEnv returns a host environment variable, as long as it is listed under `template_env`
+func allowedEnv(name string) (string, error) {
+
+	for _, allowed := range viper.GetStringSlice("template_env") {
+		if allowed == name {
+			return os.Getenv(name), nil
+		}
+	}
+
+	return "", fmt.Errorf("environment variable %s is not listed in template_env", name)
+}
+
+func toYaml(value interface{}) (string, error) {
+
+	out, err := yaml.Marshal(value)
+
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
+func toJson(value interface{}) (string, error) {
+
+	out, err := json.Marshal(value)
+
+	return string(out), err
+}
+
+// indent pads every line of s with the given number of spaces
+func indent(spaces int, s string) string {
+
+	pad := strings.Repeat(" ", spaces)
+
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+// join glues any list together with sep, so it works on settings from .mach.yaml as well as string slices
+func join(sep string, list interface{}) string {
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return fmt.Sprint(list)
+	}
+
+	var parts []string
+	for i := 0; i < v.Len(); i++ {
+		parts = append(parts, fmt.Sprint(v.Index(i).Interface()))
+	}
+
+	return strings.Join(parts, sep)
+}
+
+// isEmpty follows the same rules as `if` in templates, nil, zero values and empty collections are empty
+func isEmpty(value interface{}) bool {
+
+	if value == nil {
+		return true
+	}
+
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+
+	return v.IsZero()
+}
@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+// renderTestTemplate writes a template, and optional includes, to a temp dir and renders it with data
+func renderTestTemplate(t *testing.T, content string, includes map[string]string, data interface{}) (string, error) {
+
+	dir, _ := ioutil.TempDir("", "mach-template")
+	defer os.RemoveAll(dir)
+
+	os.MkdirAll(filepath.Join(dir, "includes"), 0755)
+	for name, include := range includes {
+		ioutil.WriteFile(filepath.Join(dir, "includes", name), []byte(include), 0644)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "Dockerfile.tpl"), []byte(content), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "motd"), []byte("welcome"), 0644)
+
+	tpl, err := parseTemplate(filepath.Join(dir, "Dockerfile.tpl"))
+	if err != nil {
+		return "", err
+	}
+
+	var buff bytes.Buffer
+	err = tpl.Execute(&buff, data)
+
+	return buff.String(), err
+}
+
+func Test_templateFuncsNoEscaping(t *testing.T) {
+
+	actual, err := renderTestTemplate(t, `RUN apt-get update && echo "{{ .name }}"`, nil, map[string]string{"name": "<mach>"})
+
+	assert.NoError(t, err)
+	assert.Equal(t, `RUN apt-get update && echo "<mach>"`, actual, "Dockerfiles should not be html escaped")
+}
+
+func Test_templateFuncsDefaultRequired(t *testing.T) {
+
+	actual, err := renderTestTemplate(t, `{{ .missing | default "8.1" }} {{ .set | default "8.1" }}`, nil, map[string]string{"set": "7.4"})
+	assert.NoError(t, err)
+	assert.Equal(t, "8.1 7.4", actual)
+
+	_, err = renderTestTemplate(t, `{{ required "domain_name is required" .domain_name }}`, nil, map[string]string{})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "domain_name is required")
+}
+
+func Test_templateFuncsEnvAllowlist(t *testing.T) {
+
+	os.Setenv("MACH_TEST_ALLOWED", "yes")
+	viper.Set("template_env", []string{"MACH_TEST_ALLOWED"})
+	defer viper.Set("template_env", nil)
+
+	actual, err := renderTestTemplate(t, `{{ env "MACH_TEST_ALLOWED" }}`, nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "yes", actual)
+
+	_, err = renderTestTemplate(t, `{{ env "HOME" }}`, nil, nil)
+	assert.Error(t, err, "variables outside of template_env should not be readable")
+}
+
+func Test_templateFuncsSerializers(t *testing.T) {
+
+	data := map[string]interface{}{"env": map[string]string{"A": "1"}}
+
+	actual, err := renderTestTemplate(t, "env:{{ .env | toYaml | nindent 2 }}\n{{ .env | toJson }}", nil, data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "env:\n  A: \"1\"\n{\"A\":\"1\"}", actual)
+}
+
+func Test_templateFuncsStrings(t *testing.T) {
+
+	data := map[string]interface{}{"name": "php-fpm", "list": []interface{}{"a", "b"}}
+
+	actual, err := renderTestTemplate(t, `{{ .name | upper | replace "-" "_" }} {{ join "," .list }} {{ if hasPrefix "php" .name }}{{ .name | trimPrefix "php-" | quote }}{{ end }}`, nil, data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `PHP_FPM a,b "fpm"`, actual)
+}
+
+func Test_templateFuncsQuoting(t *testing.T) {
+
+	data := map[string]interface{}{"name": "php fpm", "motd": "it's up"}
+
+	actual, err := renderTestTemplate(t, `{{ .name | title }} {{ .motd | squote }}`, nil, data)
+
+	assert.NoError(t, err)
+	assert.Equal(t, `Php Fpm 'it'\''s up'`, actual, "single quotes should be escaped for the shell")
+}
+
+func Test_templateFuncsIncludeAndFiles(t *testing.T) {
+
+	actual, err := renderTestTemplate(t, `{{ include "run.tpl" "ls" | indent 2 }}|{{ fileContents "motd" }}`,
+		map[string]string{"run.tpl": "RUN {{ . }}"}, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "  RUN ls|welcome", actual)
+}
@@ -0,0 +1,337 @@
+// Cmd versions compares package versions the way each packaging ecosystem orders them
+package cmd
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionCompare returns -1, 0 or 1 as version a is older than, the same as or newer than b
+type versionCompare func(a string, b string) int
+
+// preReleaseMarker matches the pre-release parts of apk, python, ruby and php versions, like `_rc1` or `b2`
+var preReleaseMarker = regexp.MustCompile(`(?i)[._-]?(alpha|beta|pre|rc|dev|a|b)(\d+)|[._-]?(alpha|beta|pre|rc|dev)`)
+
+// compareDpkg orders Debian versions, `[epoch:]upstream[-revision]`, as dpkg does
+func compareDpkg(a string, b string) int {
+
+	epochA, upstreamA, revisionA := splitDpkgVersion(a)
+	epochB, upstreamB, revisionB := splitDpkgVersion(b)
+
+	if epochA != epochB {
+		return compareInts(epochA, epochB)
+	}
+
+	if c := compareDpkgPart(upstreamA, upstreamB); c != 0 {
+		return c
+	}
+
+	return compareDpkgPart(revisionA, revisionB)
+}
+
+func splitDpkgVersion(version string) (int, string, string) {
+
+	epoch := 0
+	if i := strings.Index(version, ":"); i >= 0 {
+		epoch, _ = strconv.Atoi(version[:i])
+		version = version[i+1:]
+	}
+
+	revision := ""
+	if i := strings.LastIndex(version, "-"); i >= 0 {
+		revision = version[i+1:]
+		version = version[:i]
+	}
+
+	return epoch, version, revision
+}
+
+// compareDpkgPart compares alternating runs of non-digits and digits, in the non-digits `~` sorts before
+// anything, even the end of the string, and letters before everything else
+func compareDpkgPart(a string, b string) int {
+
+	order := func(c byte) int {
+		switch {
+		case c == '~':
+			return -1
+		case c >= '0' && c <= '9':
+			return 0
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			return int(c)
+		}
+		return int(c) + 256
+	}
+
+	for a != "" || b != "" {
+		for (a != "" && !isDigit(a[0])) || (b != "" && !isDigit(b[0])) {
+			var ca, cb int
+			if a != "" && !isDigit(a[0]) {
+				ca = order(a[0])
+			}
+			if b != "" && !isDigit(b[0]) {
+				cb = order(b[0])
+			}
+			if ca != cb {
+				return compareInts(ca, cb)
+			}
+			if a != "" && !isDigit(a[0]) {
+				a = a[1:]
+			}
+			if b != "" && !isDigit(b[0]) {
+				b = b[1:]
+			}
+		}
+
+		var na, nb string
+		na, a = leadingDigits(a)
+		nb, b = leadingDigits(b)
+		if c := compareNumeric(na, nb); c != 0 {
+			return c
+		}
+	}
+
+	return 0
+}
+
+// compareRPM orders rpm versions, `[epoch:]version[-release]`, as rpmvercmp does
+func compareRPM(a string, b string) int {
+
+	epochA, versionA, releaseA := splitDpkgVersion(a)
+	epochB, versionB, releaseB := splitDpkgVersion(b)
+
+	if epochA != epochB {
+		return compareInts(epochA, epochB)
+	}
+
+	if c := rpmvercmp(versionA, versionB); c != 0 {
+		return c
+	}
+
+	if releaseA == "" || releaseB == "" {
+		return 0
+	}
+
+	return rpmvercmp(releaseA, releaseB)
+}
+
+// rpmvercmp compares runs of letters and digits, ignoring separators. A numeric run is newer than a letter
+// one, `~` is older than anything, and with everything else equal the version with more runs is newer.
+func rpmvercmp(a string, b string) int {
+
+	for {
+		a = strings.TrimLeftFunc(a, func(r rune) bool { return !isAlnum(r) && r != '~' })
+		b = strings.TrimLeftFunc(b, func(r rune) bool { return !isAlnum(r) && r != '~' })
+
+		if strings.HasPrefix(a, "~") || strings.HasPrefix(b, "~") {
+			if !strings.HasPrefix(a, "~") {
+				return 1
+			}
+			if !strings.HasPrefix(b, "~") {
+				return -1
+			}
+			a, b = a[1:], b[1:]
+			continue
+		}
+
+		if a == "" || b == "" {
+			break
+		}
+
+		var segA, segB string
+		if isDigit(a[0]) {
+			segA, a = leadingDigits(a)
+			segB, b = leadingDigits(b)
+			if segB == "" {
+				return 1
+			}
+			if c := compareNumeric(segA, segB); c != 0 {
+				return c
+			}
+			continue
+		}
+
+		segA, a = leadingLetters(a)
+		segB, b = leadingLetters(b)
+		if segB == "" {
+			return -1
+		}
+		if c := strings.Compare(segA, segB); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case a == "" && b == "":
+		return 0
+	case a == "":
+		return -1
+	}
+
+	return 1
+}
+
+// compareSemver orders semantic versions, a leading `v` and build metadata are ignored
+func compareSemver(a string, b string) int {
+
+	coreA, preA := splitSemver(a)
+	coreB, preB := splitSemver(b)
+
+	partsA := strings.Split(coreA, ".")
+	partsB := strings.Split(coreB, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var pa, pb string
+		if i < len(partsA) {
+			pa = partsA[i]
+		}
+		if i < len(partsB) {
+			pb = partsB[i]
+		}
+		if c := compareNumeric(pa, pb); c != 0 {
+			return c
+		}
+	}
+
+	switch {
+	case preA == preB:
+		return 0
+	case preA == "":
+		return 1
+	case preB == "":
+		return -1
+	}
+
+	idsA := strings.Split(preA, ".")
+	idsB := strings.Split(preB, ".")
+	for i := 0; i < len(idsA) && i < len(idsB); i++ {
+		numA, errA := strconv.Atoi(idsA[i])
+		numB, errB := strconv.Atoi(idsB[i])
+
+		switch {
+		case errA == nil && errB == nil:
+			if c := compareInts(numA, numB); c != 0 {
+				return c
+			}
+		case errA == nil:
+			return -1
+		case errB == nil:
+			return 1
+		default:
+			if c := strings.Compare(idsA[i], idsB[i]); c != 0 {
+				return c
+			}
+		}
+	}
+
+	return compareInts(len(idsA), len(idsB))
+}
+
+func splitSemver(version string) (string, string) {
+
+	version = strings.TrimPrefix(version, "v")
+
+	if i := strings.Index(version, "+"); i >= 0 {
+		version = version[:i]
+	}
+
+	if i := strings.Index(version, "-"); i >= 0 {
+		return version[:i], version[i+1:]
+	}
+
+	return version, ""
+}
+
+// compareGeneric orders the versions of apk, python, ruby and php packages closely enough for advisories:
+// rpmvercmp, with pre-releases like `_rc1`, `b2` or `.beta` sorting before the release
+func compareGeneric(a string, b string) int {
+
+	marked := func(version string) string {
+		return preReleaseMarker.ReplaceAllString(version, "~$1$2$3")
+	}
+
+	return rpmvercmp(marked(a), marked(b))
+}
+
+// comparePackagist is compareGeneric for composer packages, whose versions are often the git tag with its `v`,
+// `v5.4.30`, in composer.lock and in advisories alike
+func comparePackagist(a string, b string) int {
+
+	trim := func(version string) string {
+		if len(version) > 1 && (version[0] == 'v' || version[0] == 'V') && version[1] >= '0' && version[1] <= '9' {
+			return version[1:]
+		}
+		return version
+	}
+
+	return compareGeneric(trim(a), trim(b))
+}
+
+// ecosystemVersionCompare returns how versions are ordered in an OSV ecosystem
+func ecosystemVersionCompare(ecosystem string) versionCompare {
+
+	switch ecosystemBase(ecosystem) {
+	case "Debian", "Ubuntu":
+		return compareDpkg
+	case "Red Hat", "Rocky Linux", "AlmaLinux", "openSUSE", "SUSE":
+		return compareRPM
+	case "npm", "Go", "crates.io":
+		return compareSemver
+	case "Packagist":
+		return comparePackagist
+	}
+
+	return compareGeneric
+}
+
+func compareInts(a int, b int) int {
+
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+
+	return 0
+}
+
+// compareNumeric compares strings of digits of any length, empty is zero
+func compareNumeric(a string, b string) int {
+
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+
+	if len(a) != len(b) {
+		return compareInts(len(a), len(b))
+	}
+
+	return strings.Compare(a, b)
+}
+
+func leadingDigits(s string) (string, string) {
+
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+func leadingLetters(s string) (string, string) {
+
+	i := 0
+	for i < len(s) && (s[i] >= 'a' && s[i] <= 'z' || s[i] >= 'A' && s[i] <= 'Z') {
+		i++
+	}
+
+	return s[:i], s[i:]
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isAlnum(r rune) bool {
+	return r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+}
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_compareDpkg(t *testing.T) {
+
+	assert.Equal(t, -1, compareDpkg("1.1.1n-0+deb11u3", "1.1.1n-0+deb11u4"))
+	assert.Equal(t, 1, compareDpkg("1:1.0-1", "2.0-1"), "the epoch wins")
+	assert.Equal(t, -1, compareDpkg("1.0~rc1-1", "1.0-1"), "~ sorts before the release")
+	assert.Equal(t, 1, compareDpkg("7.74.0-1.3+deb11u7", "7.74.0-1.3"))
+	assert.Equal(t, -1, compareDpkg("2.31-13", "2.31-13+deb11u5"))
+	assert.Equal(t, 1, compareDpkg("1.10", "1.9"))
+	assert.Equal(t, 0, compareDpkg("0:1.0-1", "1.0-1"))
+}
+
+func Test_compareRPM(t *testing.T) {
+
+	assert.Equal(t, -1, compareRPM("5.1.8-4.el9", "5.1.8-6.el9"))
+	assert.Equal(t, 1, compareRPM("3.0.7-6.el9_2", "3.0.7-6.el9"))
+	assert.Equal(t, -1, compareRPM("1.0~beta", "1.0"))
+	assert.Equal(t, 1, compareRPM("1.0.1", "1.0a"), "numbers are newer than letters")
+	assert.Equal(t, 0, compareRPM("1.0-1", "1.0"), "a missing release matches any")
+}
+
+func Test_compareSemver(t *testing.T) {
+
+	assert.Equal(t, -1, compareSemver("1.2.3", "1.10.0"))
+	assert.Equal(t, -1, compareSemver("1.0.0-rc.1", "1.0.0"))
+	assert.Equal(t, -1, compareSemver("1.0.0-alpha", "1.0.0-alpha.1"))
+	assert.Equal(t, -1, compareSemver("1.0.0-alpha.2", "1.0.0-alpha.10"))
+	assert.Equal(t, 0, compareSemver("v0.3.7", "0.3.7+incompatible"))
+}
+
+func Test_compareGeneric(t *testing.T) {
+
+	assert.Equal(t, -1, compareGeneric("1.35.0-r17", "1.35.0-r18"), "apk revisions")
+	assert.Equal(t, -1, compareGeneric("3.0.8_rc1-r0", "3.0.8-r0"), "apk pre-releases")
+	assert.Equal(t, -1, compareGeneric("2.0.0b2", "2.0.0"), "python pre-releases")
+	assert.Equal(t, -1, compareGeneric("2.0.0b2", "2.0.0rc1"))
+	assert.Equal(t, 1, compareGeneric("7.0.4.1", "7.0.4"), "ruby patch releases")
+}
+
+func Test_comparePackagist(t *testing.T) {
+
+	compare := ecosystemVersionCompare("Packagist")
+
+	assert.Equal(t, 1, compare("v5.4.30", "5.4.20"), "composer.lock keeps the v of the git tag")
+	assert.Equal(t, 0, compare("v5.4.20", "5.4.20"))
+	assert.Equal(t, -1, compare("5.4.19", "v5.4.20"))
+	assert.Equal(t, -1, compare("v2.0.0-beta1", "v2.0.0"))
+}